@@ -3,6 +3,7 @@ package config
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/crypto"
@@ -52,11 +53,15 @@ type Config struct {
 
 	PeerKey crypto.PrivKey
 
-	Transports         []TptC
-	Muxers             []MsMuxC
-	SecurityTransports []MsSecC
-	Insecure           bool
-	PSK                pnet.PSK
+	Transports      []TptC
+	Muxers          []MsMuxC
+	MuxerPreference []string
+	// TransportDialTimeouts maps transport protocol names to the timeout of
+	// their dials.
+	TransportDialTimeouts map[string]time.Duration
+	SecurityTransports    []MsSecC
+	Insecure              bool
+	PSK                   pnet.PSK
 
 	RelayCustom bool
 	Relay       bool
@@ -157,7 +162,7 @@ func (cfg *Config) NewNode(ctx context.Context) (host.Host, error) {
 		}
 	}
 
-	upgrader.Muxer, err = makeMuxer(h, cfg.Muxers)
+	upgrader.Muxer, err = makeMuxer(h, cfg.Muxers, cfg.MuxerPreference...)
 	if err != nil {
 		h.Close()
 		return nil, err
@@ -168,6 +173,11 @@ func (cfg *Config) NewNode(ctx context.Context) (host.Host, error) {
 		h.Close()
 		return nil, err
 	}
+	tpts, err = applyDialTimeouts(tpts, cfg.TransportDialTimeouts)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
 	for _, t := range tpts {
 		err = swrm.AddTransport(t)
 		if err != nil {
@@ -43,7 +43,7 @@ func MuxerConstructor(m interface{}) (MuxC, error) {
 	}, nil
 }
 
-func makeMuxer(h host.Host, tpts []MsMuxC) (mux.Multiplexer, error) {
+func makeMuxer(h host.Host, tpts []MsMuxC, preference ...string) (mux.Multiplexer, error) {
 	muxMuxer := msmux.NewBlankTransport()
 	transportSet := make(map[string]struct{}, len(tpts))
 	for _, tptC := range tpts {
@@ -59,5 +59,39 @@ func makeMuxer(h host.Host, tpts []MsMuxC) (mux.Multiplexer, error) {
 		}
 		muxMuxer.AddTransport(tptC.ID, tpt)
 	}
+	if err := orderMuxers(muxMuxer, preference); err != nil {
+		return nil, err
+	}
 	return muxMuxer, nil
 }
+
+// orderMuxers moves the muxers named in preference, in that order, in front
+// of the others when negotiating the muxer of a connection.
+func orderMuxers(muxMuxer *msmux.Transport, preference []string) error {
+	if len(preference) == 0 {
+		return nil
+	}
+	known := make(map[string]bool, len(muxMuxer.OrderPreference))
+	for _, id := range muxMuxer.OrderPreference {
+		known[id] = true
+	}
+	ordered := make([]string, 0, len(muxMuxer.OrderPreference))
+	seen := make(map[string]bool, len(preference))
+	for _, id := range preference {
+		if !known[id] {
+			return fmt.Errorf("muxer preference for unknown muxer: %s", id)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ordered = append(ordered, id)
+	}
+	for _, id := range muxMuxer.OrderPreference {
+		if !seen[id] {
+			ordered = append(ordered, id)
+		}
+	}
+	muxMuxer.OrderPreference = ordered
+	return nil
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"context"
+	"reflect"
 	"testing"
 
 	"github.com/libp2p/go-libp2p-core/host"
@@ -11,6 +12,7 @@ import (
 
 	mux "github.com/libp2p/go-libp2p-core/mux"
 	yamux "github.com/libp2p/go-libp2p-yamux"
+	msmux "github.com/libp2p/go-stream-muxer-multistream"
 )
 
 func TestMuxerSimple(t *testing.T) {
@@ -100,3 +102,27 @@ func TestCatchDuplicateTransportsMuxer(t *testing.T) {
 		})
 	}
 }
+
+func TestMuxerPreference(t *testing.T) {
+	ctx := context.Background()
+	h := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	yamuxMuxer, err := MuxerConstructor(yamux.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transports := []MsMuxC{{yamuxMuxer, "a"}, {yamuxMuxer, "b"}, {yamuxMuxer, "c"}}
+
+	m, err := makeMuxer(h, transports, "c", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := m.(*msmux.Transport).OrderPreference
+	if !reflect.DeepEqual(order, []string{"c", "a", "b"}) {
+		t.Fatalf("expected the preferred muxers first, got %v", order)
+	}
+
+	if _, err := makeMuxer(h, transports, "d"); err == nil {
+		t.Fatal("expected a preference for an unknown muxer to fail")
+	}
+}
@@ -1,10 +1,16 @@
 package config
 
 import (
+	"context"
+	"fmt"
+	"time"
+
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/transport"
 
 	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 // TptC is the type for libp2p transport constructors. You probably won't ever
@@ -65,3 +71,44 @@ func makeTransports(h host.Host, u *tptu.Upgrader, tpts []TptC) ([]transport.Tra
 	}
 	return transports, nil
 }
+
+// dialTimeoutTransport bounds the time spent in each dial of a transport.
+type dialTimeoutTransport struct {
+	transport.Transport
+	timeout time.Duration
+}
+
+func (t *dialTimeoutTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.Transport.Dial(ctx, raddr, p)
+}
+
+// applyDialTimeouts wraps the transports handling one of the protocols of
+// timeouts, by name, so that their dials time out after the given duration.
+func applyDialTimeouts(tpts []transport.Transport, timeouts map[string]time.Duration) ([]transport.Transport, error) {
+	if len(timeouts) == 0 {
+		return tpts, nil
+	}
+
+	byCode := make(map[int]time.Duration, len(timeouts))
+	for name, timeout := range timeouts {
+		proto := ma.ProtocolWithName(name)
+		if proto.Code == 0 {
+			return nil, fmt.Errorf("unknown transport protocol %q", name)
+		}
+		byCode[proto.Code] = timeout
+	}
+
+	wrapped := make([]transport.Transport, len(tpts))
+	for i, t := range tpts {
+		wrapped[i] = t
+		for _, code := range t.Protocols() {
+			if timeout, ok := byCode[code]; ok {
+				wrapped[i] = &dialTimeoutTransport{Transport: t, timeout: timeout}
+				break
+			}
+		}
+	}
+	return wrapped, nil
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// blockingTransport blocks dials until their context is done.
+type blockingTransport struct {
+	transport.Transport
+	protocols []int
+}
+
+func (t *blockingTransport) Dial(ctx context.Context, _ ma.Multiaddr, _ peer.ID) (transport.CapableConn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (t *blockingTransport) Protocols() []int {
+	return t.protocols
+}
+
+func TestTransportDialTimeouts(t *testing.T) {
+	tcp := &blockingTransport{protocols: []int{ma.P_TCP}}
+	quic := &blockingTransport{protocols: []int{ma.P_QUIC}}
+
+	tpts, err := applyDialTimeouts([]transport.Transport{tcp, quic}, map[string]time.Duration{
+		"tcp": 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tpts[1] != quic {
+		t.Fatal("expected the QUIC transport to be left untouched")
+	}
+
+	start := time.Now()
+	if _, err := tpts[0].Dial(context.Background(), ma.StringCast("/ip4/1.2.3.4/tcp/1"), ""); err != context.DeadlineExceeded {
+		t.Fatalf("expected the dial to time out, got %v", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("dial took %s", took)
+	}
+
+	if _, err := applyDialTimeouts([]transport.Transport{tcp}, map[string]time.Duration{"foo": time.Second}); err == nil {
+		t.Fatal("expected an unknown transport protocol to fail")
+	}
+}
@@ -6,6 +6,7 @@ package libp2p
 import (
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/crypto"
@@ -107,6 +108,32 @@ func Muxer(name string, tpt interface{}) Option {
 	}
 }
 
+// MuxerPreference sets the order in which the stream multiplexers are
+// proposed when negotiating the muxer of a connection, e.g. to favor yamux
+// over mplex. The given names are protocol names of muxers configured with
+// the Muxer option, or the default muxers. Muxers not listed are proposed
+// after them, in the order they were configured.
+func MuxerPreference(names ...string) Option {
+	return func(cfg *Config) error {
+		cfg.MuxerPreference = append(cfg.MuxerPreference, names...)
+		return nil
+	}
+}
+
+// TransportDialTimeout bounds the time spent dialing an address with the
+// transport handling the given protocol, e.g. "tcp" or "quic", independently
+// of the other transports. It can only shorten the dial timeout of the
+// network, not extend it.
+func TransportDialTimeout(transport string, timeout time.Duration) Option {
+	return func(cfg *Config) error {
+		if cfg.TransportDialTimeouts == nil {
+			cfg.TransportDialTimeouts = make(map[string]time.Duration)
+		}
+		cfg.TransportDialTimeouts[transport] = timeout
+		return nil
+	}
+}
+
 // Transport configures libp2p to use the given transport (or transport
 // constructor).
 //
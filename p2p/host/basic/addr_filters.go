@@ -0,0 +1,59 @@
+package basichost
+
+import (
+	"net"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// AddressFilter reports whether an address must not be announced, see
+// HostOpts.AddressBlacklist.
+type AddressFilter func(ma.Multiaddr) bool
+
+// FilterLoopback filters loopback addresses.
+func FilterLoopback(a ma.Multiaddr) bool {
+	return manet.IsIPLoopback(a)
+}
+
+// FilterPrivateNet filters addresses in private networks, including loopback
+// and link-local addresses.
+func FilterPrivateNet(a ma.Multiaddr) bool {
+	return manet.IsPrivateAddr(a)
+}
+
+// FilterLinkLocal filters IPv4 and IPv6 link-local addresses.
+func FilterLinkLocal(a ma.Multiaddr) bool {
+	c, _ := ma.SplitFirst(a)
+	if c == nil {
+		return false
+	}
+	switch c.Protocol().Code {
+	case ma.P_IP4, ma.P_IP6:
+		ip := net.IP(c.RawValue())
+		return ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+	case ma.P_IP6ZONE:
+		return manet.IsIP6LinkLocal(a)
+	}
+	return false
+}
+
+// blacklistAddrs removes the addresses matching one of the filters of
+// HostOpts.AddressBlacklist from addrs.
+func (h *BasicHost) blacklistAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if len(h.addrBlacklist) == 0 {
+		return addrs
+	}
+
+	allowed := make([]ma.Multiaddr, 0, len(addrs))
+outer:
+	for _, a := range addrs {
+		for _, f := range h.addrBlacklist {
+			if f(a) {
+				continue outer
+			}
+		}
+		allowed = append(allowed, a)
+	}
+	return allowed
+}
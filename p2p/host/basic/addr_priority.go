@@ -0,0 +1,44 @@
+package basichost
+
+import (
+	"sort"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// PrioritizeLocalAddrs is a HostOpts.DialAddressPrioritizer putting private
+// and loopback addresses first, keeping the order of the addresses
+// otherwise.
+func PrioritizeLocalAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	return prioritizeAddrs(addrs, manet.IsPrivateAddr)
+}
+
+// PrioritizeQUIC is a HostOpts.DialAddressPrioritizer putting QUIC addresses
+// before the others, in particular TCP ones, keeping the order of the
+// addresses otherwise.
+func PrioritizeQUIC(addrs []ma.Multiaddr) []ma.Multiaddr {
+	return prioritizeAddrs(addrs, func(a ma.Multiaddr) bool {
+		_, err := a.ValueForProtocol(ma.P_QUIC)
+		return err == nil
+	})
+}
+
+// prioritizeDialAddrs applies the DialAddressPrioritizer, if any, to addrs.
+func (h *BasicHost) prioritizeDialAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if h.dialPrioritizer == nil || len(addrs) == 0 {
+		return addrs
+	}
+	return h.dialPrioritizer(addrs)
+}
+
+// prioritizeAddrs returns a copy of addrs with the addresses for which first
+// returns true first.
+func prioritizeAddrs(addrs []ma.Multiaddr, first func(ma.Multiaddr) bool) []ma.Multiaddr {
+	sorted := make([]ma.Multiaddr, len(addrs))
+	copy(sorted, addrs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return first(sorted[i]) && !first(sorted[j])
+	})
+	return sorted
+}
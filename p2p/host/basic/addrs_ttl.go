@@ -0,0 +1,66 @@
+package basichost
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peerstore"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// TimedAddr is an address that is only valid for TTL. A TTL of 0 or below
+// means the address doesn't expire.
+type TimedAddr struct {
+	Addr ma.Multiaddr
+	TTL  time.Duration
+}
+
+// AddrsFactoryWithTTL functions can be used instead of an AddrsFactory to
+// give the addresses returned by Addrs an expiry. See
+// HostOpts.AddrsFactoryWithTTL.
+type AddrsFactoryWithTTL func([]ma.Multiaddr) []TimedAddr
+
+type expiringAddr struct {
+	addr    ma.Multiaddr
+	expires time.Time
+}
+
+func (a expiringAddr) expired(now time.Time) bool {
+	return !a.expires.IsZero() && !now.Before(a.expires)
+}
+
+// timedAddrs returns the unexpired addresses produced by the
+// AddrsFactoryWithTTL, running it again once all of them expired.
+func (h *BasicHost) timedAddrs() []ma.Multiaddr {
+	h.timedAddrsMx.Lock()
+	defer h.timedAddrsMx.Unlock()
+
+	now := time.Now()
+	valid := h.timedAddrsCache[:0]
+	for _, a := range h.timedAddrsCache {
+		if !a.expired(now) {
+			valid = append(valid, a)
+		}
+	}
+	h.timedAddrsCache = valid
+
+	if len(h.timedAddrsCache) == 0 {
+		for _, ta := range h.addrsFactoryWithTTL(h.blacklistAddrs(h.AllAddrs())) {
+			a := expiringAddr{addr: ta.Addr}
+			ttl := ta.TTL
+			if ttl > 0 {
+				a.expires = now.Add(ttl)
+			} else {
+				ttl = peerstore.PermanentAddrTTL
+			}
+			h.timedAddrsCache = append(h.timedAddrsCache, a)
+			h.Peerstore().AddAddr(h.ID(), ta.Addr, ttl)
+		}
+	}
+
+	addrs := make([]ma.Multiaddr, 0, len(h.timedAddrsCache))
+	for _, a := range h.timedAddrsCache {
+		addrs = append(addrs, a.addr)
+	}
+	return addrs
+}
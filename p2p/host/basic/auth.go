@@ -0,0 +1,76 @@
+package basichost
+
+import (
+	"errors"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// ErrAuthRejected is the error of the EvtStreamNegotiationFailed events
+// emitted for streams from peers a handler set with
+// SetStreamHandlerAuthRequired doesn't allow.
+var ErrAuthRejected = errors.New("peer not allowed to open streams for protocol")
+
+// authRule restricts the peers allowed to open streams for a protocol.
+type authRule struct {
+	allowed func(peer.ID) bool
+}
+
+// SetStreamHandlerAuthRequired sets a protocol handler only given the streams
+// of allowedPeers. The streams of other peers are reset once the protocol is
+// negotiated, before any handler runs, and an EvtStreamNegotiationFailed
+// event is emitted with the AuthRejected reason. The remote peer is
+// authenticated by the security transport of the connection.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlerAuthRequired(pid protocol.ID, allowedPeers []peer.ID, handler network.StreamHandler) {
+	allowed := make(map[peer.ID]struct{}, len(allowedPeers))
+	for _, p := range allowedPeers {
+		allowed[p] = struct{}{}
+	}
+	h.SetStreamHandlerAuthFunc(pid, func(p peer.ID) bool {
+		_, ok := allowed[p]
+		return ok
+	}, handler)
+}
+
+// SetStreamHandlerAuthFunc is like SetStreamHandlerAuthRequired, allowing the
+// peers for which allowed returns true.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlerAuthFunc(pid protocol.ID, allowed func(peer.ID) bool, handler network.StreamHandler) {
+	// set the rule before the handler so that no stream gets through in
+	// between. The rule is dropped with the handler.
+	rule := &authRule{allowed: allowed}
+	h.authMx.Lock()
+	h.authRules[pid] = rule
+	h.authMx.Unlock()
+
+	h.setStreamHandler(pid, "", handler, func() {
+		h.authMx.Lock()
+		if h.authRules[pid] == rule {
+			delete(h.authRules, pid)
+		}
+		h.authMx.Unlock()
+	})
+}
+
+// authorized reports whether p may open streams for pid.
+func (h *BasicHost) authorized(pid protocol.ID, p peer.ID) bool {
+	h.authMx.Lock()
+	rule, ok := h.authRules[pid]
+	h.authMx.Unlock()
+	return !ok || rule.allowed(p)
+}
+
+func (h *BasicHost) emitAuthRejected(s network.Stream, pid protocol.ID) {
+	evt := EvtStreamNegotiationFailed{
+		RemotePeer: s.Conn().RemotePeer(),
+		Offered:    []protocol.ID{pid},
+		Err:        ErrAuthRejected,
+		Reason:     AuthRejected,
+	}
+	if err := h.emitters.evtStreamNegotiationFailed.Emit(evt); err != nil {
+		h.log.Warnf("error emitting event for rejected stream: %s", err)
+	}
+}
@@ -0,0 +1,59 @@
+package basichost
+
+import (
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// EvtBandwidthSnapshot is emitted periodically on the host's event bus when
+// HostOpts.BandwidthReportingInterval is set. It carries the bandwidth used
+// by the streams of the host since it was created.
+type EvtBandwidthSnapshot struct {
+	// Total aggregates the bandwidth used by all protocols.
+	Total metrics.Stats
+	// ByProtocol holds the bandwidth used by each protocol.
+	ByProtocol map[protocol.ID]metrics.Stats
+}
+
+// BandwidthByProtocol returns the bandwidth used by the streams of this host,
+// keyed by protocol. Only streams handed to stream handlers or returned by
+// NewStream are accounted for.
+func (h *BasicHost) BandwidthByProtocol() map[protocol.ID]metrics.Stats {
+	return h.bwc.GetBandwidthByProtocol()
+}
+
+func (h *BasicHost) emitBandwidthSnapshot() {
+	evt := EvtBandwidthSnapshot{
+		Total:      h.bwc.GetBandwidthTotals(),
+		ByProtocol: h.bwc.GetBandwidthByProtocol(),
+	}
+	if err := h.emitters.evtBandwidthSnapshot.Emit(evt); err != nil {
+		h.log.Warnf("error emitting bandwidth snapshot: %s", err)
+	}
+}
+
+// meteredStream logs all reads and writes to a bandwidth counter, under the
+// protocol of the stream.
+type meteredStream struct {
+	network.Stream
+	bwc *metrics.BandwidthCounter
+}
+
+func (s *meteredStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		s.bwc.LogRecvMessage(int64(n))
+		s.bwc.LogRecvMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
+	}
+	return n, err
+}
+
+func (s *meteredStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if n > 0 {
+		s.bwc.LogSentMessage(int64(n))
+		s.bwc.LogSentMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
+	}
+	return n, err
+}
@@ -2,9 +2,14 @@ package basichost
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
@@ -13,6 +18,8 @@ import (
 	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/event"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/mux"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
@@ -20,6 +27,7 @@ import (
 
 	"github.com/libp2p/go-eventbus"
 	inat "github.com/libp2p/go-libp2p-nat"
+	swarm "github.com/libp2p/go-libp2p-swarm"
 
 	logging "github.com/ipfs/go-log"
 	"github.com/jbenet/goprocess"
@@ -29,6 +37,7 @@ import (
 	madns "github.com/multiformats/go-multiaddr-dns"
 	manet "github.com/multiformats/go-multiaddr-net"
 	msmux "github.com/multiformats/go-multistream"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // The maximum number of address resolution steps we'll perform for a single
@@ -43,12 +52,66 @@ var (
 
 	// DefaultAddrsFactory is the default value for HostOpts.AddrsFactory.
 	DefaultAddrsFactory = func(addrs []ma.Multiaddr) []ma.Multiaddr { return addrs }
+
+	// DefaultGracefulCloseTimeout is the default value for HostOpts.GracefulCloseTimeout.
+	DefaultGracefulCloseTimeout = time.Second * 10
+
+	// DefaultAddressChangePollingInterval is the default value for
+	// HostOpts.AddressChangePollingInterval.
+	DefaultAddressChangePollingInterval = time.Minute
+
+	// DefaultProtocolCacheTTL is the default value for HostOpts.ProtocolCacheTTL.
+	DefaultProtocolCacheTTL = time.Minute * 10
+
+	// DefaultMaxAddrResolutionDepth is the default value for
+	// HostOpts.MaxAddrResolutionDepth.
+	DefaultMaxAddrResolutionDepth = 4
+
+	// DefaultNewStreamRetryBackoff is the default value for
+	// HostOpts.NewStreamRetryBackoff.
+	DefaultNewStreamRetryBackoff = 100 * time.Millisecond
 )
 
+// ErrMaxAddrResolutionDepth is returned by Connect when resolving the
+// addresses of the peer requires more nested /dnsaddr lookups than allowed by
+// HostOpts.MaxAddrResolutionDepth.
+var ErrMaxAddrResolutionDepth = errors.New("exceeded the maximum address resolution depth")
+
+// Logger is the logger used by a BasicHost, see HostOpts.Logger. It's
+// implemented by *zap.SugaredLogger and go-log loggers.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
 // AddrsFactory functions can be passed to New in order to override
 // addresses returned by Addrs.
 type AddrsFactory func([]ma.Multiaddr) []ma.Multiaddr
 
+// AppendAddrsFactory can be passed to New in order to chain an AddrsFactory
+// after the factories passed before it, instead of replacing them. See
+// ChainAddrsFactories.
+type AppendAddrsFactory AddrsFactory
+
+// ChainAddrsFactories returns an AddrsFactory applying each of the given
+// factories in order: the output of a factory is the input of the next one.
+// The final result is deduplicated.
+func ChainAddrsFactories(factories ...AddrsFactory) AddrsFactory {
+	return func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		for _, f := range factories {
+			addrs = f(addrs)
+		}
+		return dedupAddrs(addrs)
+	}
+}
+
+// StreamMiddleware wraps a network.StreamHandler in order to add behaviour
+// (logging, authentication, rate limiting, ...) to every stream dispatched to
+// a protocol handler.
+type StreamMiddleware func(network.StreamHandler) network.StreamHandler
+
 // Option is a type used to pass in options to the host.
 //
 // Deprecated in favor of HostOpts and NewHost.
@@ -69,53 +132,396 @@ const NATPortMap Option = iota
 //  * uses an identity service to send + receive node information
 //  * uses a nat service to establish NAT port mappings
 type BasicHost struct {
-	network    network.Network
-	mux        *msmux.MultistreamMuxer
-	ids        *identify.IDService
-	pings      *ping.PingService
-	natmgr     NATManager
-	maResolver *madns.Resolver
-	cmgr       connmgr.ConnManager
-	eventbus   event.Bus
+	network     network.Network
+	mux         *msmux.MultistreamMuxer
+	ids         *identify.IDService
+	pings       *ping.PingService
+	natmgr      NATManager
+	rateLimiter *streamRateLimiter
+	// optsMx protects the options that can be changed by Reconfigure:
+	// AddrsFactory and dialLimiter.
+	optsMx      sync.RWMutex
+	dialLimiter *dialLimiter
+	// pendingStreams limits the outbound streams per peer whose protocol
+	// wasn't acknowledged yet, using only the per-peer limit of a
+	// dialLimiter.
+	pendingStreams  *dialLimiter
+	gater           ConnectionGater
+	upgraders       []ConnectionUpgrader
+	metrics         *hostMetrics
+	rcmgr           ResourceManager
+	scopes          *resourceScopes
+	bwc             *metrics.BandwidthCounter
+	maResolver      *madns.Resolver
+	dnsRetries      int
+	dnsBackoff      time.Duration
+	maxResolveDepth int
+	cmgr            connmgr.ConnManager
+	eventbus        event.Bus
+	log             Logger
+	tracer          Tracer
 
 	AddrsFactory AddrsFactory
 
-	negtimeout time.Duration
+	addrsFactoryWithTTL AddrsFactoryWithTTL
+	timedAddrsMx        sync.Mutex
+	timedAddrsCache     []expiringAddr
+
+	transports    []int
+	addrBlacklist []AddressFilter
+
+	negtimeout           time.Duration
+	inboundTimeout       time.Duration
+	outboundTimeout      time.Duration
+	writeTimeout         time.Duration
+	readTimeout          time.Duration
+	gracefulCloseTimeout time.Duration
+	addrChangeInterval   time.Duration
+	bwInterval           time.Duration
+	protoCacheTTL        time.Duration
+	protoUpdateDebounce  time.Duration
 
 	proc goprocess.Process
 
 	mx        sync.Mutex
 	lastAddrs []ma.Multiaddr
-	emitters  struct {
-		evtLocalProtocolsUpdated event.Emitter
+
+	middlewareMx sync.RWMutex
+	middleware   map[protocol.ID][]StreamMiddleware
+
+	peerMatchMx sync.RWMutex
+	peerMatch   map[protocol.ID]peerMatchHandler
+
+	defaultHandlerMx sync.RWMutex
+	defaultHandle    msmux.HandlerFunc
+
+	// protoUpdatesMx protects the batch of local protocol updates waiting
+	// to be emitted as a single EvtLocalProtocolsUpdated event, when
+	// debounced.
+	protoUpdatesMx sync.Mutex
+	protoUpdates   *protoUpdateBatch
+
+	// handlers tracks the stream handlers currently running so that
+	// GracefulClose can wait for them. Once draining is set, no new
+	// handlers are started.
+	handlersMx sync.Mutex
+	draining   bool
+	handlers   sync.WaitGroup
+
+	// connectedMx protects connected, the set of peers we last reported
+	// as connected through EvtPeerConnectednessChanged.
+	connectedMx sync.Mutex
+	connected   map[peer.ID]struct{}
+
+	// connectsMx protects connects, the connection attempts in progress.
+	connectsMx sync.Mutex
+	connects   map[peer.ID]*connectCall
+
+	// conns and peers mirror the open connections and the connected set,
+	// for ForEachConn and ForEachPeer.
+	conns sync.Map
+	peers sync.Map
+
+	// connectedSince maps the connected peers to the time they got
+	// connected.
+	connectedSince sync.Map
+
+	// muxRegsMx protects the handlers the host registered on the muxer and
+	// their priorities.
+	muxRegsMx  sync.Mutex
+	muxRegs    map[protocol.ID]muxRegistration
+	muxSeq     uint64
+	priorities map[protocol.ID]int
+
+	// authMx protects authRules, the peers allowed to open streams for
+	// the protocols of SetStreamHandlerAuthRequired.
+	authMx    sync.Mutex
+	authRules map[protocol.ID]*authRule
+
+	// closeStreamProtos are the protocols of EnableCloseStream, and
+	// handlerErrorProtos the ones of EnableHandlerErrors.
+	closeStreamProtos  protocolSet
+	handlerErrorProtos protocolSet
+
+	protoTableMx sync.Mutex
+	protoTable   map[protocol.ID]ProtocolEntry
+	// deregisterHooks are the hooks of SetStreamHandlerWithDeregisterHook.
+	deregisterHooks map[protocol.ID]func()
+
+	streamLimitsMx sync.Mutex
+	activeStreams  map[protocol.ID]int
+	limitedStreams map[network.Stream]protocol.ID
+
+	newStreamRetries      int
+	newStreamRetryBackoff time.Duration
+
+	protoPreference func(offered, supported []protocol.ID) protocol.ID
+
+	relayAddrs func() []ma.Multiaddr
+
+	addrChangeHook func(added, removed []ma.Multiaddr)
+
+	debugAddr net.Addr
+
+	dialStrategy DialStrategy
+
+	interceptor StreamInterceptor
+
+	propagationKeys []interface{}
+
+	dialPrioritizer func([]ma.Multiaddr) []ma.Multiaddr
+
+	allowedRemoteAddrs func(ma.Multiaddr) bool
+	// connCtxValues maps connections to their *propagatedValues.
+	connCtxValues sync.Map
+
+	panicHandler PanicHandler
+
+	// numConns and numStreams count the open connections and streams.
+	numConns, numStreams int32
+
+	servicesMx     sync.Mutex
+	services       map[protocol.ID]Service
+	servicesClosed bool
+
+	// closing is cancelled when the host closes.
+	closing context.Context
+
+	streamCtxsMx sync.Mutex
+	streamCtxs   map[network.Conn]map[*contextStream]struct{}
+
+	keepConnectedMx sync.Mutex
+	keepConnected   map[peer.ID]*keepConnectedLoop
+
+	// drainMx protects drainWaiters, the channels signalled when a stream
+	// with a peer closes while Disconnect waits for its streams to drain.
+	drainMx      sync.Mutex
+	drainWaiters map[peer.ID][]chan struct{}
+
+	// protoUpdatedMx protects protoUpdated, the last time identify told us
+	// about the protocols of each peer. See Protocols.
+	protoUpdatedMx sync.Mutex
+	protoUpdated   map[peer.ID]time.Time
+	// protoSources holds when identify last told us about each protocol of
+	// each peer.
+	protoSources map[peer.ID]map[protocol.ID]time.Time
+
+	// streamTags maps the streams tagged with TagStream to their
+	// *streamTags.
+	streamTags sync.Map
+
+	// connMetadata maps connections to their ConnectionMetadata store.
+	connMetadata sync.Map
+
+	// identifiedConns holds the connections whose identify response has
+	// been consumed, see ProtocolsAfterIdentify.
+	identifiedConns sync.Map
+
+	// streamEvents queues EvtStreamOpened and EvtStreamClosed events for
+	// emitStreamEvents.
+	streamEvents chan interface{}
+
+	emitters struct {
+		evtLocalProtocolsUpdated    event.Emitter
+		evtPeerRateLimitExceeded    event.Emitter
+		evtPeerConnectednessChanged event.Emitter
+		evtLocalAddressesUpdated    event.Emitter
+		evtBandwidthSnapshot        event.Emitter
+		evtStreamOpened             event.Emitter
+		evtStreamClosed             event.Emitter
+		evtPeerConnected            event.Emitter
+		evtStreamNegotiationFailed  event.Emitter
+		evtHostReconfigured         event.Emitter
 	}
 }
 
 var _ host.Host = (*BasicHost)(nil)
 
+// Host is a host.Host extended with shorthands for common operations, as
+// implemented by BasicHost.
+type Host interface {
+	host.Host
+
+	// Connectedness returns the state of our connection to p, like
+	// Network().Connectedness(p).
+	Connectedness(p peer.ID) network.Connectedness
+}
+
+var _ Host = (*BasicHost)(nil)
+
 // HostOpts holds options that can be passed to NewHost in order to
 // customize construction of the *BasicHost.
 type HostOpts struct {
 	// MultistreamMuxer is essential for the *BasicHost and will use a sensible default value if omitted.
 	MultistreamMuxer *msmux.MultistreamMuxer
 
-	// NegotiationTimeout determines the read and write timeouts on streams.
+	// NegotiationTimeout determines the read and write timeouts on streams
+	// during protocol negotiation, for both inbound streams and streams
+	// opened with NewStream. A shorter context deadline passed to NewStream
+	// takes precedence.
 	// If 0 or omitted, it will use DefaultNegotiationTimeout.
 	// If below 0, timeouts on streams will be deactivated.
 	NegotiationTimeout time.Duration
 
+	// InboundStreamTimeout, when greater than 0, bounds how long we wait for
+	// the remote peer to send the protocol of an inbound stream. It's set as
+	// a read deadline on the stream before negotiation, cleared once a
+	// protocol is selected.
+	InboundStreamTimeout time.Duration
+
+	// OutboundStreamTimeout, when greater than 0, is set as a write deadline
+	// on the streams negotiated by NewStream, cleared once a protocol is
+	// selected. Streams for protocols the peer is known to support are
+	// negotiated lazily, on first use, and aren't affected.
+	OutboundStreamTimeout time.Duration
+
+	// StreamWriteTimeout, when greater than 0, bounds the time a write on
+	// the streams opened by NewStream may block, e.g. because the remote
+	// peer stopped reading. The write deadline is pushed back by this
+	// duration on every write, so it's an inactivity timeout rather than a
+	// limit on the lifetime of the stream.
+	StreamWriteTimeout time.Duration
+
+	// StreamReadTimeout, when greater than 0, bounds the time a read on the
+	// streams handed to stream handlers may block, e.g. because the remote
+	// peer stopped writing. Like StreamWriteTimeout, the read deadline is
+	// pushed back on every read, so handlers blocked in io.ReadFull don't
+	// leak when the remote goes silent.
+	StreamReadTimeout time.Duration
+
 	// AddrsFactory holds a function which can be used to override or filter the result of Addrs.
 	// If omitted, there's no override or filtering, and the results of Addrs and AllAddrs are the same.
 	AddrsFactory AddrsFactory
 
+	// AddrsFactoryWithTTL, if set, is used instead of AddrsFactory. The
+	// addresses it returns are stored in the peerstore with their TTL, and
+	// dropped from the result of Addrs once expired, which
+	// CheckForAddressChanges reports as a change. It's run again once all of
+	// them expired.
+	AddrsFactoryWithTTL AddrsFactoryWithTTL
+
+	// AddressBlacklist holds filters removing addresses, e.g. loopback ones,
+	// from the result of Addrs. They're applied before AddrsFactory (or
+	// AddrsFactoryWithTTL).
+	AddressBlacklist []AddressFilter
+
+	// TransportFilter, if set, restricts the addresses returned by Addrs
+	// to those using one of the named transports, e.g. "tcp" or "quic". It's
+	// applied to the result of AddrsFactory (or AddrsFactoryWithTTL).
+	TransportFilter []string
+
 	// MultiaddrResolves holds the go-multiaddr-dns.Resolver used for resolving
 	// /dns4, /dns6, and /dnsaddr addresses before trying to connect to a peer.
 	MultiaddrResolver *madns.Resolver
 
+	// DNSRetries is the number of times a failed lookup of MultiaddrResolver
+	// is retried, waiting DNSRetryBackoff before the first retry and twice as
+	// long before each subsequent one. Defaults to 0, no retries.
+	DNSRetries      int
+	DNSRetryBackoff time.Duration
+
+	// MaxAddrResolutionDepth limits the number of nested /dnsaddr lookups
+	// performed to resolve an address of a peer before connecting to it.
+	// If 0 or omitted, it will use DefaultMaxAddrResolutionDepth.
+	MaxAddrResolutionDepth int
+
+	// NewStreamRetries is the number of times NewStream retries over a new
+	// connection when the stream is reset or closed while being opened.
+	// Defaults to 0, no retries.
+	NewStreamRetries int
+
+	// NewStreamRetryBackoff is the time NewStream waits before its first
+	// retry. It doubles after every retry.
+	// If 0 or omitted, it will use DefaultNewStreamRetryBackoff.
+	NewStreamRetryBackoff time.Duration
+
+	// ProtocolPreference, if set, picks the protocol NewStream uses among
+	// the protocols the peerstore knows the remote supports (offered) and
+	// the protocols passed to NewStream (supported), e.g. to prefer the
+	// newest semver-compatible version. By default, the first of the
+	// supported protocols the remote is known to support is used. When it
+	// returns "" or a protocol not in both lists, the protocol is negotiated.
+	ProtocolPreference func(offered, supported []protocol.ID) protocol.ID
+
+	// IdentifySkipIfFresh, if positive, skips identifying the new connections
+	// to peers identified less than IdentifySkipIfFresh ago, reusing the
+	// protocols and addresses we know for them.
+	IdentifySkipIfFresh time.Duration
+
+	// IdentifyPushDebounce, when greater than 0, makes identify push our
+	// protocol changes to peers only once they stopped changing for this
+	// duration, in a single delta.
+	IdentifyPushDebounce time.Duration
+
+	// MaxIdentifyMessageSize limits the size of the identify messages sent to
+	// peers by leaving out protocols, longest first. The listen addresses are
+	// always sent. An identify.EvtIdentifyTruncated event is emitted when
+	// protocols are left out. Defaults to 0, no limit.
+	MaxIdentifyMessageSize int
+
+	// StreamHandlerPanicHandler is called when a stream handler panics,
+	// instead of logging the panic and resetting the stream. Either way, the
+	// panic doesn't crash the process.
+	StreamHandlerPanicHandler PanicHandler
+
+	// RelayAddrs returns relay addresses to advertise in addition to our own
+	// addresses. It's called by every call to Addrs, so the relay addresses
+	// may change over time: CheckForAddressChanges notices it like for any
+	// other address.
+	RelayAddrs func() []ma.Multiaddr
+
+	// ListenAddrChangeHook is called synchronously by CheckForAddressChanges
+	// with the added and removed addresses whenever our advertised addresses
+	// change, before EvtLocalAddressesUpdated is emitted. It must not call
+	// CheckForAddressChanges.
+	ListenAddrChangeHook func(added, removed []ma.Multiaddr)
+
+	// DebugHTTP starts an HTTP server on the loopback interface serving the
+	// debug endpoints of ServeHTTP. It's stopped when the host closes.
+	DebugHTTP bool
+
+	// DebugHTTPPort is the port of the DebugHTTP server. If omitted, a free
+	// port is picked, see DebugHTTPAddr.
+	DebugHTTPPort int
+
+	// StreamDialStrategy selects the connection new streams to a peer are
+	// opened on when there are several. If omitted, the network picks the
+	// connection with the most streams.
+	StreamDialStrategy DialStrategy
+
+	// StreamInterceptor, if set, is given every negotiated stream before it's
+	// handed to its handler or returned by NewStream.
+	StreamInterceptor StreamInterceptor
+
+	// AllowedRemoteAddrs, if set, restricts the inbound connections to the
+	// ones from remote addresses for which it returns true, e.g. to only
+	// accept connections from a subnet. Other connections are closed as
+	// soon as they're established, before identify runs.
+	AllowedRemoteAddrs func(ma.Multiaddr) bool
+
+	// DialAddressPrioritizer, if set, orders the addresses Connect adds to
+	// the peerstore before dialing, and may leave some out so that Connect
+	// doesn't add them. See PrioritizeLocalAddrs and PrioritizeQUIC. The
+	// network currently dials all the addresses of a peer at once and the
+	// peerstore doesn't keep their order, so the order is only a hint.
+	DialAddressPrioritizer func([]ma.Multiaddr) []ma.Multiaddr
+
+	// ContextPropagationKeys are the keys of the context values carried from
+	// the Connect or NewStream call that established a connection to the
+	// contexts of the SetStreamHandlerWithContext handlers of the streams the
+	// peer opens on that connection, e.g. trace IDs. Contexts are local to a
+	// process, so the values of the remote peer can't be carried.
+	ContextPropagationKeys []interface{}
+
 	// NATManager takes care of setting NAT port mappings, and discovering external addresses.
 	// If omitted, this will simply be disabled.
 	NATManager func(network.Network) NATManager
 
+	// NATPortMapping enables UPnP/NAT-PMP port mapping with the default
+	// NATManager when NATManager is omitted. Mappings are renewed
+	// periodically and removed when the host closes.
+	NATPortMapping bool
+
 	// ConnManager is a libp2p connection manager
 	ConnManager connmgr.ConnManager
 
@@ -124,34 +530,202 @@ type HostOpts struct {
 
 	// UserAgent sets the user-agent for the host. Defaults to ClientVersion.
 	UserAgent string
+
+	// Logger, if set, is used by the host and its identify service instead
+	// of the package loggers.
+	Logger Logger
+
+	// Tracer, if set, traces Connect and NewStream in spans named
+	// ConnectSpanName and NewStreamSpanName, with the peer.id, protocol,
+	// transport and error attributes. The spans are local: their context
+	// isn't sent to the remote peer, as multistream has no room for it.
+	Tracer Tracer
+
+	// GracefulCloseTimeout bounds how long GracefulClose waits for in-flight
+	// stream handlers when it is called with a nil context.
+	// If 0 or omitted, it will use DefaultGracefulCloseTimeout.
+	GracefulCloseTimeout time.Duration
+
+	// PerPeerStreamRateLimit, when greater than 0, limits the number of
+	// inbound streams a single peer may open within PerPeerStreamRateWindow.
+	// Streams above the limit are reset before protocol negotiation.
+	PerPeerStreamRateLimit  int
+	PerPeerStreamRateWindow time.Duration
+
+	// AddressChangePollingInterval determines how often the started host
+	// calls CheckForAddressChanges.
+	// If 0 or omitted, it will use DefaultAddressChangePollingInterval.
+	AddressChangePollingInterval time.Duration
+
+	// BandwidthReportingInterval determines how often the started host emits
+	// an EvtBandwidthSnapshot event.
+	// If 0 or omitted, no snapshots are emitted.
+	BandwidthReportingInterval time.Duration
+
+	// ConnectionGater, if set, is consulted before Connect dials a peer, to
+	// filter the addresses passed to Connect and the ones returned by Addrs,
+	// and to close the inbound connections it refuses once established.
+	// It doesn't gate the dials the network makes on its own, see
+	// ConnectionGater.
+	ConnectionGater ConnectionGater
+
+	// ProtocolCacheTTL determines how long the protocols identify reported
+	// for a peer are considered fresh by Protocols.
+	// If 0 or omitted, it will use DefaultProtocolCacheTTL.
+	ProtocolCacheTTL time.Duration
+
+	// MaxConcurrentDials, when greater than 0, limits the number of dials
+	// Connect performs concurrently. Connect calls above the limit wait for
+	// a slot in FIFO order, or until their context is done.
+	MaxConcurrentDials int
+
+	// MaxConcurrentDialsPerPeer, when greater than 0, limits the number of
+	// dials Connect performs concurrently to the same peer, independently
+	// of MaxConcurrentDials.
+	MaxConcurrentDialsPerPeer int
+
+	// MaxPendingOutboundStreamsPerPeer, when greater than 0, limits the
+	// number of streams NewStream returns to a peer before the peer
+	// acknowledged their protocol, i.e. before we read anything from them.
+	// NewStream blocks until a slot frees up or its context is done.
+	MaxPendingOutboundStreamsPerPeer int
+
+	// ProtocolFilter, if set, restricts the protocols advertised to peers
+	// through identify to those for which it returns true. Streams for
+	// protocols that don't pass the filter are still handled.
+	ProtocolFilter func(protocol.ID) bool
+
+	// ProtocolUpdateDebounce, when greater than 0, coalesces the protocols
+	// added and removed by the stream handler methods into a single
+	// EvtLocalProtocolsUpdated event, emitted once no protocol was added or
+	// removed for this duration, or at the latest ten times this duration
+	// after the first update.
+	ProtocolUpdateDebounce time.Duration
+
+	// ConnectionUpgraders are run in order on every new connection once
+	// identify completed on it. If one of them fails, the connection is
+	// closed.
+	ConnectionUpgraders []ConnectionUpgrader
+
+	// ResourceManager, if set, is consulted for every stream and connection
+	// of the host, which are rejected if it returns an error.
+	ResourceManager ResourceManager
+
+	// PrometheusRegisterer, if set, is used to register metrics about the
+	// streams, connections, identify and addresses of the host. Metrics
+	// already registered, e.g. by another host, are shared.
+	PrometheusRegisterer prometheus.Registerer
 }
 
 // NewHost constructs a new *BasicHost and activates it by attaching its stream and connection handlers to the given inet.Network.
 func NewHost(ctx context.Context, net network.Network, opts *HostOpts) (*BasicHost, error) {
 	h := &BasicHost{
-		network:      net,
-		mux:          msmux.NewMultistreamMuxer(),
-		negtimeout:   DefaultNegotiationTimeout,
-		AddrsFactory: DefaultAddrsFactory,
-		maResolver:   madns.DefaultResolver,
-		eventbus:     eventbus.NewBus(),
+		network:              net,
+		mux:                  msmux.NewMultistreamMuxer(),
+		negtimeout:           DefaultNegotiationTimeout,
+		gracefulCloseTimeout: DefaultGracefulCloseTimeout,
+		addrChangeInterval:   DefaultAddressChangePollingInterval,
+		protoCacheTTL:        DefaultProtocolCacheTTL,
+		AddrsFactory:         DefaultAddrsFactory,
+		maResolver:           madns.DefaultResolver,
+		eventbus:             eventbus.NewBus(),
+		log:                  log,
+		middleware:           make(map[protocol.ID][]StreamMiddleware),
+		peerMatch:            make(map[protocol.ID]peerMatchHandler),
+		connected:            make(map[peer.ID]struct{}),
+		connects:             make(map[peer.ID]*connectCall),
+		authRules:            make(map[protocol.ID]*authRule),
+		keepConnected:        make(map[peer.ID]*keepConnectedLoop),
+		drainWaiters:         make(map[peer.ID][]chan struct{}),
+		streamCtxs:           make(map[network.Conn]map[*contextStream]struct{}),
+		protoTable:           make(map[protocol.ID]ProtocolEntry),
+		deregisterHooks:      make(map[protocol.ID]func()),
+		services:             make(map[protocol.ID]Service),
+		activeStreams:        make(map[protocol.ID]int),
+		limitedStreams:       make(map[network.Stream]protocol.ID),
+		muxRegs:              make(map[protocol.ID]muxRegistration),
+		priorities:           make(map[protocol.ID]int),
+		protoUpdated:         make(map[peer.ID]time.Time),
+		protoSources:         make(map[peer.ID]map[protocol.ID]time.Time),
+		streamEvents:         make(chan interface{}, streamEventsBufSize),
+		bwc:                  metrics.NewBandwidthCounter(),
 	}
 
+	if opts.Logger != nil {
+		h.log = opts.Logger
+	}
+	h.tracer = opts.Tracer
+
 	var err error
 	if h.emitters.evtLocalProtocolsUpdated, err = h.eventbus.Emitter(&event.EvtLocalProtocolsUpdated{}); err != nil {
 		return nil, err
 	}
+	if h.emitters.evtPeerRateLimitExceeded, err = h.eventbus.Emitter(&EvtPeerRateLimitExceeded{}); err != nil {
+		return nil, err
+	}
+	if h.emitters.evtPeerConnectednessChanged, err = h.eventbus.Emitter(&event.EvtPeerConnectednessChanged{}); err != nil {
+		return nil, err
+	}
+	if h.emitters.evtLocalAddressesUpdated, err = h.eventbus.Emitter(&event.EvtLocalAddressesUpdated{}); err != nil {
+		return nil, err
+	}
+	if h.emitters.evtBandwidthSnapshot, err = h.eventbus.Emitter(&EvtBandwidthSnapshot{}); err != nil {
+		return nil, err
+	}
+	if h.emitters.evtStreamOpened, err = h.eventbus.Emitter(&EvtStreamOpened{}); err != nil {
+		return nil, err
+	}
+	if h.emitters.evtStreamClosed, err = h.eventbus.Emitter(&EvtStreamClosed{}); err != nil {
+		return nil, err
+	}
+	if h.emitters.evtPeerConnected, err = h.eventbus.Emitter(&EvtPeerConnected{}); err != nil {
+		return nil, err
+	}
+	if h.emitters.evtStreamNegotiationFailed, err = h.eventbus.Emitter(&EvtStreamNegotiationFailed{}); err != nil {
+		return nil, err
+	}
+	if h.emitters.evtHostReconfigured, err = h.eventbus.Emitter(&EvtHostReconfigured{}); err != nil {
+		return nil, err
+	}
 
 	h.proc = goprocessctx.WithContextAndTeardown(ctx, func() error {
+		h.stopServices()
 		if h.natmgr != nil {
 			h.natmgr.Close()
 		}
 		if h.cmgr != nil {
 			h.cmgr.Close()
 		}
+		h.protoUpdatesMx.Lock()
+		if h.protoUpdates != nil {
+			h.protoUpdates.timer.Stop()
+		}
+		h.protoUpdatesMx.Unlock()
 		_ = h.emitters.evtLocalProtocolsUpdated.Close()
+		_ = h.emitters.evtPeerRateLimitExceeded.Close()
+		_ = h.emitters.evtPeerConnectednessChanged.Close()
+		_ = h.emitters.evtLocalAddressesUpdated.Close()
+		_ = h.emitters.evtBandwidthSnapshot.Close()
+		_ = h.emitters.evtStreamOpened.Close()
+		_ = h.emitters.evtStreamClosed.Close()
+		_ = h.emitters.evtPeerConnected.Close()
+		_ = h.emitters.evtStreamNegotiationFailed.Close()
+		_ = h.emitters.evtHostReconfigured.Close()
 		return h.Network().Close()
 	})
+	h.closing = goprocessctx.OnClosingContext(h.proc)
+	h.proc.Go(h.emitStreamEvents)
+
+	// subscribe before the identify service is started so that we don't
+	// miss any update.
+	protoSub, err := h.eventbus.Subscribe([]interface{}{
+		new(event.EvtPeerIdentificationCompleted),
+		new(event.EvtPeerProtocolsUpdated),
+	}, eventbus.BufSize(128))
+	if err != nil {
+		return nil, err
+	}
+	h.proc.Go(func(p goprocess.Process) { h.trackProtocolUpdates(p, protoSub) })
 
 	if opts.MultistreamMuxer != nil {
 		h.mux = opts.MultistreamMuxer
@@ -162,23 +736,155 @@ func NewHost(ctx context.Context, net network.Network, opts *HostOpts) (*BasicHo
 		goprocessctx.WithProcessClosing(ctx, h.proc),
 		h,
 		identify.UserAgent(opts.UserAgent),
+		identify.ProtocolFilter(opts.ProtocolFilter),
+		identify.UseLogger(opts.Logger),
+		identify.MaxMessageSize(opts.MaxIdentifyMessageSize),
+		identify.SkipIfFresh(opts.IdentifySkipIfFresh),
+		identify.PushDebounce(opts.IdentifyPushDebounce),
 	)
 
 	if uint64(opts.NegotiationTimeout) != 0 {
 		h.negtimeout = opts.NegotiationTimeout
 	}
 
+	if opts.InboundStreamTimeout > 0 {
+		h.inboundTimeout = opts.InboundStreamTimeout
+	}
+
+	if opts.OutboundStreamTimeout > 0 {
+		h.outboundTimeout = opts.OutboundStreamTimeout
+	}
+
+	if opts.StreamWriteTimeout > 0 {
+		h.writeTimeout = opts.StreamWriteTimeout
+	}
+
+	if opts.StreamReadTimeout > 0 {
+		h.readTimeout = opts.StreamReadTimeout
+	}
+
+	if opts.AddressChangePollingInterval > 0 {
+		h.addrChangeInterval = opts.AddressChangePollingInterval
+	}
+
+	if opts.BandwidthReportingInterval > 0 {
+		h.bwInterval = opts.BandwidthReportingInterval
+	}
+
+	if opts.ProtocolUpdateDebounce > 0 {
+		h.protoUpdateDebounce = opts.ProtocolUpdateDebounce
+	}
+
+	if opts.ProtocolCacheTTL > 0 {
+		h.protoCacheTTL = opts.ProtocolCacheTTL
+	}
+
+	if opts.GracefulCloseTimeout > 0 {
+		h.gracefulCloseTimeout = opts.GracefulCloseTimeout
+	}
+
+	if opts.PerPeerStreamRateLimit > 0 {
+		if opts.PerPeerStreamRateWindow <= 0 {
+			return nil, fmt.Errorf("per-peer stream rate limit requires a positive window")
+		}
+		h.rateLimiter = newStreamRateLimiter(opts.PerPeerStreamRateLimit, opts.PerPeerStreamRateWindow)
+	}
+
+	if opts.MaxConcurrentDials > 0 || opts.MaxConcurrentDialsPerPeer > 0 {
+		h.dialLimiter = newDialLimiter(opts.MaxConcurrentDials, opts.MaxConcurrentDialsPerPeer)
+	}
+
+	if opts.MaxPendingOutboundStreamsPerPeer > 0 {
+		h.pendingStreams = newDialLimiter(0, opts.MaxPendingOutboundStreamsPerPeer)
+	}
+
 	if opts.AddrsFactory != nil {
 		h.AddrsFactory = opts.AddrsFactory
 	}
+	h.addrsFactoryWithTTL = opts.AddrsFactoryWithTTL
+	h.addrBlacklist = opts.AddressBlacklist
+
+	if len(opts.TransportFilter) > 0 {
+		transports, err := transportCodes(opts.TransportFilter)
+		if err != nil {
+			return nil, err
+		}
+		h.transports = transports
+	}
+
+	h.gater = opts.ConnectionGater
+	h.upgraders = opts.ConnectionUpgraders
+
+	if opts.ResourceManager != nil {
+		h.rcmgr = opts.ResourceManager
+		h.scopes = newResourceScopes()
+	}
+
+	if opts.PrometheusRegisterer != nil {
+		m, err := newHostMetrics(opts.PrometheusRegisterer)
+		if err != nil {
+			return nil, err
+		}
+		h.metrics = m
+	}
+
+	if opts.StreamHandlerPanicHandler != nil {
+		h.panicHandler = opts.StreamHandlerPanicHandler
+	}
+
+	if opts.RelayAddrs != nil {
+		h.relayAddrs = opts.RelayAddrs
+	}
+
+	if opts.ListenAddrChangeHook != nil {
+		h.addrChangeHook = opts.ListenAddrChangeHook
+	}
+
+	if opts.AllowedRemoteAddrs != nil {
+		h.allowedRemoteAddrs = opts.AllowedRemoteAddrs
+	}
+
+	if opts.DialAddressPrioritizer != nil {
+		h.dialPrioritizer = opts.DialAddressPrioritizer
+	}
+
+	if len(opts.ContextPropagationKeys) > 0 {
+		h.propagationKeys = opts.ContextPropagationKeys
+	}
+
+	if opts.StreamInterceptor != nil {
+		h.interceptor = opts.StreamInterceptor
+	}
+
+	if opts.StreamDialStrategy != nil {
+		h.dialStrategy = opts.StreamDialStrategy
+	}
+
+	h.protoPreference = opts.ProtocolPreference
+	if opts.NewStreamRetries > 0 {
+		h.newStreamRetries = opts.NewStreamRetries
+	}
+	h.newStreamRetryBackoff = DefaultNewStreamRetryBackoff
+	if opts.NewStreamRetryBackoff > 0 {
+		h.newStreamRetryBackoff = opts.NewStreamRetryBackoff
+	}
 
 	if opts.NATManager != nil {
 		h.natmgr = opts.NATManager(net)
+	} else if opts.NATPortMapping {
+		h.natmgr = NewNATManager(net)
 	}
 
 	if opts.MultiaddrResolver != nil {
 		h.maResolver = opts.MultiaddrResolver
 	}
+	h.dnsRetries = opts.DNSRetries
+	h.dnsBackoff = opts.DNSRetryBackoff
+
+	h.maxResolveDepth = DefaultMaxAddrResolutionDepth
+	if opts.MaxAddrResolutionDepth > 0 {
+		h.maxResolveDepth = opts.MaxAddrResolutionDepth
+	}
 
 	if opts.ConnManager == nil {
 		h.cmgr = &connmgr.NullConnMgr{}
@@ -191,6 +897,19 @@ func NewHost(ctx context.Context, net network.Network, opts *HostOpts) (*BasicHo
 		h.pings = ping.NewPingService(h)
 	}
 
+	if opts.DebugHTTP {
+		if err := h.startDebugHTTP(opts.DebugHTTPPort); err != nil {
+			return nil, err
+		}
+	}
+
+	net.Notify(&network.NotifyBundle{
+		ConnectedF:    h.connectedNotify,
+		DisconnectedF: h.disconnectedNotify,
+		OpenedStreamF: h.openedStreamNotify,
+		ClosedStreamF: h.closedStreamNotify,
+	})
+
 	net.SetConnHandler(h.newConnHandler)
 	net.SetStreamHandler(h.newStreamHandler)
 
@@ -201,6 +920,7 @@ func NewHost(ctx context.Context, net network.Network, opts *HostOpts) (*BasicHo
 // The following options can be passed:
 // * NATPortMap
 // * AddrsFactory
+// * AppendAddrsFactory
 // * connmgr.ConnManager
 // * madns.Resolver
 //
@@ -217,6 +937,12 @@ func New(net network.Network, opts ...interface{}) *BasicHost {
 			}
 		case AddrsFactory:
 			hostopts.AddrsFactory = o
+		case AppendAddrsFactory:
+			if hostopts.AddrsFactory == nil {
+				hostopts.AddrsFactory = ChainAddrsFactories(AddrsFactory(o))
+			} else {
+				hostopts.AddrsFactory = ChainAddrsFactories(hostopts.AddrsFactory, AddrsFactory(o))
+			}
 		case connmgr.ConnManager:
 			hostopts.ConnManager = o
 		case *madns.Resolver:
@@ -236,45 +962,169 @@ func New(net network.Network, opts ...interface{}) *BasicHost {
 
 // Start starts background tasks in the host
 func (h *BasicHost) Start() {
+	// initialize lastAddrs
+	h.mx.Lock()
+	if h.lastAddrs == nil {
+		h.lastAddrs = h.Addrs()
+	}
+	h.mx.Unlock()
+
 	h.proc.Go(h.background)
 }
 
 // newConnHandler is the remote-opened conn handler for inet.Network
 func (h *BasicHost) newConnHandler(c network.Conn) {
+	if h.isDraining() {
+		c.Close()
+		return
+	}
+
+	if h.gater != nil && c.Stat().Direction == network.DirInbound && !h.gater.InterceptAccept(c) {
+		h.log.Debugf("gater refused inbound connection from %s", c.RemotePeer())
+		c.Close()
+		return
+	}
+
+	if h.allowedRemoteAddrs != nil && c.Stat().Direction == network.DirInbound && !h.allowedRemoteAddrs(c.RemoteMultiaddr()) {
+		h.log.Debugf("refused inbound connection from %s at %s", c.RemotePeer(), c.RemoteMultiaddr())
+		c.Close()
+		return
+	}
+
+	if err := h.admitConn(c); err != nil {
+		h.log.Debugf("resource manager rejected connection to %s: %s", c.RemotePeer(), err)
+		return
+	}
+
 	// Clear protocols on connecting to new peer to avoid issues caused
-	// by misremembering protocols between reconnects
-	h.Peerstore().SetProtocols(c.RemotePeer())
+	// by misremembering protocols between reconnects, unless identify will
+	// reuse them.
+	if !h.ids.Fresh(c.RemotePeer()) {
+		h.Peerstore().SetProtocols(c.RemotePeer())
+	}
+	start := time.Now()
 	h.ids.IdentifyConn(c)
+	h.identifiedConns.Store(c, struct{}{})
+	h.metrics.identified(time.Since(start))
+	h.upgradeConn(c)
+}
+
+// connectedNotify and disconnectedNotify bridge the network's connection
+// notifications to EvtPeerConnectednessChanged events. We only emit on
+// transitions between having no connection to a peer and having at least one.
+func (h *BasicHost) connectedNotify(n network.Network, c network.Conn) {
+	atomic.AddInt32(&h.numConns, 1)
+	h.conns.Store(c, struct{}{})
+	h.metrics.connOpened(c)
+
+	p := c.RemotePeer()
+
+	h.connectedMx.Lock()
+	defer h.connectedMx.Unlock()
+	if _, ok := h.connected[p]; ok {
+		return
+	}
+	h.connected[p] = struct{}{}
+	h.peers.Store(p, struct{}{})
+	h.connectedSince.Store(p, time.Now())
+	h.emitters.evtPeerConnectednessChanged.Emit(event.EvtPeerConnectednessChanged{
+		Peer:          p,
+		Connectedness: network.Connected,
+	})
+}
+
+func (h *BasicHost) disconnectedNotify(n network.Network, c network.Conn) {
+	atomic.AddInt32(&h.numConns, -1)
+	h.conns.Delete(c)
+	h.connMetadata.Delete(c)
+	h.connCtxValues.Delete(c)
+	h.identifiedConns.Delete(c)
+	h.metrics.connClosed(c)
+	h.releaseConn(c)
+	h.cancelStreamContexts(c)
+
+	p := c.RemotePeer()
+
+	h.connectedMx.Lock()
+	defer h.connectedMx.Unlock()
+	if _, ok := h.connected[p]; !ok || n.Connectedness(p) == network.Connected {
+		return
+	}
+	delete(h.connected, p)
+	h.peers.Delete(p)
+	h.connectedSince.Delete(p)
+	h.forgetProtocolUpdates(p)
+	h.emitters.evtPeerConnectednessChanged.Emit(event.EvtPeerConnectednessChanged{
+		Peer:          p,
+		Connectedness: network.NotConnected,
+	})
 }
 
 // newStreamHandler is the remote-opened stream handler for network.Network
 // TODO: this feels a bit wonky
 func (h *BasicHost) newStreamHandler(s network.Stream) {
+	if h.rateLimiter != nil {
+		p := s.Conn().RemotePeer()
+		if !h.rateLimiter.Allow(p) {
+			h.log.Debugf("peer %s exceeded the stream rate limit", p)
+			s.Reset()
+			h.emitters.evtPeerRateLimitExceeded.Emit(EvtPeerRateLimitExceeded{Peer: p})
+			return
+		}
+	}
+
+	if err := h.admitStream(s); err != nil {
+		h.log.Debugf("resource manager rejected stream from %s: %s", s.Conn().RemotePeer(), err)
+		return
+	}
+
 	before := time.Now()
 
 	if h.negtimeout > 0 {
 		if err := s.SetDeadline(time.Now().Add(h.negtimeout)); err != nil {
-			log.Debug("setting stream deadline: ", err)
+			h.log.Debugf("setting stream deadline: %s", err)
+			s.Reset()
+			return
+		}
+	}
+
+	if h.inboundTimeout > 0 {
+		if err := s.SetReadDeadline(time.Now().Add(h.inboundTimeout)); err != nil {
+			h.log.Debugf("setting stream read deadline: %s", err)
 			s.Reset()
 			return
 		}
 	}
 
-	lzc, protoID, handle, err := h.Mux().NegotiateLazy(s)
+	var (
+		rec     = &negotiationRecorder{Stream: s, recording: true}
+		lzc     io.ReadWriteCloser
+		protoID string
+		handle  protocol.HandlerFunc
+		err     error
+	)
+	mux := h.peerMux(s.Conn().RemotePeer())
+	if dh := h.defaultHandler(); dh != nil {
+		lzc, protoID, handle, err = h.negotiateWithDefault(rec, mux, dh)
+	} else {
+		lzc, protoID, handle, err = mux.NegotiateLazy(rec)
+	}
 	took := time.Since(before)
 	if err != nil {
+		h.emitNegotiationFailed(rec, err)
 		if err == io.EOF {
-			logf := log.Debugf
+			logf := h.log.Debugf
 			if took > time.Second*10 {
-				logf = log.Warningf
+				logf = h.log.Warnf
 			}
 			logf("protocol EOF: %s (took %s)", s.Conn().RemotePeer(), took)
 		} else {
-			log.Debugf("protocol mux failed: %s (took %s)", err, took)
+			h.log.Debugf("protocol mux failed: %s (took %s)", err, took)
 		}
 		s.Reset()
 		return
 	}
+	rec.stop()
 
 	s = &streamWrapper{
 		Stream: s,
@@ -283,78 +1133,199 @@ func (h *BasicHost) newStreamHandler(s network.Stream) {
 
 	if h.negtimeout > 0 {
 		if err := s.SetDeadline(time.Time{}); err != nil {
-			log.Debugf("resetting stream deadline: ", err)
+			h.log.Debugf("resetting stream deadline: %s", err)
+			s.Reset()
+			return
+		}
+	} else if h.inboundTimeout > 0 {
+		if err := s.SetReadDeadline(time.Time{}); err != nil {
+			h.log.Debugf("resetting stream read deadline: %s", err)
 			s.Reset()
 			return
 		}
 	}
 
 	s.SetProtocol(protocol.ID(protoID))
-	log.Debugf("protocol negotiation took %s", took)
+	h.log.Debugf("protocol negotiation took %s", took)
 
-	go handle(protoID, s)
+	if !h.authorized(protocol.ID(protoID), s.Conn().RemotePeer()) {
+		h.log.Debugf("peer %s not allowed to open %s streams", s.Conn().RemotePeer(), protoID)
+		s.Reset()
+		h.emitAuthRejected(s, protocol.ID(protoID))
+		return
+	}
+
+	var rs network.Stream = s
+	if h.readTimeout > 0 {
+		rs = newReadTimeoutStream(s, h.readTimeout)
+	}
+
+	is, err := h.interceptStream(network.DirInbound, rs)
+	if err != nil {
+		h.log.Debugf("stream interceptor rejected %s stream from %s: %s", protoID, s.Conn().RemotePeer(), err)
+		return
+	}
+
+	go h.runHandler(handle, protoID, is)
 }
 
 // PushIdentify pushes an identify update through the identify push protocol
 // Warning: this interface is unstable and may disappear in the future.
 func (h *BasicHost) PushIdentify() {
-	push := false
+	h.CheckForAddressChanges()
+}
+
+// IdentifyPush pushes our current identify information, e.g. our addresses
+// and protocols, to p. It returns an error if we aren't connected to p.
+func (h *BasicHost) IdentifyPush(ctx context.Context, p peer.ID) error {
+	return h.ids.PushTo(ctx, p)
+}
 
+// IdentifyPushAll pushes our current identify information to all the peers
+// we're connected to, waiting for all the pushes to complete or ctx to be
+// done. It returns an error if we aren't connected to any peer or if any of
+// the pushes failed.
+func (h *BasicHost) IdentifyPushAll(ctx context.Context) error {
+	peers := h.Network().Peers()
+	if len(peers) == 0 {
+		return identify.ErrNotConnected
+	}
+	return h.identifyPushPeers(ctx, peers)
+}
+
+// identifyPushPeers pushes our current identify information to peers, waiting
+// for all the pushes to complete or ctx to be done.
+func (h *BasicHost) identifyPushPeers(ctx context.Context, peers []peer.ID) error {
+	errs := make(chan error, len(peers))
+	for _, p := range peers {
+		go func(p peer.ID) {
+			errs <- h.ids.PushTo(ctx, p)
+		}(p)
+	}
+
+	var (
+		failed   int
+		firstErr error
+	)
+	for range peers {
+		if err := <-errs; err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to push identify to %d of %d peers: %s", failed, len(peers), firstErr)
+	}
+	return nil
+}
+
+// CheckForAddressChanges determines whether our addresses have changed since
+// the last check and, if so, emits an EvtLocalAddressesUpdated event and
+// pushes the new addresses to our peers through identify.
+//
+// A started host calls this periodically, see
+// HostOpts.AddressChangePollingInterval.
+func (h *BasicHost) CheckForAddressChanges() {
 	h.mx.Lock()
 	addrs := h.Addrs()
-	if !sameAddrs(addrs, h.lastAddrs) {
-		push = true
+	changeEvt := makeUpdatedAddrEvent(h.lastAddrs, addrs)
+	if changeEvt != nil {
 		h.lastAddrs = addrs
 	}
 	h.mx.Unlock()
 
-	if push {
+	if changeEvt != nil {
+		h.metrics.addrsChanged()
+		if h.addrChangeHook != nil {
+			var added, removed []ma.Multiaddr
+			for _, u := range changeEvt.Current {
+				if u.Action == event.Added {
+					added = append(added, u.Address)
+				}
+			}
+			for _, u := range changeEvt.Removed {
+				removed = append(removed, u.Address)
+			}
+			h.addrChangeHook(added, removed)
+		}
+		if err := h.emitters.evtLocalAddressesUpdated.Emit(*changeEvt); err != nil {
+			h.log.Warnf("error emitting event for updated addrs: %s", err)
+		}
 		h.ids.Push()
 	}
 }
 
+// makeUpdatedAddrEvent diffs the previous and current address sets, returning
+// nil if they are the same.
+func makeUpdatedAddrEvent(prev, current []ma.Multiaddr) *event.EvtLocalAddressesUpdated {
+	prevmap := make(map[string]ma.Multiaddr, len(prev))
+	evt := event.EvtLocalAddressesUpdated{Diffs: true}
+	addrsAdded := false
+
+	for _, addr := range prev {
+		prevmap[string(addr.Bytes())] = addr
+	}
+	for _, addr := range current {
+		_, ok := prevmap[string(addr.Bytes())]
+		updated := event.UpdatedAddress{Address: addr}
+		if ok {
+			updated.Action = event.Maintained
+		} else {
+			updated.Action = event.Added
+			addrsAdded = true
+		}
+		evt.Current = append(evt.Current, updated)
+		delete(prevmap, string(addr.Bytes()))
+	}
+	for _, addr := range prevmap {
+		updated := event.UpdatedAddress{Action: event.Removed, Address: addr}
+		evt.Removed = append(evt.Removed, updated)
+	}
+
+	if !addrsAdded && len(evt.Removed) == 0 {
+		return nil
+	}
+
+	return &evt
+}
+
 func (h *BasicHost) background(p goprocess.Process) {
 	// periodically schedules an IdentifyPush to update our peers for changes
 	// in our address set (if needed)
-	ticker := time.NewTicker(1 * time.Minute)
+	ticker := time.NewTicker(h.addrChangeInterval)
 	defer ticker.Stop()
 
-	// initialize lastAddrs
-	h.mx.Lock()
-	if h.lastAddrs == nil {
-		h.lastAddrs = h.Addrs()
+	var bwTick <-chan time.Time
+	if h.bwInterval > 0 {
+		bwTicker := time.NewTicker(h.bwInterval)
+		defer bwTicker.Stop()
+		bwTick = bwTicker.C
+	}
+
+	// advertise the external addresses as soon as the port mappings change
+	// rather than on the next tick.
+	var natSynced <-chan struct{}
+	if n, ok := h.natmgr.(interface{ syncedChan() <-chan struct{} }); ok {
+		natSynced = n.syncedChan()
 	}
-	h.mx.Unlock()
 
 	for {
 		select {
 		case <-ticker.C:
-			h.PushIdentify()
-
-		case <-p.Closing():
-			return
-		}
-	}
-}
+			h.CheckForAddressChanges()
 
-func sameAddrs(a, b []ma.Multiaddr) bool {
-	if len(a) != len(b) {
-		return false
-	}
+		case <-bwTick:
+			h.emitBandwidthSnapshot()
 
-	bmap := make(map[string]struct{}, len(b))
-	for _, addr := range b {
-		bmap[string(addr.Bytes())] = struct{}{}
-	}
+		case <-natSynced:
+			h.CheckForAddressChanges()
 
-	for _, addr := range a {
-		_, ok := bmap[string(addr.Bytes())]
-		if !ok {
-			return false
+		case <-p.Closing():
+			return
 		}
 	}
-
-	return true
 }
 
 // ID returns the (local) peer.ID associated with this Host
@@ -372,6 +1343,19 @@ func (h *BasicHost) Network() network.Network {
 	return h.network
 }
 
+// Swarm returns the network of the host as a *swarm.Swarm, or nil if the host
+// runs on another network implementation, e.g. a mock network.
+func (h *BasicHost) Swarm() *swarm.Swarm {
+	s, _ := h.network.(*swarm.Swarm)
+	return s
+}
+
+// Connectedness returns the state of our connection to p. It's a shorthand
+// for h.Network().Connectedness(p).
+func (h *BasicHost) Connectedness(p peer.ID) network.Connectedness {
+	return h.Network().Connectedness(p)
+}
+
 // Mux returns the Mux multiplexing incoming streams to protocol handlers
 func (h *BasicHost) Mux() protocol.Switch {
 	return h.mux
@@ -386,78 +1370,417 @@ func (h *BasicHost) EventBus() event.Bus {
 	return h.eventbus
 }
 
+// RegisterNetworkNotifiee registers n to receive the notifications of the
+// host's network. This is equivalent to:
+//   host.Network().Notify(n)
+func (h *BasicHost) RegisterNetworkNotifiee(n network.Notifiee) {
+	h.Network().Notify(n)
+}
+
+// UnregisterNetworkNotifiee stops the notifications registered with
+// RegisterNetworkNotifiee. This is equivalent to:
+//   host.Network().StopNotify(n)
+func (h *BasicHost) UnregisterNetworkNotifiee(n network.Notifiee) {
+	h.Network().StopNotify(n)
+}
+
 // SetStreamHandler sets the protocol handler on the Host's Mux.
 // This is equivalent to:
 //   host.Mux().SetHandler(proto, handler)
 // (Threadsafe)
 func (h *BasicHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
-	h.Mux().AddHandler(string(pid), func(p string, rwc io.ReadWriteCloser) error {
-		is := rwc.(network.Stream)
-		is.SetProtocol(protocol.ID(p))
-		handler(is)
-		return nil
-	})
-	h.emitters.evtLocalProtocolsUpdated.Emit(event.EvtLocalProtocolsUpdated{
+	h.setStreamHandler(pid, "", handler, nil)
+}
+
+func (h *BasicHost) setStreamHandler(pid protocol.ID, desc string, handler network.StreamHandler, onRemove func()) {
+	h.removePeerMatchHandler(pid)
+	h.recordProtocol(pid, false, desc, onRemove)
+	h.addMuxHandler(pid, nil, h.muxHandler(pid, handler))
+	h.emitLocalProtocolsUpdated(event.EvtLocalProtocolsUpdated{
 		Added: []protocol.ID{pid},
 	})
 }
 
+// SetStreamHandlers sets the handlers of several protocols forming a
+// service at once, like SetStreamHandler, emitting a single
+// EvtLocalProtocolsUpdated with all of them once they're all set. Peers
+// learn about them all together through identify.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlers(handlers map[protocol.ID]network.StreamHandler) {
+	if len(handlers) == 0 {
+		return
+	}
+
+	handles := make(map[protocol.ID]msmux.HandlerFunc, len(handlers))
+	added := make([]protocol.ID, 0, len(handlers))
+	for pid, handler := range handlers {
+		h.removePeerMatchHandler(pid)
+		h.recordProtocol(pid, false, "", nil)
+		handles[pid] = h.muxHandler(pid, handler)
+		added = append(added, pid)
+	}
+	h.addMuxHandlers(handles)
+
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	h.emitLocalProtocolsUpdated(event.EvtLocalProtocolsUpdated{Added: added})
+}
+
 // SetStreamHandlerMatch sets the protocol handler on the Host's Mux
 // using a matching function to do protocol comparisons
 func (h *BasicHost) SetStreamHandlerMatch(pid protocol.ID, m func(string) bool, handler network.StreamHandler) {
-	h.Mux().AddHandlerWithFunc(string(pid), m, func(p string, rwc io.ReadWriteCloser) error {
+	h.removePeerMatchHandler(pid)
+	h.recordProtocol(pid, true, "", nil)
+	h.addMuxHandler(pid, m, h.muxHandler(pid, handler))
+	h.emitLocalProtocolsUpdated(event.EvtLocalProtocolsUpdated{
+		Added: []protocol.ID{pid},
+	})
+}
+
+// ReplaceStreamHandler atomically replaces the protocol handler for pid on
+// the Host's Mux: inbound streams are dispatched either to the previous or to
+// the new handler, none is rejected in between. Streams already dispatched
+// keep running with the previous handler. Like SetStreamHandler, the new
+// handler matches pid exactly. The middleware for pid is kept.
+// (Threadsafe)
+func (h *BasicHost) ReplaceStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	registered := false
+	for _, proto := range h.Mux().Protocols() {
+		if proto == string(pid) {
+			registered = true
+			break
+		}
+	}
+
+	// replace the handler in the muxer before dropping a peer-aware one, so
+	// that the protocol is always handled.
+	h.recordProtocol(pid, false, "", nil)
+	h.addMuxHandler(pid, nil, h.muxHandler(pid, handler))
+	h.removePeerMatchHandler(pid)
+
+	if !registered {
+		h.emitLocalProtocolsUpdated(event.EvtLocalProtocolsUpdated{
+			Added: []protocol.ID{pid},
+		})
+	}
+}
+
+// RemoveStreamHandler returns ..
+func (h *BasicHost) RemoveStreamHandler(pid protocol.ID) {
+	h.removeMuxHandler(pid)
+	h.removePeerMatchHandler(pid)
+	h.forgetProtocol(pid)
+
+	h.middlewareMx.Lock()
+	delete(h.middleware, pid)
+	h.middlewareMx.Unlock()
+
+	h.emitLocalProtocolsUpdated(event.EvtLocalProtocolsUpdated{
+		Removed: []protocol.ID{pid},
+	})
+}
+
+// UseStreamMiddleware appends the given middleware to the chain applied to
+// streams dispatched to the handler registered for pid. Middleware is applied
+// in the order it was added: the first middleware is the outermost wrapper.
+//
+// Middleware may be registered before the handler itself; it is stored and
+// applied once a handler for pid is set. Removing the handler with
+// RemoveStreamHandler also clears its middleware.
+// (Threadsafe)
+func (h *BasicHost) UseStreamMiddleware(pid protocol.ID, mw ...StreamMiddleware) {
+	h.middlewareMx.Lock()
+	h.middleware[pid] = append(h.middleware[pid], mw...)
+	h.middlewareMx.Unlock()
+}
+
+// muxHandler adapts a network.StreamHandler registered for pid to the
+// multistream handler signature. The middleware chain is looked up when the
+// stream is dispatched so that middleware added after the handler still
+// applies.
+func (h *BasicHost) muxHandler(pid protocol.ID, handler network.StreamHandler) msmux.HandlerFunc {
+	return func(p string, rwc io.ReadWriteCloser) error {
 		is := rwc.(network.Stream)
+
+		h.handlersMx.Lock()
+		if h.draining {
+			h.handlersMx.Unlock()
+			is.Reset()
+			return nil
+		}
+		h.handlers.Add(1)
+		h.handlersMx.Unlock()
+		defer h.handlers.Done()
+
 		is.SetProtocol(protocol.ID(p))
-		handler(is)
+		if h.closeStreamProtos.has(protocol.ID(p)) {
+			is = &streamResetStream{Stream: is}
+		}
+		s := h.trackStream(&meteredStream{
+			Stream: is,
+			bwc:    h.bwc,
+		}, network.DirInbound)
+		h.applyMiddleware(pid, handler)(s)
 		return nil
-	})
-	h.emitters.evtLocalProtocolsUpdated.Emit(event.EvtLocalProtocolsUpdated{
-		Added: []protocol.ID{pid},
-	})
+	}
+}
+
+func (h *BasicHost) applyMiddleware(pid protocol.ID, handler network.StreamHandler) network.StreamHandler {
+	h.middlewareMx.RLock()
+	mws := h.middleware[pid]
+	h.middlewareMx.RUnlock()
+
+	for i := len(mws) - 1; i >= 0; i-- {
+		handler = mws[i](handler)
+	}
+	return handler
+}
+
+// NewStream opens a new stream to given peer p, and writes a p2p/protocol
+// header with given protocol.ID. If there is no connection to p, attempts
+// to create one. If ProtocolID is "", writes no header.
+// When NewStreamRetries is set, opening the stream is retried, with
+// backoff, over a new connection when the current one is reset. Only the
+// connection that failed is closed.
+// (Threadsafe)
+func (h *BasicHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (s network.Stream, err error) {
+	ctx, span := h.startSpan(ctx, NewStreamSpanName, p)
+	if span != nil {
+		defer func() {
+			if err != nil {
+				endSpan(span, nil, "", err)
+			} else {
+				endSpan(span, s.Conn(), s.Protocol(), nil)
+			}
+		}()
+	}
+
+	var errs newStreamRetryError
+	backoff := h.newStreamRetryBackoff
+	for {
+		s, c, err := h.newStreamOnce(ctx, p, pids)
+		if err == nil {
+			h.recordContextValues(ctx, s.Conn())
+			return h.interceptStream(network.DirOutbound, s)
+		}
+		errs = append(errs, err)
+		if len(errs) > h.newStreamRetries || !retriableStreamError(err) || ctx.Err() != nil {
+			if len(errs) == 1 {
+				return nil, err
+			}
+			return nil, errs
+		}
+
+		// retry over a new connection.
+		h.log.Debugf("error opening a stream to %s, retrying in %s: %s", p, backoff, err)
+		if c != nil {
+			c.Close()
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, append(errs, ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// newStreamOnce makes a single attempt at opening a stream to p. On error, it
+// also returns the connection the stream was opened on, if it got that far.
+func (h *BasicHost) newStreamOnce(ctx context.Context, p peer.ID, pids []protocol.ID) (network.Stream, network.Conn, error) {
+	pref, err := h.preferredProtocol(p, pids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pref != "" {
+		s, err := h.newStream(ctx, p, pref)
+		if err != nil {
+			return nil, nil, err
+		}
+		return h.wrapOutboundStream(s), nil, nil
+	}
+
+	var protoStrs []string
+	for _, pid := range pids {
+		protoStrs = append(protoStrs, string(pid))
+	}
+
+	s, err := h.openStream(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selected, err := h.negotiateOutbound(ctx, s, protoStrs)
+	if err != nil {
+		s.Reset()
+		return nil, s.Conn(), err
+	}
+	selpid := protocol.ID(selected)
+	s.SetProtocol(selpid)
+	h.Peerstore().AddProtocols(p, selected)
+
+	return h.wrapOutboundStream(s), nil, nil
+}
+
+// newStreamRetryError holds the errors of all the attempts to open a stream.
+type newStreamRetryError []error
+
+func (e newStreamRetryError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "failed to open stream after %d attempts:", len(e))
+	for _, err := range e {
+		fmt.Fprintf(&b, "\n  * %s", err)
+	}
+	return b.String()
+}
+
+func (e newStreamRetryError) Unwrap() []error {
+	return e
+}
+
+// retriableStreamError reports whether err means the connection broke while
+// opening a stream.
+func retriableStreamError(err error) bool {
+	return errors.Is(err, mux.ErrReset) || errors.Is(err, io.EOF)
+}
+
+// NewStreamWithFallback opens a new stream to p, negotiating preferred or,
+// if p doesn't support it, the first supported protocol of fallback. It
+// returns the negotiated protocol. When falling back, preferred is removed
+// from the protocols the peerstore knows for p so that future streams don't
+// try it first.
+// (Threadsafe)
+func (h *BasicHost) NewStreamWithFallback(ctx context.Context, p peer.ID, preferred protocol.ID, fallback ...protocol.ID) (network.Stream, protocol.ID, error) {
+	pids := append([]protocol.ID{preferred}, fallback...)
+	s, err := h.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	selected := s.Protocol()
+	if selected != preferred {
+		h.log.Warnf("peer %s doesn't support %s, falling back to %s", p, preferred, selected)
+		if err := h.Peerstore().RemoveProtocols(p, string(preferred)); err != nil {
+			h.log.Debugf("error recording protocol fallback for %s: %s", p, err)
+		}
+	}
+	return s, selected, nil
+}
+
+// NewStreamTimeout is like NewStream but bounds the time spent dialing p and
+// negotiating the protocol by timeout, independently of ctx. The returned
+// stream has no deadline set.
+// (Threadsafe)
+func (h *BasicHost) NewStreamTimeout(ctx context.Context, p peer.ID, timeout time.Duration, pids ...protocol.ID) (network.Stream, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// negotiateOutbound clears the deadlines it sets once done.
+	return h.NewStream(ctx, p, pids...)
+}
+
+// OpenProtocol connects to pi, unless we're already connected, and opens a
+// new stream for one of the given protocols, like Connect followed by
+// NewStream. If the stream is reset while being opened, typically because the
+// connection broke, it connects again, dialing a new connection if needed,
+// and retries once.
+// (Threadsafe)
+func (h *BasicHost) OpenProtocol(ctx context.Context, pi peer.AddrInfo, pids ...protocol.ID) (network.Stream, error) {
+	var (
+		s   network.Stream
+		err error
+	)
+	for i := 0; i < 2; i++ {
+		if err = h.Connect(ctx, pi); err != nil {
+			return nil, err
+		}
+		s, err = h.NewStream(ctx, pi.ID, pids...)
+		if !errors.Is(err, mux.ErrReset) {
+			break
+		}
+		h.log.Debugf("stream to %s reset while opening, retrying", pi.ID)
+	}
+	return s, err
 }
 
-// RemoveStreamHandler returns ..
-func (h *BasicHost) RemoveStreamHandler(pid protocol.ID) {
-	h.Mux().RemoveHandler(string(pid))
-	h.emitters.evtLocalProtocolsUpdated.Emit(event.EvtLocalProtocolsUpdated{
-		Removed: []protocol.ID{pid},
-	})
+// wrapOutboundStream prepares a stream opened by NewStream to be returned to
+// the caller.
+func (h *BasicHost) wrapOutboundStream(s network.Stream) network.Stream {
+	if h.writeTimeout > 0 {
+		s = newWriteTimeoutStream(s, h.writeTimeout)
+	}
+	if h.closeStreamProtos.has(s.Protocol()) {
+		s = &streamResetStream{Stream: s}
+	}
+	if h.handlerErrorProtos.has(s.Protocol()) {
+		s = &handlerErrorStream{Stream: s}
+	}
+	return h.trackStream(&meteredStream{
+		Stream: s,
+		bwc:    h.bwc,
+	}, network.DirOutbound)
 }
 
-// NewStream opens a new stream to given peer p, and writes a p2p/protocol
-// header with given protocol.ID. If there is no connection to p, attempts
-// to create one. If ProtocolID is "", writes no header.
-// (Threadsafe)
-func (h *BasicHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
-	pref, err := h.preferredProtocol(p, pids)
-	if err != nil {
-		return nil, err
+// negotiateOutbound selects one of protos on s, giving up when the
+// negotiation timeout expires or ctx is done, whichever comes first.
+func (h *BasicHost) negotiateOutbound(ctx context.Context, s network.Stream, protos []string) (string, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	if h.negtimeout > 0 {
+		if negdeadline := time.Now().Add(h.negtimeout); !hasDeadline || negdeadline.Before(deadline) {
+			deadline, hasDeadline = negdeadline, true
+		}
 	}
 
-	if pref != "" {
-		return h.newStream(ctx, p, pref)
+	if hasDeadline {
+		if err := s.SetDeadline(deadline); err != nil {
+			return "", err
+		}
 	}
 
-	var protoStrs []string
-	for _, pid := range pids {
-		protoStrs = append(protoStrs, string(pid))
+	var hasWriteDeadline bool
+	if h.outboundTimeout > 0 {
+		if wdeadline := time.Now().Add(h.outboundTimeout); !hasDeadline || wdeadline.Before(deadline) {
+			if err := s.SetWriteDeadline(wdeadline); err != nil {
+				return "", err
+			}
+			hasWriteDeadline = true
+		}
 	}
 
-	s, err := h.Network().NewStream(ctx, p)
-	if err != nil {
-		return nil, err
+	type result struct {
+		selected string
+		err      error
 	}
+	resCh := make(chan result, 1)
+	go func() {
+		selected, err := msmux.SelectOneOf(protos, s)
+		resCh <- result{selected, err}
+	}()
 
-	selected, err := msmux.SelectOneOf(protoStrs, s)
-	if err != nil {
+	var res result
+	select {
+	case res = <-resCh:
+	case <-ctx.Done():
 		s.Reset()
-		return nil, err
+		<-resCh
+		return "", ctx.Err()
+	}
+	if res.err != nil {
+		return "", res.err
 	}
-	selpid := protocol.ID(selected)
-	s.SetProtocol(selpid)
-	h.Peerstore().AddProtocols(p, selected)
 
-	return s, nil
+	if hasDeadline {
+		if err := s.SetDeadline(time.Time{}); err != nil {
+			return "", err
+		}
+	} else if hasWriteDeadline {
+		if err := s.SetWriteDeadline(time.Time{}); err != nil {
+			return "", err
+		}
+	}
+	return res.selected, nil
 }
 
 func pidsToStrings(pids []protocol.ID) []string {
@@ -469,6 +1792,10 @@ func pidsToStrings(pids []protocol.ID) []string {
 }
 
 func (h *BasicHost) preferredProtocol(p peer.ID, pids []protocol.ID) (protocol.ID, error) {
+	if h.protoPreference != nil {
+		return h.selectPreferredProtocol(p, pids)
+	}
+
 	pidstrs := pidsToStrings(pids)
 	supported, err := h.Peerstore().SupportsProtocols(p, pidstrs...)
 	if err != nil {
@@ -482,19 +1809,77 @@ func (h *BasicHost) preferredProtocol(p peer.ID, pids []protocol.ID) (protocol.I
 	return out, nil
 }
 
+// selectPreferredProtocol implements preferredProtocol with the
+// ProtocolPreference option.
+func (h *BasicHost) selectPreferredProtocol(p peer.ID, pids []protocol.ID) (protocol.ID, error) {
+	protos, err := h.Peerstore().GetProtocols(p)
+	if err != nil {
+		return "", err
+	}
+	if len(protos) == 0 {
+		return "", nil
+	}
+	offered := make([]protocol.ID, len(protos))
+	for i, proto := range protos {
+		offered[i] = protocol.ID(proto)
+	}
+
+	pref := h.protoPreference(offered, pids)
+	if pref == "" {
+		return "", nil
+	}
+	if !containsProtocol(offered, pref) || !containsProtocol(pids, pref) {
+		h.log.Debugf("ignoring preferred protocol %s for %s: not offered by both sides", pref, p)
+		return "", nil
+	}
+	return pref, nil
+}
+
+func containsProtocol(pids []protocol.ID, pid protocol.ID) bool {
+	for _, p := range pids {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *BasicHost) newStream(ctx context.Context, p peer.ID, pid protocol.ID) (network.Stream, error) {
-	s, err := h.Network().NewStream(ctx, p)
+	if h.pendingStreams != nil {
+		if err := h.pendingStreams.acquire(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := h.openStream(ctx, p)
 	if err != nil {
+		if h.pendingStreams != nil {
+			h.pendingStreams.release(p)
+		}
 		return nil, err
 	}
 
 	s.SetProtocol(pid)
 
 	lzcon := msmux.NewMSSelect(s, string(pid))
-	return &streamWrapper{
+	var ws network.Stream = &streamWrapper{
 		Stream: s,
 		rw:     lzcon,
-	}, nil
+	}
+	if h.pendingStreams != nil {
+		ws = &pendingStream{Stream: ws, release: func() { h.pendingStreams.release(p) }}
+	}
+	return ws, nil
+}
+
+// EvtPeerConnected is emitted on the host's event bus when Connect dialed a
+// new connection to a peer.
+type EvtPeerConnected struct {
+	Peer peer.ID
+	Conn network.Conn
+	// Latency is the time from the Connect call to the connection being
+	// usable, i.e. identified.
+	Latency time.Duration
 }
 
 // Connect ensures there is a connection between this host and the peer with
@@ -502,21 +1887,240 @@ func (h *BasicHost) newStream(ctx context.Context, p peer.ID, pid protocol.ID) (
 // h.Network.Dial, and block until a connection is open, or an error is returned.
 // Connect will absorb the addresses in pi into its internal peerstore.
 // It will also resolve any /dns4, /dns6, and /dnsaddr addresses.
-func (h *BasicHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+// When dialing all the addresses of the peer fails, the error is a
+// *DialError holding the error of each address.
+// Concurrent calls for the same peer share a single connection attempt and
+// its outcome. The addresses given to a call joining an attempt in progress
+// are added to the peerstore but may not be dialed by that attempt.
+func (h *BasicHost) Connect(ctx context.Context, pi peer.AddrInfo) (err error) {
+	ctx, span := h.startSpan(ctx, ConnectSpanName, pi.ID)
+	if span != nil {
+		defer func() {
+			var c network.Conn
+			if conns := h.Network().ConnsToPeer(pi.ID); err == nil && len(conns) > 0 {
+				c = conns[len(conns)-1]
+			}
+			endSpan(span, c, "", err)
+		}()
+	}
+
+	for {
+		h.connectsMx.Lock()
+		call, ok := h.connects[pi.ID]
+		if !ok {
+			call = &connectCall{done: make(chan struct{})}
+			h.connects[pi.ID] = call
+			h.connectsMx.Unlock()
+
+			call.err = h.connect(ctx, pi)
+
+			h.connectsMx.Lock()
+			delete(h.connects, pi.ID)
+			h.connectsMx.Unlock()
+			close(call.done)
+			return call.err
+		}
+		h.connectsMx.Unlock()
+
+		if h.gater == nil || h.gater.InterceptPeerDial(pi.ID) {
+			h.Peerstore().AddAddrs(pi.ID, h.gateAddrs(pi.ID, pi.Addrs), peerstore.TempAddrTTL)
+		}
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// the attempt was abandoned by the caller that made it, not failed:
+		// make our own.
+		if call.err == context.Canceled || call.err == context.DeadlineExceeded {
+			continue
+		}
+		return call.err
+	}
+}
+
+// connectCall is a connection attempt made by Connect, shared by the
+// concurrent calls for the same peer.
+type connectCall struct {
+	done chan struct{}
+	err  error
+}
+
+func (h *BasicHost) connect(ctx context.Context, pi peer.AddrInfo) error {
+	start := time.Now()
+
+	if h.gater != nil && !h.gater.InterceptPeerDial(pi.ID) {
+		return ErrGaterDisallowedConnection
+	}
+
 	// absorb addresses into peerstore
-	h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.TempAddrTTL)
+	h.Peerstore().AddAddrs(pi.ID, h.prioritizeDialAddrs(h.gateAddrs(pi.ID, pi.Addrs)), peerstore.TempAddrTTL)
 
 	if h.Network().Connectedness(pi.ID) == network.Connected {
 		return nil
 	}
 
-	resolved, err := h.resolveAddrs(ctx, h.Peerstore().PeerInfo(pi.ID))
+	if dl := h.getDialLimiter(); dl != nil {
+		if err := dl.acquire(ctx, pi.ID); err != nil {
+			return err
+		}
+		defer dl.release(pi.ID)
+
+		// we may have connected while waiting.
+		if h.Network().Connectedness(pi.ID) == network.Connected {
+			return nil
+		}
+	}
+
+	known := h.Peerstore().PeerInfo(pi.ID)
+	resolved, err := h.resolveAddrs(ctx, known)
+	if err != nil {
+		return err
+	}
+	h.addResolvedAddrs(pi.ID, known.Addrs, resolved)
+
+	c, err := h.dialPeer(ctx, pi.ID)
+	if err != nil {
+		return err
+	}
+	h.recordContextValues(ctx, c)
+
+	evt := EvtPeerConnected{Peer: pi.ID, Conn: c, Latency: time.Since(start)}
+	if err := h.emitters.evtPeerConnected.Emit(evt); err != nil {
+		h.log.Warnf("error emitting event for connection to %s: %s", pi.ID, err)
+	}
+	return nil
+}
+
+// ConnectWithAddrs connects to p through the given addresses, like Connect,
+// but without keeping them in the peerstore: the addresses that weren't
+// already known for p are removed from it once the connection attempt is
+// over. This is useful for one-shot addresses, e.g. learned through a
+// rendezvous.
+func (h *BasicHost) ConnectWithAddrs(ctx context.Context, p peer.ID, addrs []ma.Multiaddr) error {
+	known := h.Peerstore().Addrs(p)
+	var added []ma.Multiaddr
+	for _, a := range addrs {
+		if !containsAddr(known, a) {
+			added = append(added, a)
+		}
+	}
+
+	err := h.Connect(ctx, peer.AddrInfo{ID: p, Addrs: addrs})
+
+	for _, a := range added {
+		h.Peerstore().SetAddr(p, a, 0)
+	}
+	return err
+}
+
+// ConnectPriorityTag is the connection manager tag ConnectWithPriority sets on
+// the peers it connects to.
+const ConnectPriorityTag = "host/connect-priority"
+
+// ConnectWithPriority connects to pi like Connect and, once connected, tags
+// the peer with priority under ConnectPriorityTag so that the connection
+// manager prefers to keep the connection when pruning.
+func (h *BasicHost) ConnectWithPriority(ctx context.Context, pi peer.AddrInfo, priority int) error {
+	if err := h.Connect(ctx, pi); err != nil {
+		return err
+	}
+	h.ConnManager().TagPeer(pi.ID, ConnectPriorityTag, priority)
+	return nil
+}
+
+// WaitForConnect blocks until we're connected to p, without dialing it
+// itself. It returns as soon as Connect emits EvtPeerConnected for p, or the
+// network reports any other connection to p, e.g. an inbound one, and
+// ctx.Err() if ctx expires first.
+func (h *BasicHost) WaitForConnect(ctx context.Context, p peer.ID) error {
+	// subscribe before checking the connectedness so we can't miss a
+	// connection.
+	sub, err := h.EventBus().Subscribe(new(EvtPeerConnected), eventbus.BufSize(16))
 	if err != nil {
 		return err
 	}
-	h.Peerstore().AddAddrs(pi.ID, resolved, peerstore.TempAddrTTL)
+	defer sub.Close()
+
+	connected := make(chan struct{}, 1)
+	notifee := &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			if c.RemotePeer() != p {
+				return
+			}
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		},
+	}
+	h.Network().Notify(notifee)
+	defer h.Network().StopNotify(notifee)
+
+	if h.Network().Connectedness(p) == network.Connected {
+		return nil
+	}
+	for {
+		select {
+		case evt, ok := <-sub.Out():
+			if !ok {
+				return errHostClosed
+			}
+			if evt.(EvtPeerConnected).Peer == p {
+				return nil
+			}
+		case <-connected:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// addResolvedAddrs adds the resolved addresses of p to the peerstore in a
+// single write, skipping the duplicates and the addresses we already know,
+// which is most of them when few need resolving.
+func (h *BasicHost) addResolvedAddrs(p peer.ID, known, resolved []ma.Multiaddr) {
+	seen := make(map[string]struct{}, len(known)+len(resolved))
+	for _, a := range known {
+		seen[string(a.Bytes())] = struct{}{}
+	}
+	added := make([]ma.Multiaddr, 0, len(resolved))
+	for _, a := range resolved {
+		if _, ok := seen[string(a.Bytes())]; ok {
+			continue
+		}
+		seen[string(a.Bytes())] = struct{}{}
+		added = append(added, a)
+	}
+	if len(added) == 0 {
+		return
+	}
+	h.Peerstore().AddAddrs(p, h.prioritizeDialAddrs(h.gateAddrs(p, added)), peerstore.TempAddrTTL)
+}
+
+func containsAddr(addrs []ma.Multiaddr, a ma.Multiaddr) bool {
+	for _, b := range addrs {
+		if a.Equal(b) {
+			return true
+		}
+	}
+	return false
+}
 
-	return h.dialPeer(ctx, pi.ID)
+// ResolveAddrs resolves the /dns4, /dns6 and /dnsaddr addresses of pi like
+// Connect does, without touching the peerstore. The /dnsaddr records of other
+// peers are left out, failed lookups are skipped, and the addresses that
+// don't need to be resolved are returned as is. It fails with
+// ErrMaxAddrResolutionDepth when resolution recurses too deep.
+func (h *BasicHost) ResolveAddrs(ctx context.Context, pi peer.AddrInfo) (peer.AddrInfo, error) {
+	addrs, err := h.resolveAddrs(ctx, pi)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	return peer.AddrInfo{ID: pi.ID, Addrs: addrs}, nil
 }
 
 func (h *BasicHost) resolveAddrs(ctx context.Context, pi peer.AddrInfo) ([]ma.Multiaddr, error) {
@@ -528,18 +2132,29 @@ func (h *BasicHost) resolveAddrs(ctx context.Context, pi peer.AddrInfo) ([]ma.Mu
 
 	resolveSteps := 0
 
+	// depthAddr is an address along with the number of lookups that
+	// produced it.
+	type depthAddr struct {
+		addr  ma.Multiaddr
+		depth int
+	}
+
 	// Recursively resolve all addrs.
 	//
 	// While the toResolve list is non-empty:
 	// * Pop an address off.
 	// * If the address is fully resolved, add it to the resolved list.
 	// * Otherwise, resolve it and add the results to the "to resolve" list.
-	toResolve := append(([]ma.Multiaddr)(nil), pi.Addrs...)
+	toResolve := make([]depthAddr, 0, len(pi.Addrs))
+	for _, addr := range pi.Addrs {
+		toResolve = append(toResolve, depthAddr{addr: addr})
+	}
 	resolved := make([]ma.Multiaddr, 0, len(pi.Addrs))
 	for len(toResolve) > 0 {
 		// pop the last addr off.
-		addr := toResolve[len(toResolve)-1]
+		next := toResolve[len(toResolve)-1]
 		toResolve = toResolve[:len(toResolve)-1]
+		addr, depth := next.addr, next.depth
 
 		// if it's resolved, add it to the resolved list.
 		if !madns.Matches(addr) {
@@ -552,7 +2167,7 @@ func (h *BasicHost) resolveAddrs(ctx context.Context, pi peer.AddrInfo) ([]ma.Mu
 		// We've resolved too many addresses. We can keep all the fully
 		// resolved addresses but we'll need to skip the rest.
 		if resolveSteps >= maxAddressResolution {
-			log.Warningf(
+			h.log.Warnf(
 				"peer %s asked us to resolve too many addresses: %s/%s",
 				pi.ID,
 				resolveSteps,
@@ -561,43 +2176,72 @@ func (h *BasicHost) resolveAddrs(ctx context.Context, pi peer.AddrInfo) ([]ma.Mu
 			continue
 		}
 
+		if depth >= h.maxResolveDepth {
+			return nil, ErrMaxAddrResolutionDepth
+		}
+
 		// otherwise, resolve it
 		reqaddr := addr.Encapsulate(p2paddr)
-		resaddrs, err := h.maResolver.Resolve(ctx, reqaddr)
+		resaddrs, err := h.resolve(ctx, reqaddr)
 		if err != nil {
-			log.Infof("error resolving %s: %s", reqaddr, err)
+			h.log.Infof("error resolving %s: %s", reqaddr, err)
 		}
 
 		// add the results to the toResolve list.
 		for _, res := range resaddrs {
 			pi, err := peer.AddrInfoFromP2pAddr(res)
 			if err != nil {
-				log.Infof("error parsing %s: %s", res, err)
+				h.log.Infof("error parsing %s: %s", res, err)
+			}
+			for _, addr := range pi.Addrs {
+				toResolve = append(toResolve, depthAddr{addr: addr, depth: depth + 1})
 			}
-			toResolve = append(toResolve, pi.Addrs...)
 		}
 	}
 
 	return resolved, nil
 }
 
+// resolve resolves addr, retrying failed lookups as configured.
+func (h *BasicHost) resolve(ctx context.Context, addr ma.Multiaddr) ([]ma.Multiaddr, error) {
+	backoff := h.dnsBackoff
+	for i := 0; ; i++ {
+		addrs, err := h.maResolver.Resolve(ctx, addr)
+		if err == nil || i >= h.dnsRetries {
+			return addrs, err
+		}
+
+		h.log.Debugf("error resolving %s, retrying in %s: %s", addr, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
 // dialPeer opens a connection to peer, and makes sure to identify
 // the connection once it has been opened.
-func (h *BasicHost) dialPeer(ctx context.Context, p peer.ID) error {
-	log.Debugf("host %s dialing %s", h.ID(), p)
+func (h *BasicHost) dialPeer(ctx context.Context, p peer.ID) (network.Conn, error) {
+	h.log.Debugf("host %s dialing %s", h.ID(), p)
 	c, err := h.Network().DialPeer(ctx, p)
 	if err != nil {
-		return err
+		return nil, dialError(p, err)
 	}
 
 	// Clear protocols on connecting to new peer to avoid issues caused
-	// by misremembering protocols between reconnects
-	h.Peerstore().SetProtocols(p)
+	// by misremembering protocols between reconnects, unless identify will
+	// reuse them.
+	if !h.ids.Fresh(p) {
+		h.Peerstore().SetProtocols(p)
+	}
 
 	// identify the connection before returning.
 	done := make(chan struct{})
 	go func() {
 		h.ids.IdentifyConn(c)
+		h.identifiedConns.Store(c, struct{}{})
 		close(done)
 	}()
 
@@ -605,11 +2249,11 @@ func (h *BasicHost) dialPeer(ctx context.Context, p peer.ID) error {
 	select {
 	case <-done:
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
 	}
 
-	log.Debugf("host %s finished dialing %s", h.ID(), p)
-	return nil
+	h.log.Debugf("host %s finished dialing %s", h.ID(), p)
+	return c, nil
 }
 
 func (h *BasicHost) ConnManager() connmgr.ConnManager {
@@ -617,9 +2261,81 @@ func (h *BasicHost) ConnManager() connmgr.ConnManager {
 }
 
 // Addrs returns listening addresses that are safe to announce to the network.
-// The output is the same as AllAddrs, but processed by AddrsFactory.
+// The output is the same as AllAddrs, but processed by AddrsFactory, or
+// AddrsFactoryWithTTL if set, followed by the RelayAddrs, if set, and
+// filtered by the connection gater, if any.
 func (h *BasicHost) Addrs() []ma.Multiaddr {
-	return h.AddrsFactory(h.AllAddrs())
+	if h.addrsFactoryWithTTL != nil {
+		return h.gateAddrs(h.ID(), h.appendRelayAddrs(h.filterTransports(h.timedAddrs())))
+	}
+	return h.gateAddrs(h.ID(), h.appendRelayAddrs(h.filterTransports(h.addrsFactory()(h.blacklistAddrs(h.AllAddrs())))))
+}
+
+// appendRelayAddrs appends the addresses returned by the RelayAddrs option,
+// if set, to addrs.
+func (h *BasicHost) appendRelayAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if h.relayAddrs == nil {
+		return addrs
+	}
+	// don't append to the slice of the factory.
+	out := append(make([]ma.Multiaddr, 0, len(addrs)), addrs...)
+	for _, a := range h.relayAddrs() {
+		if !containsAddr(out, a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// AddrInfo returns the ID of the host along with the addresses returned by
+// Addrs.
+func (h *BasicHost) AddrInfo() peer.AddrInfo {
+	return peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}
+}
+
+// LocalInfo is what a host advertises about itself, see LocalPeerInfo.
+type LocalInfo struct {
+	ID        peer.ID
+	Addrs     []ma.Multiaddr
+	Protocols []protocol.ID
+}
+
+// LocalPeerInfo returns the ID, the addresses returned by Addrs and the
+// protocols we handle, e.g. to advertise the host in a DHT. The addresses and
+// protocols are read together: the stream handlers set or removed through the
+// host and the address change checks can't happen in between.
+func (h *BasicHost) LocalPeerInfo() LocalInfo {
+	h.muxRegsMx.Lock()
+	defer h.muxRegsMx.Unlock()
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	protos := h.Mux().Protocols()
+	info := LocalInfo{
+		ID:        h.ID(),
+		Addrs:     h.Addrs(),
+		Protocols: make([]protocol.ID, len(protos)),
+	}
+	for i, p := range protos {
+		info.Protocols[i] = protocol.ID(p)
+	}
+	return info
+}
+
+// P2PAddrs returns the addresses returned by Addrs, encapsulating the ID of
+// the host (/ip4/.../tcp/.../p2p/<id>), e.g. to share them out-of-band.
+func (h *BasicHost) P2PAddrs() ([]ma.Multiaddr, error) {
+	p2ppart, err := ma.NewComponent(ma.ProtocolWithCode(ma.P_P2P).Name, peer.IDB58Encode(h.ID()))
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := h.Addrs()
+	p2paddrs := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		p2paddrs = append(p2paddrs, a.Encapsulate(p2ppart))
+	}
+	return p2paddrs, nil
 }
 
 // mergeAddrs merges input address lists, leave only unique addresses
@@ -641,7 +2357,7 @@ func dedupAddrs(addrs []ma.Multiaddr) (uniqueAddrs []ma.Multiaddr) {
 func (h *BasicHost) AllAddrs() []ma.Multiaddr {
 	listenAddrs, err := h.Network().InterfaceListenAddresses()
 	if err != nil {
-		log.Debug("error retrieving network interface addrs")
+		h.log.Debugf("error retrieving network interface addrs")
 	}
 	var natMappings []inat.Mapping
 
@@ -693,7 +2409,7 @@ func (h *BasicHost) AllAddrs() []ma.Multiaddr {
 
 			naddr, err := manet.ToNetAddr(transport)
 			if err != nil {
-				log.Error("error parsing net multiaddr %q: %s", transport, err)
+				h.log.Errorf("error parsing net multiaddr %q: %s", transport, err)
 				continue
 			}
 
@@ -728,7 +2444,7 @@ func (h *BasicHost) AllAddrs() []ma.Multiaddr {
 
 			mappedMaddr, err := manet.FromNetAddr(mappedAddr)
 			if err != nil {
-				log.Errorf("mapped addr can't be turned into a multiaddr %q: %s", mappedAddr, err)
+				h.log.Errorf("mapped addr can't be turned into a multiaddr %q: %s", mappedAddr, err)
 				continue
 			}
 
@@ -795,6 +2511,163 @@ func (h *BasicHost) Close() error {
 	return h.proc.Close()
 }
 
+// GracefulClose shuts down the Host after letting in-flight streams finish.
+// It stops accepting new connections and streams, closes the write side of
+// all open streams, and waits for running stream handlers to return before
+// closing the Host. If ctx expires first, the Host is closed anyway and the
+// context error is returned.
+//
+// If ctx is nil, HostOpts.GracefulCloseTimeout bounds the wait.
+func (h *BasicHost) GracefulClose(ctx context.Context) error {
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), h.gracefulCloseTimeout)
+		defer cancel()
+	}
+
+	h.handlersMx.Lock()
+	h.draining = true
+	h.handlersMx.Unlock()
+
+	for _, s := range h.ActiveStreams() {
+		s.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.handlers.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if cerr := h.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Disconnect closes all the connections to p. It first stops keeping
+// connected to p (see KeepConnected) and closes the streams open with p,
+// waiting, until ctx is done, for them to be fully closed: the remote closed
+// them too and we read their remaining data, or they were reset. The
+// connections are closed in any case, and ctx.Err() is returned if the
+// streams didn't drain in time. It returns identify.ErrNotConnected if we
+// aren't connected to p.
+func (h *BasicHost) Disconnect(ctx context.Context, p peer.ID) error {
+	if h.Network().Connectedness(p) != network.Connected {
+		return identify.ErrNotConnected
+	}
+	h.StopKeepConnected(p)
+
+	closed := h.waitDrain(p)
+	defer h.stopWaitDrain(p, closed)
+
+	for _, c := range h.Network().ConnsToPeer(p) {
+		for _, s := range c.GetStreams() {
+			s.Close()
+		}
+	}
+
+	var err error
+	for h.hasStreams(p) {
+		select {
+		case <-closed:
+			continue
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		break
+	}
+
+	if cerr := h.Network().ClosePeer(p); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// waitDrain returns a channel signalled every time a stream with p closes,
+// until stopWaitDrain is called.
+func (h *BasicHost) waitDrain(p peer.ID) chan struct{} {
+	ch := make(chan struct{}, 1)
+	h.drainMx.Lock()
+	h.drainWaiters[p] = append(h.drainWaiters[p], ch)
+	h.drainMx.Unlock()
+	return ch
+}
+
+func (h *BasicHost) stopWaitDrain(p peer.ID, ch chan struct{}) {
+	h.drainMx.Lock()
+	defer h.drainMx.Unlock()
+	waiters := h.drainWaiters[p]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(h.drainWaiters, p)
+	} else {
+		h.drainWaiters[p] = waiters
+	}
+}
+
+// streamDrained signals the Disconnect calls waiting for the streams with p
+// to close.
+func (h *BasicHost) streamDrained(p peer.ID) {
+	h.drainMx.Lock()
+	defer h.drainMx.Unlock()
+	for _, ch := range h.drainWaiters[p] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (h *BasicHost) hasStreams(p peer.ID) bool {
+	for _, c := range h.Network().ConnsToPeer(p) {
+		if len(c.GetStreams()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveStreams returns a snapshot of the streams open on all the
+// connections of the host.
+func (h *BasicHost) ActiveStreams() []network.Stream {
+	var streams []network.Stream
+	for _, c := range h.Network().Conns() {
+		streams = append(streams, c.GetStreams()...)
+	}
+	return streams
+}
+
+// ActiveStreamsByProtocol returns a snapshot of the streams open on all the
+// connections of the host for the given protocol.
+func (h *BasicHost) ActiveStreamsByProtocol(pid protocol.ID) []network.Stream {
+	var streams []network.Stream
+	for _, s := range h.ActiveStreams() {
+		if s.Protocol() == pid {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+func (h *BasicHost) isDraining() bool {
+	h.handlersMx.Lock()
+	defer h.handlersMx.Unlock()
+	return h.draining
+}
+
 type streamWrapper struct {
 	network.Stream
 	rw io.ReadWriter
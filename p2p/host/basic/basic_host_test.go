@@ -3,24 +3,45 @@ package basichost
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"reflect"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+
 	"github.com/libp2p/go-eventbus"
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/event"
 	"github.com/libp2p/go-libp2p-core/helpers"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/mux"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-libp2p-core/test"
 
+	ggio "github.com/gogo/protobuf/io"
+	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	swarm "github.com/libp2p/go-libp2p-swarm"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 	ma "github.com/multiformats/go-multiaddr"
 	madns "github.com/multiformats/go-multiaddr-dns"
+	manet "github.com/multiformats/go-multiaddr-net"
+	msmux "github.com/multiformats/go-multistream"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestHostDoubleClose(t *testing.T) {
@@ -79,6 +100,44 @@ func TestHostSimple(t *testing.T) {
 	}
 }
 
+func TestHostConnectednessEvents(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	sub, err := h1.EventBus().Subscribe(&event.EvtPeerConnectednessChanged{}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	assert := func(exp network.Connectedness) {
+		t.Helper()
+		select {
+		case evt := <-sub.Out():
+			next := evt.(event.EvtPeerConnectednessChanged)
+			if next.Peer != h2.ID() || next.Connectedness != exp {
+				t.Fatalf("expected %s to be %d; received: %+v", h2.ID(), exp, next)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not received in 5 seconds")
+		}
+	}
+
+	h2pi := h2.Peerstore().PeerInfo(h2.ID())
+	if err := h1.Connect(ctx, h2pi); err != nil {
+		t.Fatal(err)
+	}
+	assert(network.Connected)
+
+	if err := h1.Network().ClosePeer(h2.ID()); err != nil {
+		t.Fatal(err)
+	}
+	assert(network.NotConnected)
+}
+
 func TestProtocolHandlerEvents(t *testing.T) {
 	ctx := context.Background()
 	h := New(swarmt.GenSwarm(t, ctx))
@@ -135,6 +194,136 @@ func TestHostAddrsFactory(t *testing.T) {
 	}
 }
 
+func TestHostAppendAddrsFactory(t *testing.T) {
+	maddr1 := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	maddr2 := ma.StringCast("/ip4/2.3.4.5/tcp/1234")
+	first := func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		return []ma.Multiaddr{maddr1}
+	}
+	// overlays only append their own address to whatever they're given
+	overlay := func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		return append(addrs, maddr2)
+	}
+
+	ctx := context.Background()
+	h := New(swarmt.GenSwarm(t, ctx), AddrsFactory(first), AppendAddrsFactory(overlay), AppendAddrsFactory(overlay))
+	defer h.Close()
+
+	addrs := h.Addrs()
+	if len(addrs) != 2 || !addrs[0].Equal(maddr1) || !addrs[1].Equal(maddr2) {
+		t.Fatalf("expected [%s %s], got %s", maddr1, maddr2, addrs)
+	}
+}
+
+func TestHostAddrInfo(t *testing.T) {
+	maddr := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	addrsFactory := func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		return []ma.Multiaddr{maddr}
+	}
+
+	ctx := context.Background()
+	h := New(swarmt.GenSwarm(t, ctx), AddrsFactory(addrsFactory))
+	defer h.Close()
+
+	pi := h.AddrInfo()
+	if pi.ID != h.ID() || len(pi.Addrs) != 1 || !pi.Addrs[0].Equal(maddr) {
+		t.Fatalf("unexpected addr info: %s", pi)
+	}
+
+	addrs, err := h.P2PAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ma.StringCast("/ip4/1.2.3.4/tcp/1234/p2p/" + h.ID().Pretty())
+	if len(addrs) != 1 || !addrs[0].Equal(expected) {
+		t.Fatalf("expected [%s], got %s", expected, addrs)
+	}
+
+	pi2, err := peer.AddrInfoFromP2pAddr(addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi2.ID != h.ID() || !pi2.Addrs[0].Equal(maddr) {
+		t.Fatalf("unexpected addr info: %s", pi2)
+	}
+}
+
+func TestHostAddressBlacklist(t *testing.T) {
+	public := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	var factoryInput []ma.Multiaddr
+	addrsFactory := func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		factoryInput = addrs
+		return append(addrs, public)
+	}
+
+	ctx := context.Background()
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		AddrsFactory:     addrsFactory,
+		AddressBlacklist: []AddressFilter{FilterLoopback},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// the swarm only listens on loopback addresses.
+	addrs := h.Addrs()
+	if len(factoryInput) != 0 {
+		t.Fatalf("expected the loopback addresses to be filtered, got %s", factoryInput)
+	}
+	if len(addrs) != 1 || !addrs[0].Equal(public) {
+		t.Fatalf("expected [%s], got %s", public, addrs)
+	}
+
+	for _, tc := range []struct {
+		addr                         string
+		loopback, private, linkLocal bool
+	}{
+		{"/ip4/127.0.0.1/tcp/1", true, true, false},
+		{"/ip6/::1/tcp/1", true, true, false},
+		{"/ip4/192.168.1.1/tcp/1", false, true, false},
+		{"/ip4/169.254.1.1/tcp/1", false, true, true},
+		{"/ip6/fe80::1/tcp/1", false, true, true},
+		{"/ip4/1.2.3.4/tcp/1", false, false, false},
+		{"/dns4/example.com/tcp/1", false, false, false},
+	} {
+		a := ma.StringCast(tc.addr)
+		if FilterLoopback(a) != tc.loopback || FilterPrivateNet(a) != tc.private || FilterLinkLocal(a) != tc.linkLocal {
+			t.Errorf("%s: expected loopback %t, private %t, link-local %t", a, tc.loopback, tc.private, tc.linkLocal)
+		}
+	}
+}
+
+func TestHostTransportFilter(t *testing.T) {
+	tcpAddr := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	wsAddr := ma.StringCast("/ip4/1.2.3.4/tcp/1235/ws")
+	quicAddr := ma.StringCast("/ip4/1.2.3.4/udp/1234/quic")
+	addrsFactory := func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		return []ma.Multiaddr{tcpAddr, quicAddr, wsAddr}
+	}
+
+	ctx := context.Background()
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		AddrsFactory:    addrsFactory,
+		TransportFilter: []string{"quic"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	addrs := h.Addrs()
+	if len(addrs) != 1 || !addrs[0].Equal(quicAddr) {
+		t.Fatalf("expected [%s], got %s", quicAddr, addrs)
+	}
+
+	if _, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		TransportFilter: []string{"carrier-pigeon"},
+	}); err == nil {
+		t.Fatal("expected an error for an unknown transport")
+	}
+}
+
 func getHostPair(ctx context.Context, t *testing.T) (host.Host, host.Host) {
 	t.Helper()
 
@@ -249,6 +438,86 @@ func TestHostProtoMismatch(t *testing.T) {
 	}
 }
 
+func TestHostProtoMismatchEvent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, h2 := getHostPair(ctx, t)
+	defer h1.Close()
+	defer h2.Close()
+
+	sub, err := h1.EventBus().Subscribe(new(EvtStreamNegotiationFailed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	offered := []protocol.ID{"/foo", "/bar", "/baz/1.0.0"}
+	if _, err := h2.NewStream(ctx, h1.ID(), offered...); err == nil {
+		t.Fatal("expected new stream to fail")
+	}
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(EvtStreamNegotiationFailed)
+		if evt.RemotePeer != h2.ID() {
+			t.Fatalf("expected an event for %s, got %s", h2.ID(), evt.RemotePeer)
+		}
+		if !reflect.DeepEqual(evt.Offered, offered) {
+			t.Fatalf("expected %s to be offered, got %s", offered, evt.Offered)
+		}
+		if evt.Err == nil {
+			t.Fatal("expected the negotiation error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a negotiation failure event")
+	}
+}
+
+func TestHostProtoNegotiationTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		NegotiationTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	// never answer protocol negotiation
+	h1.Network().SetStreamHandler(func(s network.Stream) {
+		<-ctx.Done()
+		s.Reset()
+	})
+
+	start := time.Now()
+	if _, err := h2.NewStream(ctx, h1.ID(), "/foo", "/bar"); err == nil {
+		t.Fatal("expected negotiation to time out")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("negotiation took %s", took)
+	}
+
+	// a shorter context deadline takes precedence
+	h2.negtimeout = time.Minute
+	tctx, tcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer tcancel()
+	if _, err := h2.NewStream(tctx, h1.ID(), "/foo", "/bar"); err == nil {
+		t.Fatal("expected negotiation to time out")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("negotiation took %s", took)
+	}
+}
+
 func TestHostProtoPreknowledge(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -438,6 +707,39 @@ func TestAddrResolution(t *testing.T) {
 	}
 }
 
+func TestHostResolveAddrs(t *testing.T) {
+	ctx := context.Background()
+
+	p1 := test.RandPeerIDFatal(t)
+	p2 := test.RandPeerIDFatal(t)
+	resolved := ma.StringCast("/ip4/192.0.2.1/tcp/123")
+	plain := ma.StringCast("/ip4/192.0.2.2/tcp/456")
+
+	backend := &madns.MockBackend{
+		TXT: map[string][]string{"_dnsaddr.example.com": []string{
+			"dnsaddr=" + resolved.String() + "/p2p/" + p1.Pretty(),
+			"dnsaddr=/ip4/192.0.2.3/tcp/789/p2p/" + p2.Pretty(),
+		}},
+	}
+	h := New(swarmt.GenSwarm(t, ctx), &madns.Resolver{Backend: backend})
+	defer h.Close()
+
+	pi := peer.AddrInfo{ID: p1, Addrs: []ma.Multiaddr{ma.StringCast("/dnsaddr/example.com"), plain}}
+	res, err := h.ResolveAddrs(ctx, pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != p1 {
+		t.Fatalf("expected the peer ID to be kept, got %s", res.ID)
+	}
+	if len(res.Addrs) != 2 || !containsAddr(res.Addrs, resolved) || !containsAddr(res.Addrs, plain) {
+		t.Fatalf("expected [%s %s], got %s", resolved, plain, res.Addrs)
+	}
+	if known := h.Peerstore().Addrs(p1); len(known) != 0 {
+		t.Fatalf("expected the peerstore to be left untouched, got %s", known)
+	}
+}
+
 func TestAddrResolutionRecursive(t *testing.T) {
 	ctx := context.Background()
 
@@ -507,6 +809,134 @@ func TestAddrResolutionRecursive(t *testing.T) {
 	}
 }
 
+func TestAddrResolutionMaxDepth(t *testing.T) {
+	ctx := context.Background()
+
+	p, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a.example.com -> b.example.com -> c.example.com -> ip4
+	backend := &madns.MockBackend{
+		TXT: map[string][]string{
+			"_dnsaddr.a.example.com": []string{
+				"dnsaddr=/dnsaddr/b.example.com/p2p/" + p.Pretty(),
+			},
+			"_dnsaddr.b.example.com": []string{
+				"dnsaddr=/dnsaddr/c.example.com/p2p/" + p.Pretty(),
+			},
+			"_dnsaddr.c.example.com": []string{
+				"dnsaddr=/ip4/192.0.2.1/tcp/123/p2p/" + p.Pretty(),
+			},
+		},
+	}
+	resolver := &madns.Resolver{Backend: backend}
+	pi := peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{ma.StringCast("/dnsaddr/a.example.com")}}
+
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		MultiaddrResolver:      resolver,
+		MaxAddrResolutionDepth: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if err := h.Connect(ctx, pi); err != ErrMaxAddrResolutionDepth {
+		t.Fatalf("expected %s, got %v", ErrMaxAddrResolutionDepth, err)
+	}
+
+	h2, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		MultiaddrResolver:      resolver,
+		MaxAddrResolutionDepth: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+
+	addrs, err := h2.resolveAddrs(ctx, pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || !addrs[0].Equal(ma.StringCast("/ip4/192.0.2.1/tcp/123")) {
+		t.Fatalf("expected [/ip4/192.0.2.1/tcp/123], got %s", addrs)
+	}
+}
+
+// flakyBackend fails the first failures TXT lookups.
+type flakyBackend struct {
+	*madns.MockBackend
+
+	mx       sync.Mutex
+	failures int
+}
+
+func (b *flakyBackend) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.failures > 0 {
+		b.failures--
+		return nil, errors.New("temporary failure")
+	}
+	return b.MockBackend.LookupTXT(ctx, name)
+}
+
+func TestAddrResolutionRetry(t *testing.T) {
+	ctx := context.Background()
+
+	p1, err := test.RandPeerID()
+	if err != nil {
+		t.Error(err)
+	}
+	addr1 := ma.StringCast("/dnsaddr/example.com")
+	addr2 := ma.StringCast("/ip4/192.0.2.1/tcp/123")
+	p2paddr1 := ma.StringCast("/dnsaddr/example.com/p2p/" + p1.Pretty())
+	p2paddr2 := ma.StringCast("/ip4/192.0.2.1/tcp/123/p2p/" + p1.Pretty())
+
+	for _, retries := range []int{1, 2} {
+		backend := &flakyBackend{
+			MockBackend: &madns.MockBackend{
+				TXT: map[string][]string{"_dnsaddr.example.com": []string{
+					"dnsaddr=" + p2paddr2.String(),
+				}},
+			},
+			failures: 2,
+		}
+
+		h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+			MultiaddrResolver: &madns.Resolver{Backend: backend},
+			DNSRetries:        retries,
+			DNSRetryBackoff:   time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+
+		pi, err := peer.AddrInfoFromP2pAddr(p2paddr1)
+		if err != nil {
+			t.Error(err)
+		}
+
+		tctx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+		_ = h.Connect(tctx, *pi)
+		cancel()
+
+		addrs := h.Peerstore().Addrs(pi.ID)
+		sort.Sort(sortedMultiaddrs(addrs))
+
+		if retries < 2 {
+			if len(addrs) != 1 || !addrs[0].Equal(addr1) {
+				t.Fatalf("expected [%s], got %+v", addr1, addrs)
+			}
+		} else if len(addrs) != 2 || !addrs[0].Equal(addr1) || !addrs[1].Equal(addr2) {
+			t.Fatalf("expected [%s %s], got %+v", addr1, addr2, addrs)
+		}
+	}
+}
+
 type sortedMultiaddrs []ma.Multiaddr
 
 func (sma sortedMultiaddrs) Len() int      { return len(sma) }
@@ -514,3 +944,4721 @@ func (sma sortedMultiaddrs) Swap(i, j int) { sma[i], sma[j] = sma[j], sma[i] }
 func (sma sortedMultiaddrs) Less(i, j int) bool {
 	return bytes.Compare(sma[i].Bytes(), sma[j].Bytes()) == 1
 }
+
+func TestStreamMiddleware(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, h2 := getHostPair(ctx, t)
+	defer h1.Close()
+	defer h2.Close()
+
+	calls := make(chan string, 3)
+	trace := func(name string) StreamMiddleware {
+		return func(next network.StreamHandler) network.StreamHandler {
+			return func(s network.Stream) {
+				calls <- name
+				next(s)
+			}
+		}
+	}
+
+	bh := h1.(*BasicHost)
+	// middleware registered before the handler must still apply
+	bh.UseStreamMiddleware(protocol.TestingID, trace("outer"))
+	bh.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		defer s.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Error(err)
+		}
+		calls <- "handler"
+	})
+	bh.UseStreamMiddleware(protocol.TestingID, trace("inner"))
+
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, exp := range []string{"outer", "inner", "handler"} {
+		select {
+		case got := <-calls:
+			if got != exp {
+				t.Fatalf("expected %s, got %s", exp, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for stream")
+		}
+	}
+
+	bh.RemoveStreamHandler(protocol.TestingID)
+	bh.middlewareMx.RLock()
+	n := len(bh.middleware[protocol.TestingID])
+	bh.middlewareMx.RUnlock()
+	if n != 0 {
+		t.Fatalf("expected middleware to be cleared, found %d", n)
+	}
+}
+
+func TestHostGracefulClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, h2 := getHostPair(ctx, t)
+	defer h2.Close()
+
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		defer s.Close()
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		close(finished)
+	})
+
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for stream")
+	}
+
+	bh := h1.(*BasicHost)
+	if err := bh.GracefulClose(nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("expected handler to finish before the host closed")
+	}
+
+	// must remain safe to close again
+	if err := bh.GracefulClose(nil); err != nil {
+		t.Fatal(err)
+	}
+	bh.Close()
+}
+
+func TestHostGracefulCloseTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, h2 := getHostPair(ctx, t)
+	defer h2.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		defer s.Close()
+		close(started)
+		<-release
+	})
+
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for stream")
+	}
+
+	tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer tcancel()
+	if err := h1.(*BasicHost).GracefulClose(tctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestPerPeerStreamRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		PerPeerStreamRateLimit:  1,
+		PerPeerStreamRateWindow: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	sub, err := h1.EventBus().Subscribe(&EvtPeerRateLimitExceeded{}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		s.Close()
+	})
+
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	// identify may already have used up the single token, so try a few
+	// times; the peer must get throttled before we run out of attempts.
+	throttled := false
+	for i := 0; i < 3 && !throttled; i++ {
+		s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+		if err == nil {
+			_, err = s.Read(make([]byte, 1))
+		}
+		if err != nil && err != io.EOF {
+			throttled = true
+		}
+	}
+	if !throttled {
+		t.Fatal("expected streams to be rejected")
+	}
+
+	select {
+	case evt := <-sub.Out():
+		if p := evt.(EvtPeerRateLimitExceeded).Peer; p != h2.ID() {
+			t.Fatalf("expected throttled peer %s, got %s", h2.ID(), p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not received in 5 seconds")
+	}
+}
+
+func TestHostAddrChangePolling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr1 := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	addr2 := ma.StringCast("/ip4/2.3.4.5/tcp/1234")
+
+	var lk sync.Mutex
+	addrs := []ma.Multiaddr{addr1}
+	addrsFactory := func([]ma.Multiaddr) []ma.Multiaddr {
+		lk.Lock()
+		defer lk.Unlock()
+		return addrs
+	}
+
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		AddrsFactory:                 addrsFactory,
+		AddressChangePollingInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	sub, err := h.EventBus().Subscribe(&event.EvtLocalAddressesUpdated{}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	h.Start()
+
+	lk.Lock()
+	addrs = []ma.Multiaddr{addr2}
+	lk.Unlock()
+
+	// no manual CheckForAddressChanges call; the poller must notice.
+	select {
+	case e := <-sub.Out():
+		evt := e.(event.EvtLocalAddressesUpdated)
+		if !evt.Diffs {
+			t.Fatal("expected a diff")
+		}
+		if len(evt.Current) != 1 || !evt.Current[0].Address.Equal(addr2) || evt.Current[0].Action != event.Added {
+			t.Fatalf("unexpected current addrs: %+v", evt.Current)
+		}
+		if len(evt.Removed) != 1 || !evt.Removed[0].Address.Equal(addr1) || evt.Removed[0].Action != event.Removed {
+			t.Fatalf("unexpected removed addrs: %+v", evt.Removed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not received in 5 seconds")
+	}
+}
+
+func TestHostBandwidthByProtocol(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		BandwidthReportingInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	sub, err := h1.EventBus().Subscribe(&EvtBandwidthSnapshot{}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		defer s.Close()
+		io.Copy(s, s) // mirror everything
+	})
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := []byte("abcdefghijkl")
+	if _, err := s.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// meters are only updated periodically
+	for _, h := range []*BasicHost{h1, h2} {
+		var stats metrics.Stats
+		for i := 0; i < 50; i++ {
+			stats = h.BandwidthByProtocol()[protocol.TestingID]
+			if stats.TotalIn == int64(len(buf)) && stats.TotalOut == int64(len(buf)) {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if stats.TotalIn != int64(len(buf)) || stats.TotalOut != int64(len(buf)) {
+			t.Fatalf("expected %d bytes in and out, got %+v", len(buf), stats)
+		}
+	}
+
+	h1.Start()
+	select {
+	case e := <-sub.Out():
+		evt := e.(EvtBandwidthSnapshot)
+		if evt.Total.TotalIn != int64(len(buf)) || evt.ByProtocol[protocol.TestingID].TotalIn != int64(len(buf)) {
+			t.Fatalf("unexpected snapshot: %+v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not received in 5 seconds")
+	}
+}
+
+func TestStreamHandlerWithError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, h2 := getHostPair(ctx, t)
+	defer h1.Close()
+	defer h2.Close()
+
+	h1.(*BasicHost).SetStreamHandlerWithError(protocol.TestingID, func(s network.Stream) error {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return err
+		}
+		if string(buf) != "hello" {
+			return fmt.Errorf("bad request: %s", buf)
+		}
+		_, err := s.Write(buf)
+		s.Close()
+		return err
+	})
+	h2.(*BasicHost).EnableHandlerErrors(protocol.TestingID)
+
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("expected hello, got %s", buf)
+	}
+	s.Close()
+
+	s, err = h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte("howdy")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Read(buf)
+	herr, ok := err.(*StreamHandlerError)
+	if !ok {
+		t.Fatalf("expected a StreamHandlerError, got %v", err)
+	}
+	if herr.Message != "bad request: howdy" || herr.Protocol != protocol.TestingID {
+		t.Fatalf("unexpected error: %+v", herr)
+	}
+
+	// other protocols may send what looks like an error frame, here two
+	// empty varint-delimited messages.
+	h1.SetStreamHandler("/raw", func(s network.Stream) {
+		s.Write([]byte{0, 0})
+		s.Close()
+	})
+	s, err = h2.NewStream(ctx, h1.ID(), "/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(s)
+	if err != nil || !bytes.Equal(data, []byte{0, 0}) {
+		t.Fatalf("expected the data untouched, got %v, %v", data, err)
+	}
+}
+
+type testGater struct {
+	blockedPeer peer.ID
+	blockedAddr ma.Multiaddr
+	denyAccept  bool
+}
+
+func (g *testGater) InterceptPeerDial(p peer.ID) bool {
+	return p != g.blockedPeer
+}
+
+func (g *testGater) InterceptAddrDial(p peer.ID, a ma.Multiaddr) bool {
+	return !a.Equal(g.blockedAddr)
+}
+
+func (g *testGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return !g.denyAccept
+}
+
+func TestHostConnectionGater(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	allowed := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	blocked := ma.StringCast("/ip4/2.3.4.5/tcp/1234")
+
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h3 := New(swarmt.GenSwarm(t, ctx))
+	defer h3.Close()
+
+	gater := &testGater{blockedPeer: h3.ID(), blockedAddr: blocked}
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		ConnectionGater: gater,
+		AddrsFactory: func([]ma.Multiaddr) []ma.Multiaddr {
+			return []ma.Multiaddr{allowed, blocked}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+
+	if addrs := h1.Addrs(); len(addrs) != 1 || !addrs[0].Equal(allowed) {
+		t.Fatalf("expected [%s], got %s", allowed, addrs)
+	}
+
+	if err := h1.Connect(ctx, h3.Peerstore().PeerInfo(h3.ID())); err != ErrGaterDisallowedConnection {
+		t.Fatalf("expected %s, got %v", ErrGaterDisallowedConnection, err)
+	}
+
+	h2pi := h2.Peerstore().PeerInfo(h2.ID())
+	h2pi.Addrs = append(h2pi.Addrs, blocked)
+	if err := h1.Connect(ctx, h2pi); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range h1.Peerstore().Addrs(h2.ID()) {
+		if a.Equal(blocked) {
+			t.Fatal("blocked address should not have been added to the peerstore")
+		}
+	}
+	h1.Network().ClosePeer(h2.ID())
+
+	gater.denyAccept = true
+	if err := h3.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(h1.Network().ConnsToPeer(h3.ID())) > 0; i++ {
+		if i > 50 {
+			t.Fatal("inbound connection should have been closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestHostWaitForProtocol(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	h1.SetStreamHandler("/super", func(s network.Stream) { s.Close() })
+
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	tctx, tcancel := context.WithTimeout(ctx, 5*time.Second)
+	defer tcancel()
+	if err := h2.WaitForProtocol(tctx, h1.ID(), "/super"); err != nil {
+		t.Fatal(err)
+	}
+
+	// protocols registered after identify are learned through a push
+	h1.SetStreamHandler("/foo", func(s network.Stream) { s.Close() })
+	if err := h2.WaitForProtocol(tctx, h1.ID(), "/foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	sctx, scancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer scancel()
+	if err := h2.WaitForProtocol(sctx, h1.ID(), "/bar"); err != ErrProtocolNotSupported {
+		t.Fatalf("expected %s, got %v", ErrProtocolNotSupported, err)
+	}
+}
+
+func TestHostStreamHandlerMatchWithPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	h3 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+	defer h3.Close()
+
+	connectedOn := make(chan protocol.ID)
+	handler := func(s network.Stream) {
+		connectedOn <- s.Protocol()
+		s.Close()
+	}
+
+	h1.SetStreamHandlerMatchWithPeer("/whitelisted", func(p peer.ID, proto string) bool {
+		return p == h2.ID() && proto == "/whitelisted"
+	}, handler)
+	// regular handlers must keep working alongside peer-aware ones
+	h1.SetStreamHandler(protocol.TestingID, handler)
+
+	h1pi := h1.Peerstore().PeerInfo(h1.ID())
+	for _, h := range []host.Host{h2, h3} {
+		if err := h.Connect(ctx, h1pi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := h2.NewStream(ctx, h1.ID(), "/whitelisted", protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	assertWait(t, connectedOn, "/whitelisted")
+	s.Close()
+
+	s, err = h3.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	assertWait(t, connectedOn, protocol.TestingID)
+	s.Close()
+
+	// h3 may optimistically pick the advertised protocol, in which case the
+	// negotiation fails on first use.
+	s, err = h3.NewStream(ctx, h1.ID(), "/whitelisted")
+	if err == nil {
+		_, err = s.Read(make([]byte, 1))
+	}
+	if err == nil {
+		t.Fatal("expected negotiation to fail for a peer that isn't whitelisted")
+	}
+
+	// the protocol is refused during the negotiation, so h3 can fall back
+	// to another one.
+	rs, err := h3.Network().NewStream(ctx, h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected, err := msmux.SelectOneOf([]string{"/whitelisted", string(protocol.TestingID)}, rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selected != string(protocol.TestingID) {
+		t.Fatalf("expected h3 to fall back to %s, got %s", protocol.TestingID, selected)
+	}
+	rs.Write([]byte("hello"))
+	assertWait(t, connectedOn, protocol.TestingID)
+	rs.Reset()
+
+	// the match function is given the proposed protocol.
+	h1.SetStreamHandlerMatchWithPeer("/versioned/1.0.0", func(p peer.ID, proto string) bool {
+		return p == h2.ID() && strings.HasPrefix(proto, "/versioned/1.")
+	}, handler)
+	s, err = h2.NewStream(ctx, h1.ID(), "/versioned/1.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	assertWait(t, connectedOn, "/versioned/1.2.0")
+	s.Close()
+}
+
+func TestHostStreamEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	subs := make([]event.Subscription, 2)
+	for i, h := range []*BasicHost{h1, h2} {
+		sub, err := h.EventBus().Subscribe([]interface{}{
+			new(EvtStreamOpened),
+			new(EvtStreamClosed),
+		}, eventbus.BufSize(16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		subs[i] = sub
+	}
+
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		defer s.Close()
+		io.Copy(s, s) // mirror everything
+	})
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := []byte("abcdefghijkl")
+	if _, err := s.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// identify streams generate events too, skip them.
+	dirs := []network.Direction{network.DirInbound, network.DirOutbound}
+	for i, sub := range subs {
+		var (
+			opened *EvtStreamOpened
+			closed *EvtStreamClosed
+		)
+		for closed == nil {
+			select {
+			case evt := <-sub.Out():
+				switch evt := evt.(type) {
+				case EvtStreamOpened:
+					if evt.Stream.Protocol() == protocol.TestingID {
+						opened = &evt
+					}
+				case EvtStreamClosed:
+					if evt.Protocol == protocol.TestingID {
+						closed = &evt
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for stream events")
+			}
+		}
+		if opened == nil {
+			t.Fatal("expected stream opened event before stream closed event")
+		}
+		if opened.Direction != dirs[i] {
+			t.Fatalf("expected direction %d, got %d", dirs[i], opened.Direction)
+		}
+		if closed.Stream != opened.Stream {
+			t.Fatal("closed event for a different stream")
+		}
+		if closed.BytesRead != int64(len(buf)) || closed.BytesWritten != int64(len(buf)) {
+			t.Fatalf("expected %d bytes read and written, got %d and %d",
+				len(buf), closed.BytesRead, closed.BytesWritten)
+		}
+		if closed.Duration <= 0 {
+			t.Fatal("expected a positive stream duration")
+		}
+	}
+}
+
+func TestHostProtocols(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) { s.Close() })
+
+	for _, ttl := range []time.Duration{time.Hour, time.Nanosecond} {
+		h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{ProtocolCacheTTL: ttl})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h1.Close()
+
+		if err := h1.Connect(ctx, h2.Peerstore().PeerInfo(h2.ID())); err != nil {
+			t.Fatal(err)
+		}
+		if err := h1.WaitForProtocol(ctx, h2.ID(), protocol.TestingID); err != nil {
+			t.Fatal(err)
+		}
+
+		// wait for the identification to be recorded.
+		for i := 0; ; i++ {
+			h1.protoUpdatedMx.Lock()
+			_, ok := h1.protoUpdated[h2.ID()]
+			h1.protoUpdatedMx.Unlock()
+			if ok {
+				break
+			}
+			if i == 50 {
+				t.Fatal("identification wasn't recorded")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// forget the protocols, only stale data is refreshed by identify.
+		if err := h1.Peerstore().SetProtocols(h2.ID()); err != nil {
+			t.Fatal(err)
+		}
+		protos, err := h1.Protocols(h2.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, p := range protos {
+			if p == protocol.TestingID {
+				found = true
+			}
+		}
+		if stale := ttl < time.Second; found != stale {
+			t.Fatalf("ttl %s: expected protocol to be found: %t, got protocols %v", ttl, stale, protos)
+		}
+	}
+}
+
+func TestHostHasProtocol(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{ProtocolCacheTTL: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) { s.Close() })
+
+	if !h1.HasProtocol(h1.ID(), identify.ID) {
+		t.Fatal("expected the local host to support identify")
+	}
+	if h1.HasProtocol(h1.ID(), protocol.TestingID) {
+		t.Fatal("expected the local host not to support the testing protocol")
+	}
+
+	if err := h1.Connect(ctx, h2.Peerstore().PeerInfo(h2.ID())); err != nil {
+		t.Fatal(err)
+	}
+	if err := h1.WaitForProtocol(ctx, h2.ID(), protocol.TestingID); err != nil {
+		t.Fatal(err)
+	}
+	if !h1.HasProtocol(h2.ID(), protocol.TestingID) {
+		t.Fatal("expected h2 to support the testing protocol")
+	}
+
+	// forget the protocols, they're refreshed in the background.
+	if err := h1.Peerstore().SetProtocols(h2.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if h1.HasProtocolRemote(h2.ID(), protocol.TestingID) {
+		t.Fatal("expected the protocols of h2 not to be known yet")
+	}
+	for i := 0; !h1.HasProtocol(h2.ID(), protocol.TestingID); i++ {
+		if i == 100 {
+			t.Fatal("expected the protocols of h2 to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHostDialLimiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		MaxConcurrentDials:        2,
+		MaxConcurrentDialsPerPeer: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	dl := h.dialLimiter
+
+	p1, p2, p3 := peer.ID("p1"), peer.ID("p2"), peer.ID("p3")
+	for _, p := range []peer.ID{p1, p2} {
+		if err := dl.acquire(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// p1 is blocked by both limits, p3 by the global one only.
+	acquired := make(chan peer.ID, 2)
+	for _, p := range []peer.ID{p1, p3} {
+		go func(p peer.ID) {
+			if err := dl.acquire(ctx, p); err != nil {
+				t.Error(err)
+			}
+			acquired <- p
+		}(p)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// a waiter gives up when its context is done.
+	tctx, tcancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer tcancel()
+	if err := dl.acquire(tctx, p2); err != context.DeadlineExceeded {
+		t.Fatalf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	if stats := h.DialStats(); stats.Active != 2 || stats.Queued != 2 || stats.TotalQueued != 3 {
+		t.Fatalf("unexpected dial stats: %+v", stats)
+	}
+
+	// p3 doesn't wait for p1, which is still blocked by its peer limit.
+	dl.release(p2)
+	select {
+	case p := <-acquired:
+		if p != p3 {
+			t.Fatalf("expected %s to acquire a slot, got %s", p3, p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a slot")
+	}
+
+	dl.release(p3)
+	dl.release(p1)
+	select {
+	case p := <-acquired:
+		if p != p1 {
+			t.Fatalf("expected %s to acquire a slot, got %s", p1, p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a slot")
+	}
+	dl.release(p1)
+
+	stats := h.DialStats()
+	if stats.Active != 0 || stats.Queued != 0 {
+		t.Fatalf("unexpected dial stats: %+v", stats)
+	}
+	if stats.MaxWaitTime <= 0 || stats.TotalWaitTime < stats.MaxWaitTime {
+		t.Fatalf("unexpected wait times: %+v", stats)
+	}
+}
+
+func TestNewStreamTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h1.SetStreamHandler("/testing", func(s network.Stream) {
+		defer s.Close()
+		// answer after the timeout of the stream.
+		time.Sleep(100 * time.Millisecond)
+		io.Copy(s, s) // mirror everything
+	})
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	// forget what identify told us so that the protocol is negotiated.
+	if err := h2.Peerstore().SetProtocols(h1.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := h2.NewStreamTimeout(ctx, h1.ID(), 50*time.Millisecond, "/testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a peer that never answers.
+	p, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2.Peerstore().AddAddr(p, ma.StringCast("/ip4/192.0.2.1/tcp/1234"), peerstore.TempAddrTTL)
+	start := time.Now()
+	if _, err := h2.NewStreamTimeout(ctx, p, 50*time.Millisecond, "/testing"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected NewStreamTimeout to time out, took %s", d)
+	}
+}
+
+func TestNewStreamWithFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h1.SetStreamHandler("/testing/1.0.0", func(s network.Stream) {
+		defer s.Close()
+		io.Copy(s, s) // mirror everything
+	})
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	// forget what identify told us so that the protocols are negotiated.
+	if err := h2.Peerstore().SetProtocols(h1.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	s, selected, err := h2.NewStreamWithFallback(ctx, h1.ID(), "/testing/2.0.0", "/testing/1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if selected != "/testing/1.0.0" {
+		t.Fatalf("expected to fall back to /testing/1.0.0, got %s", selected)
+	}
+	if _, err := s.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	protos, err := h2.Peerstore().SupportsProtocols(h1.ID(), "/testing/2.0.0", "/testing/1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(protos) != 1 || protos[0] != "/testing/1.0.0" {
+		t.Fatalf("expected only the fallback protocol to be recorded, got %v", protos)
+	}
+
+	// there's nothing to fall back to.
+	if _, _, err := h2.NewStreamWithFallback(ctx, h1.ID(), "/testing/3.0.0"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHostProtocolFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	isPublic := func(proto protocol.ID) bool {
+		return !strings.HasPrefix(string(proto), "/internal/")
+	}
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{ProtocolFilter: isPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	handler := func(s network.Stream) {
+		defer s.Close()
+		io.Copy(s, s) // mirror everything
+	}
+	h1.SetStreamHandler("/internal/1.0.0", handler)
+	h1.SetStreamHandler("/public/1.0.0", handler)
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+	if err := h2.WaitForProtocol(ctx, h1.ID(), "/public/1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// protocols added later are filtered too.
+	h1.SetStreamHandler("/internal/2.0.0", handler)
+	h1.SetStreamHandler("/public/2.0.0", handler)
+	if err := h2.WaitForProtocol(ctx, h1.ID(), "/public/2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	protos, err := h2.Peerstore().GetProtocols(h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, proto := range protos {
+		if !isPublic(protocol.ID(proto)) {
+			t.Fatalf("protocol %s was advertised", proto)
+		}
+	}
+
+	// filtered protocols are still handled.
+	s, err := h2.NewStream(ctx, h1.ID(), "/internal/1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostOpenProtocol(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		defer s.Close()
+		io.Copy(s, s) // mirror everything
+	})
+
+	pi := h1.Peerstore().PeerInfo(h1.ID())
+	for i := 0; i < 2; i++ {
+		s, err := h2.OpenProtocol(ctx, pi, protocol.TestingID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write([]byte("abc")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		// the connection is reused.
+		if conns := h2.Network().ConnsToPeer(h1.ID()); len(conns) != 1 {
+			t.Fatalf("expected 1 connection, got %d", len(conns))
+		}
+	}
+
+	if _, err := h2.OpenProtocol(ctx, pi, "/unknown/1.0.0"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHostDefaultStreamHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h1.SetDefaultStreamHandler(func(s network.Stream) {
+		defer s.Close()
+		// accept any protocol.
+		proto, err := msmux.ReadNextToken(s)
+		if err != nil {
+			t.Error(err)
+			s.Reset()
+			return
+		}
+		if err := delimWrite(s, []byte(proto)); err != nil {
+			t.Error(err)
+			s.Reset()
+			return
+		}
+		io.Copy(s, s) // mirror everything
+	})
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := h2.NewStream(ctx, h1.ID(), "/custom/1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Protocol() != "/custom/1.0.0" {
+		t.Fatalf("expected protocol /custom/1.0.0, got %s", s.Protocol())
+	}
+	if _, err := s.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// ls is still answered with the protocols of the muxer.
+	rs, err := h2.Network().NewStream(ctx, h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	protos, err := msmux.Ls(rs)
+	rs.Reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, proto := range protos {
+		if proto == identify.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected %s in %v", identify.ID, protos)
+	}
+
+	h1.RemoveDefaultStreamHandler()
+	if _, err := h2.NewStream(ctx, h1.ID(), "/custom/2.0.0"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHostAddrsFactoryWithTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		lk    sync.Mutex
+		calls int
+	)
+	addrsFactory := func([]ma.Multiaddr) []TimedAddr {
+		lk.Lock()
+		defer lk.Unlock()
+		calls++
+		return []TimedAddr{
+			{Addr: ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/tcp/%d", calls)), TTL: 200 * time.Millisecond},
+			{Addr: ma.StringCast(fmt.Sprintf("/ip4/2.3.4.5/tcp/%d", calls)), TTL: 600 * time.Millisecond},
+		}
+	}
+
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{AddrsFactoryWithTTL: addrsFactory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	sub, err := h.EventBus().Subscribe(&event.EvtLocalAddressesUpdated{}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	h.Start()
+
+	addr11 := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	addr21 := ma.StringCast("/ip4/2.3.4.5/tcp/1")
+	if addrs := h.Addrs(); len(addrs) != 2 || !addrs[0].Equal(addr11) || !addrs[1].Equal(addr21) {
+		t.Fatalf("expected [%s %s], got %s", addr11, addr21, addrs)
+	}
+	if addrs := h.Peerstore().Addrs(h.ID()); !containsAddr(addrs, addr11) || !containsAddr(addrs, addr21) {
+		t.Fatalf("expected the addresses to be stored in the peerstore, got %s", addrs)
+	}
+
+	expectChange := func(added, removed []ma.Multiaddr) {
+		t.Helper()
+		h.CheckForAddressChanges()
+		select {
+		case e := <-sub.Out():
+			evt := e.(event.EvtLocalAddressesUpdated)
+			for _, a := range added {
+				found := false
+				for _, ua := range evt.Current {
+					if ua.Address.Equal(a) && ua.Action == event.Added {
+						found = true
+					}
+				}
+				if !found {
+					t.Fatalf("expected %s to be added, got %+v", a, evt.Current)
+				}
+			}
+			if len(evt.Removed) != len(removed) {
+				t.Fatalf("expected %s to be removed, got %+v", removed, evt.Removed)
+			}
+			for i, a := range removed {
+				if !evt.Removed[i].Address.Equal(a) {
+					t.Fatalf("expected %s to be removed, got %+v", removed, evt.Removed)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not received in 5 seconds")
+		}
+	}
+
+	// the first address expires.
+	time.Sleep(300 * time.Millisecond)
+	expectChange(nil, []ma.Multiaddr{addr11})
+
+	// all addresses expired, the factory is run again.
+	time.Sleep(400 * time.Millisecond)
+	expectChange([]ma.Multiaddr{
+		ma.StringCast("/ip4/1.2.3.4/tcp/2"),
+		ma.StringCast("/ip4/2.3.4.5/tcp/2"),
+	}, []ma.Multiaddr{addr21})
+}
+
+func TestHostProtocolUpdateDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		ProtocolUpdateDebounce: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	sub, err := h.EventBus().Subscribe(&event.EvtLocalProtocolsUpdated{}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	handler := func(s network.Stream) { s.Close() }
+	h.SetStreamHandler("/a", handler)
+	h.SetStreamHandler("/b", handler)
+	// /c is never advertised.
+	h.SetStreamHandler("/c", handler)
+	h.RemoveStreamHandler("/c")
+	h.RemoveStreamHandler("/d")
+	// every update delays the event.
+	time.Sleep(30 * time.Millisecond)
+	h.SetStreamHandler("/e", handler)
+	time.Sleep(30 * time.Millisecond)
+	h.SetStreamHandler("/f", handler)
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(event.EvtLocalProtocolsUpdated)
+		if !reflect.DeepEqual(evt.Added, []protocol.ID{"/a", "/b", "/e", "/f"}) {
+			t.Fatalf("expected [/a /b /e /f] to be added, got %s", evt.Added)
+		}
+		if !reflect.DeepEqual(evt.Removed, []protocol.ID{"/d"}) {
+			t.Fatalf("expected [/d] to be removed, got %s", evt.Removed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not received in 5 seconds")
+	}
+
+	select {
+	case e := <-sub.Out():
+		t.Fatalf("unexpected event: %+v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestHostInboundStreamTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		NegotiationTimeout:   -1,
+		InboundStreamTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		defer s.Close()
+		// the read deadline was cleared.
+		time.Sleep(200 * time.Millisecond)
+		io.Copy(s, s) // mirror everything
+	})
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	// never send a protocol.
+	s, err := h2.Network().NewStream(ctx, h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := ioutil.ReadAll(s); err == nil {
+		t.Fatal("expected the stream to be reset")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("closing the stream took %s", took)
+	}
+
+	s, err = h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostConnectWithAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	known := ma.StringCast("/ip4/192.0.2.1/tcp/123")
+	h2.Peerstore().AddAddr(h1.ID(), known, peerstore.PermanentAddrTTL)
+
+	addrs := append([]ma.Multiaddr{known}, h1.Addrs()...)
+	if err := h2.ConnectWithAddrs(ctx, h1.ID(), addrs); err != nil {
+		t.Fatal(err)
+	}
+	if h2.Network().Connectedness(h1.ID()) != network.Connected {
+		t.Fatal("expected to be connected")
+	}
+
+	pstoreAddrs := h2.Peerstore().Addrs(h1.ID())
+	if !containsAddr(pstoreAddrs, known) {
+		t.Fatalf("expected %s to be kept, got %s", known, pstoreAddrs)
+	}
+	for _, a := range h1.Addrs() {
+		if containsAddr(pstoreAddrs, a) {
+			t.Fatalf("expected %s to be removed, got %s", a, pstoreAddrs)
+		}
+	}
+}
+
+func TestHostActiveStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	done := make(chan struct{})
+	handler := func(s network.Stream) {
+		<-done
+		s.Close()
+	}
+	h1.SetStreamHandler("/a", handler)
+	h1.SetStreamHandler("/b", handler)
+	defer close(done)
+
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+	for _, pid := range []protocol.ID{"/a", "/a", "/b"} {
+		s, err := h2.NewStream(ctx, h1.ID(), pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		// trigger the lazy negotiation
+		if _, err := s.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// wait for the inbound streams to be negotiated.
+	for i := 0; len(h1.ActiveStreamsByProtocol("/a")) < 2 || len(h1.ActiveStreamsByProtocol("/b")) < 1; i++ {
+		if i == 100 {
+			t.Fatal("timed out waiting for the streams")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, h := range []*BasicHost{h1, h2} {
+		if n := len(h.ActiveStreamsByProtocol("/a")); n != 2 {
+			t.Fatalf("expected 2 /a streams, got %d", n)
+		}
+		if n := len(h.ActiveStreamsByProtocol("/b")); n != 1 {
+			t.Fatalf("expected 1 /b stream, got %d", n)
+		}
+		if n := len(h.ActiveStreams()); n < 3 {
+			t.Fatalf("expected at least 3 streams, got %d", n)
+		}
+	}
+}
+
+func TestHostReplaceStreamHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	handler := func(msg string) network.StreamHandler {
+		return func(s network.Stream) {
+			defer s.Close()
+			buf := make([]byte, 1)
+			if _, err := io.ReadFull(s, buf); err != nil {
+				s.Reset()
+				return
+			}
+			s.Write([]byte(msg))
+		}
+	}
+	h1.SetStreamHandler(protocol.TestingID, handler("a"))
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			h1.ReplaceStreamHandler(protocol.TestingID, handler([]string{"a", "b"}[i%2]))
+			runtime.Gosched()
+		}
+	}()
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatalf("stream %d failed: %s", i, err)
+		}
+		seen[string(buf)] = true
+		s.Close()
+	}
+	close(stop)
+	<-swapped
+
+	if !seen["a"] || !seen["b"] {
+		t.Fatalf("expected both handlers to be used, got %v", seen)
+	}
+}
+
+type recordingLogger struct {
+	mx   sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) record(format string, args ...interface{}) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) { l.record(format, args...) }
+func (l *recordingLogger) Infof(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Warnf(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...interface{}) { l.record(format, args...) }
+
+func (l *recordingLogger) logged(substr string) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	for _, msg := range l.msgs {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHostLogger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := new(recordingLogger)
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	// send garbage instead of negotiating a protocol.
+	s, err := h2.Network().NewStream(ctx, h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("garbage\n")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	for _, substr := range []string{"protocol mux failed", string(identify.ID)} {
+		for i := 0; !logger.logged(substr); i++ {
+			if i == 100 {
+				t.Fatalf("expected %q to be logged", substr)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestHostIdentifyPush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		lk    sync.Mutex
+		extra []ma.Multiaddr
+	)
+	addrsFactory := func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		lk.Lock()
+		defer lk.Unlock()
+		return append(addrs, extra...)
+	}
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{AddrsFactory: addrsFactory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h3 := New(swarmt.GenSwarm(t, ctx))
+	defer h3.Close()
+
+	if err := h1.IdentifyPush(ctx, h2.ID()); err != identify.ErrNotConnected {
+		t.Fatalf("expected %s, got %v", identify.ErrNotConnected, err)
+	}
+	if err := h1.IdentifyPushAll(ctx); err != identify.ErrNotConnected {
+		t.Fatalf("expected %s, got %v", identify.ErrNotConnected, err)
+	}
+
+	for _, h := range []*BasicHost{h2, h3} {
+		if err := h1.Connect(ctx, h.Peerstore().PeerInfo(h.ID())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForAddr := func(h *BasicHost, a ma.Multiaddr) {
+		t.Helper()
+		for i := 0; !containsAddr(h.Peerstore().Addrs(h1.ID()), a); i++ {
+			if i == 100 {
+				t.Fatalf("%s wasn't pushed", a)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	addr1 := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	lk.Lock()
+	extra = []ma.Multiaddr{addr1}
+	lk.Unlock()
+	if err := h1.IdentifyPush(ctx, h2.ID()); err != nil {
+		t.Fatal(err)
+	}
+	waitForAddr(h2, addr1)
+
+	addr2 := ma.StringCast("/ip4/1.2.3.4/tcp/4321")
+	lk.Lock()
+	extra = []ma.Multiaddr{addr2}
+	lk.Unlock()
+	if err := h1.IdentifyPushAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForAddr(h2, addr2)
+	waitForAddr(h3, addr2)
+}
+
+func TestHostStreamTags(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		defer s.Close()
+		io.Copy(s, s) // mirror everything
+	})
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := h2.StreamTagValue(s, "foo"); ok {
+		t.Fatal("expected the stream not to be tagged")
+	}
+	h2.TagStream(s, "foo", 1)
+	h2.TagStream(s, "bar", 2)
+	h2.TagStream(s, "foo", 3)
+	if v, ok := h2.StreamTagValue(s, "foo"); !ok || v != 3 {
+		t.Fatalf("expected tag value 3, got %d (%t)", v, ok)
+	}
+	h2.UntagStream(s, "foo")
+	if _, ok := h2.StreamTagValue(s, "foo"); ok {
+		t.Fatal("expected the tag to be removed")
+	}
+	if v, ok := h2.StreamTagValue(s, "bar"); !ok || v != 2 {
+		t.Fatalf("expected tag value 2, got %d (%t)", v, ok)
+	}
+
+	// tags are removed once the stream is closed.
+	s.Reset()
+	for i := 0; ; i++ {
+		if _, ok := h2.StreamTagValue(s, "bar"); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected the tags to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHostNetworkNotifiee(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h3 := New(swarmt.GenSwarm(t, ctx))
+	defer h3.Close()
+
+	connected := make(chan peer.ID, 16)
+	n := &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			connected <- c.RemotePeer()
+		},
+	}
+	h1.RegisterNetworkNotifiee(n)
+
+	if err := h1.Connect(ctx, h2.Peerstore().PeerInfo(h2.ID())); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-connected:
+		if p != h2.ID() {
+			t.Fatalf("expected a connection to %s, got %s", h2.ID(), p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notifiee wasn't notified")
+	}
+
+	h1.UnregisterNetworkNotifiee(n)
+	if err := h1.Connect(ctx, h3.Peerstore().PeerInfo(h3.ID())); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-connected:
+		t.Fatalf("unexpected notification for %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHostConnectionMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	if err := h1.Connect(ctx, h2.Peerstore().PeerInfo(h2.ID())); err != nil {
+		t.Fatal(err)
+	}
+	c := h1.Network().ConnsToPeer(h2.ID())[0]
+
+	h1.ConnectionMetadata(c).Store("token", "secret")
+	if v, ok := h1.ConnectionMetadata(c).Load("token"); !ok || v != "secret" {
+		t.Fatalf("expected the token to be stored, got %v", v)
+	}
+
+	// the metadata is dropped once the connection is closed.
+	c.Close()
+	for i := 0; ; i++ {
+		if _, ok := h1.connMetadata.Load(c); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected the metadata to be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHostBroadcast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	received := make(chan peer.ID, 4)
+	var receivers []*BasicHost
+	for i := 0; i < 3; i++ {
+		r := New(swarmt.GenSwarm(t, ctx))
+		defer r.Close()
+		if i < 2 {
+			receivers = append(receivers, r)
+			id := r.ID()
+			r.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+				defer s.Close()
+				buf, err := ioutil.ReadAll(s)
+				if err != nil || string(buf) != "hello" {
+					t.Errorf("unexpected message %q: %v", buf, err)
+				}
+				received <- id
+			})
+		}
+		if err := h.Connect(ctx, r.Peerstore().PeerInfo(r.ID())); err != nil {
+			t.Fatal(err)
+		}
+		// forget what identify told us so that the protocol is negotiated.
+		h.Peerstore().SetProtocols(r.ID())
+	}
+
+	errs := h.Broadcast(ctx, protocol.TestingID, []byte("hello"))
+	if len(errs) != len(receivers) {
+		t.Fatalf("expected %d results, got %v", len(receivers), errs)
+	}
+	for _, r := range receivers {
+		if err, ok := errs[r.ID()]; !ok || err != nil {
+			t.Fatalf("expected the message to be sent to %s, got %v", r.ID(), err)
+		}
+	}
+
+	for range receivers {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not received in 5 seconds")
+		}
+	}
+}
+
+type healthCheckFunc func(context.Context) error
+
+func (f healthCheckFunc) Check(ctx context.Context) error { return f(ctx) }
+
+func TestHostHealthCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h1.RegisterHealthCheck("/health/ok", healthCheckFunc(func(context.Context) error { return nil }))
+	h1.RegisterHealthCheck("/health/ko", healthCheckFunc(func(context.Context) error { return errors.New("database down") }))
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h2.CheckPeerHealth(ctx, h1.ID(), "/health/ok"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := h2.CheckPeerHealth(ctx, h1.ID(), "/health/ko")
+	herr, ok := err.(*HealthCheckError)
+	if !ok {
+		t.Fatalf("expected a *HealthCheckError, got %v", err)
+	}
+	if herr.Peer != h1.ID() || herr.Message != "database down" {
+		t.Fatalf("unexpected error: %s", herr)
+	}
+}
+
+func TestHealthCheckResponseEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	resp := &healthCheckResponse{Status: healthNotServing, Error: "bad"}
+	if err := ggio.NewDelimitedWriter(&buf).WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{7, 0x08, 0x01, 0x12, 0x03, 'b', 'a', 'd'}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("expected %x, got %x", expected, buf.Bytes())
+	}
+}
+
+type upgraderFunc func(context.Context, network.Conn) error
+
+func (f upgraderFunc) Upgrade(ctx context.Context, c network.Conn) error { return f(ctx, c) }
+
+func TestHostConnectionUpgraders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		h1  *BasicHost
+		err error
+	)
+	calls := make(chan string, 2)
+	first := upgraderFunc(func(_ context.Context, c network.Conn) error {
+		// identify must have completed.
+		protos, err := h1.Peerstore().GetProtocols(c.RemotePeer())
+		if err != nil || len(protos) == 0 {
+			calls <- "not identified"
+			return nil
+		}
+		calls <- "first"
+		return nil
+	})
+	second := upgraderFunc(func(context.Context, network.Conn) error {
+		calls <- "second"
+		return nil
+	})
+
+	h1, err = NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		ConnectionUpgraders: []ConnectionUpgrader{first, second},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case call := <-calls:
+			if call != expected {
+				t.Fatalf("expected %s, got %s", expected, call)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the upgraders")
+		}
+	}
+	if h1.Network().Connectedness(h2.ID()) != network.Connected {
+		t.Fatal("expected the connection to be kept")
+	}
+
+	h3, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		ConnectionUpgraders: []ConnectionUpgrader{upgraderFunc(func(context.Context, network.Conn) error {
+			return errors.New("unsupported capabilities")
+		})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h3.Close()
+
+	if err := h2.Connect(ctx, h3.Peerstore().PeerInfo(h3.ID())); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; h3.Network().Connectedness(h2.ID()) == network.Connected; i++ {
+		if i > 100 {
+			t.Fatal("expected the connection to be closed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestHostKeepConnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h1.KeepConnected(ctx, h2.Peerstore().PeerInfo(h2.ID()), WithInitialBackoff(10*time.Millisecond))
+	}()
+
+	waitConnected := func() {
+		t.Helper()
+		for i := 0; h1.Network().Connectedness(h2.ID()) != network.Connected; i++ {
+			if i > 100 {
+				t.Fatal("expected h1 to be connected to h2")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	waitConnected()
+	if err := h2.Network().ClosePeer(h1.ID()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	waitConnected()
+
+	h1.StopKeepConnected(h2.ID())
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for KeepConnected to return")
+	}
+
+	// a peer we don't know any address of.
+	p, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h1.KeepConnected(ctx, peer.AddrInfo{ID: p},
+		WithInitialBackoff(time.Millisecond),
+		WithMaxBackoff(2*time.Millisecond),
+		WithMaxAttempts(3),
+	)
+	if err == nil {
+		t.Fatal("expected KeepConnected to give up")
+	}
+}
+
+func TestHostKeepConnectedFlapping(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	// h2 drops every connection right away.
+	var conns int32
+	h2.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			atomic.AddInt32(&conns, 1)
+			go c.Close()
+		},
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h1.KeepConnected(ctx, h2.Peerstore().PeerInfo(h2.ID()),
+			WithInitialBackoff(10*time.Millisecond),
+			WithMaxBackoff(time.Second),
+			WithMinUptime(time.Hour),
+		)
+	}()
+
+	// with the backoff growing, h1 only gets to dial a few times.
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&conns); n == 0 || n > 8 {
+		t.Fatalf("expected a few connections, got %d", n)
+	}
+
+	h1.StopKeepConnected(h2.ID())
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostProtocolTable(t *testing.T) {
+	ctx := context.Background()
+	h := New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	before := time.Now()
+	h.SetStreamHandlerWithDescription("/echo", "echoes everything", func(network.Stream) {})
+	h.SetStreamHandlerMatch("/match", func(string) bool { return false }, func(network.Stream) {})
+	h.SetStreamHandler("/removed", func(network.Stream) {})
+	h.RemoveStreamHandler("/removed")
+
+	table := h.ProtocolTable()
+	echo, ok := table["/echo"]
+	if !ok || echo.Description != "echoes everything" || echo.Match || echo.Registered.Before(before) {
+		t.Fatalf("unexpected entry for /echo: %+v", echo)
+	}
+	if match, ok := table["/match"]; !ok || !match.Match || match.Description != "" {
+		t.Fatalf("unexpected entry for /match: %+v", match)
+	}
+	if _, ok := table["/removed"]; ok {
+		t.Fatal("expected /removed not to be in the table")
+	}
+	if _, ok := table[identify.ID]; !ok {
+		t.Fatal("expected the identify protocol to be in the table")
+	}
+
+	b, err := json.Marshal(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[protocol.ID]ProtocolEntry
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["/echo"].Description != "echoes everything" || !decoded["/echo"].Registered.Equal(echo.Registered) {
+		t.Fatalf("unexpected decoded entry for /echo: %+v", decoded["/echo"])
+	}
+}
+
+func TestHostCloseStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h1.EnableCloseStream("/upload", "/download")
+	h2.EnableCloseStream("/upload", "/download")
+
+	inbound := make(chan error, 1)
+	h1.SetStreamHandler("/upload", func(s network.Stream) {
+		data, err := ioutil.ReadAll(s)
+		if string(data) != "hello" {
+			err = fmt.Errorf("unexpected data: %q", data)
+		}
+		inbound <- err
+	})
+	h1.SetStreamHandler("/download", func(s network.Stream) {
+		if _, err := s.Write([]byte("data")); err != nil {
+			s.Reset()
+			return
+		}
+		h1.CloseStream(s, 7, "quota exceeded")
+	})
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	// inbound: the handler sees the error.
+	s, err := h2.NewStream(ctx, h1.ID(), "/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h2.CloseStream(s, 42, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-inbound:
+		rerr, ok := err.(*StreamResetError)
+		if !ok || rerr.Code != 42 || rerr.Msg != "bye" {
+			t.Fatalf("expected a stream reset error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the handler")
+	}
+
+	// outbound: the opener sees the error.
+	s, err = h2.NewStream(ctx, h1.ID(), "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(s)
+	if string(data) != "data" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+	rerr, ok := err.(*StreamResetError)
+	if !ok || rerr.Code != 7 || rerr.Msg != "quota exceeded" {
+		t.Fatalf("expected a stream reset error, got %v", err)
+	}
+
+	// other protocols carry frames as plain data.
+	frame := encodeStreamReset(1, "not a reset")
+	h1.SetStreamHandler("/raw", func(s network.Stream) {
+		s.Write(frame)
+		s.Close()
+	})
+	s, err = h2.NewStream(ctx, h1.ID(), "/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h2.CloseStream(s, 1, "bye"); err != ErrCloseStreamNotEnabled {
+		t.Fatalf("expected ErrCloseStreamNotEnabled, got %v", err)
+	}
+	data, err = ioutil.ReadAll(s)
+	if err != nil || !bytes.Equal(data, frame) {
+		t.Fatalf("expected the frame as data, got %q, %v", data, err)
+	}
+}
+
+// chunkedStream returns its chunks from successive reads, then EOF.
+type chunkedStream struct {
+	network.Stream
+	chunks []string
+}
+
+func (s *chunkedStream) Read(b []byte) (int, error) {
+	if len(s.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, s.chunks[0])
+	if s.chunks[0] = s.chunks[0][n:]; s.chunks[0] == "" {
+		s.chunks = s.chunks[1:]
+	}
+	return n, nil
+}
+
+func (s *chunkedStream) Reset() error { return nil }
+
+func (s *chunkedStream) Protocol() protocol.ID { return protocol.TestingID }
+
+func TestStreamResetStreamSplitMarker(t *testing.T) {
+	frame := string(encodeStreamReset(3, "split"))
+	s := &streamResetStream{Stream: &chunkedStream{chunks: []string{"da", "ta" + frame[:5], frame[5:]}}}
+	data, err := ioutil.ReadAll(s)
+	if string(data) != "data" {
+		t.Fatalf("expected the data before the frame only, got %q", data)
+	}
+	if rerr, ok := err.(*StreamResetError); !ok || rerr.Code != 3 || rerr.Msg != "split" {
+		t.Fatalf("expected a stream reset error, got %v", err)
+	}
+
+	// the start of a marker at the end of the stream is data.
+	s = &streamResetStream{Stream: &chunkedStream{chunks: []string{"data\x00", "/libp2p"}}}
+	data, err = ioutil.ReadAll(s)
+	if err != nil || string(data) != "data\x00/libp2p" {
+		t.Fatalf("expected all the data, got %q, %v", data, err)
+	}
+}
+
+func TestHandlerErrorStreamSplitFrame(t *testing.T) {
+	frame := string(encodeHandlerError(errors.New("split")))
+	s := &handlerErrorStream{Stream: &chunkedStream{chunks: []string{frame[:2], frame[2:]}}}
+	_, err := ioutil.ReadAll(s)
+	if herr, ok := err.(*StreamHandlerError); !ok || herr.Message != "split" {
+		t.Fatalf("expected a handler error, got %v", err)
+	}
+
+	// what only starts like a frame is data.
+	s = &handlerErrorStream{Stream: &chunkedStream{chunks: []string{"\x00", "\x05ab"}}}
+	data, err := ioutil.ReadAll(s)
+	if err != nil || string(data) != "\x00\x05ab" {
+		t.Fatalf("expected all the data, got %q, %v", data, err)
+	}
+	s = &handlerErrorStream{Stream: &chunkedStream{chunks: []string{"data"}}}
+	data, err = ioutil.ReadAll(s)
+	if err != nil || string(data) != "data" {
+		t.Fatalf("expected all the data, got %q, %v", data, err)
+	}
+}
+
+func TestHostPrometheusMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reg := prometheus.NewRegistry()
+	// both hosts register their metrics on the same registry.
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{PrometheusRegisterer: reg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{PrometheusRegisterer: reg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+
+	h1.SetStreamHandler("/testing", func(s network.Stream) { s.Close() })
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+	s, err := h2.NewStream(ctx, h1.ID(), "/testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, mf := range mfs {
+		found[mf.GetName()] = true
+		if mf.GetName() != "libp2p_host_streams_opened_total" {
+			continue
+		}
+		var outbound float64
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["protocol"] == "/testing" && labels["direction"] == "outbound" {
+				outbound = m.GetCounter().GetValue()
+			}
+		}
+		if outbound != 1 {
+			t.Fatalf("expected 1 outbound /testing stream, got %f", outbound)
+		}
+	}
+	for _, name := range []string{
+		"libp2p_host_streams_opened_total",
+		"libp2p_host_connections_active",
+		"libp2p_host_identify_duration_seconds",
+	} {
+		if !found[name] {
+			t.Fatalf("expected metric %s to be registered", name)
+		}
+	}
+}
+
+func TestHostStreamHandlerPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	matchAll := func(string) bool { return true }
+	handler := func(name string) network.StreamHandler {
+		return func(s network.Stream) {
+			s.Write([]byte(name))
+			s.Close()
+		}
+	}
+	h1.SetStreamHandlerMatch("/echo/a", matchAll, handler("a"))
+	h1.SetStreamHandlerMatch("/echo/b", matchAll, handler("b"))
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	handledBy := func() string {
+		t.Helper()
+		s, err := h2.NewStream(ctx, h1.ID(), "/echo/1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		b, err := ioutil.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if name := handledBy(); name != "a" {
+		t.Fatalf("expected the first handler to be selected, got %s", name)
+	}
+
+	h1.SetStreamHandlerPriority("/echo/b", 10)
+	if name := handledBy(); name != "b" {
+		t.Fatalf("expected the prioritized handler to be selected, got %s", name)
+	}
+
+	protos := h1.Mux().Protocols()
+	ia, ib := -1, -1
+	for i, p := range protos {
+		switch p {
+		case "/echo/a":
+			ia = i
+		case "/echo/b":
+			ib = i
+		}
+	}
+	if ia < 0 || ib < 0 || ib > ia {
+		t.Fatalf("expected /echo/b to be listed before /echo/a: %v", protos)
+	}
+}
+
+type countingResourceManager struct {
+	mx            sync.Mutex
+	streams       int
+	conns         int
+	rejectStreams bool
+}
+
+func (rm *countingResourceManager) OpenStream(network.Stream) error {
+	rm.mx.Lock()
+	defer rm.mx.Unlock()
+	if rm.rejectStreams {
+		return errors.New("too many streams")
+	}
+	rm.streams++
+	return nil
+}
+
+func (rm *countingResourceManager) CloseStream(network.Stream) {
+	rm.mx.Lock()
+	defer rm.mx.Unlock()
+	rm.streams--
+}
+
+func (rm *countingResourceManager) OpenConn(network.Conn) error {
+	rm.mx.Lock()
+	defer rm.mx.Unlock()
+	rm.conns++
+	return nil
+}
+
+func (rm *countingResourceManager) CloseConn(network.Conn) {
+	rm.mx.Lock()
+	defer rm.mx.Unlock()
+	rm.conns--
+}
+
+func (rm *countingResourceManager) counts() (int, int) {
+	rm.mx.Lock()
+	defer rm.mx.Unlock()
+	return rm.streams, rm.conns
+}
+
+func TestHostResourceManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rm := &countingResourceManager{}
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{ResourceManager: rm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	waitCounts := func(streams, conns int) {
+		t.Helper()
+		for i := 0; ; i++ {
+			s, c := rm.counts()
+			if s == streams && c == conns {
+				return
+			}
+			if i > 100 {
+				t.Fatalf("expected %d streams and %d conns, got %d and %d", streams, conns, s, c)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	block := make(chan struct{})
+	h1.SetStreamHandler("/testing", func(s network.Stream) {
+		<-block
+		s.Close()
+		ioutil.ReadAll(s)
+	})
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+	// wait for identify to be done.
+	waitCounts(0, 1)
+
+	s, err := h2.NewStream(ctx, h1.ID(), "/testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hello"))
+	waitCounts(1, 1)
+	close(block)
+	s.Close()
+	waitCounts(0, 1)
+
+	rm.mx.Lock()
+	rm.rejectStreams = true
+	rm.mx.Unlock()
+
+	if _, err := h1.NewStream(ctx, h2.ID(), "/testing"); err == nil {
+		t.Fatal("expected the outbound stream to be rejected")
+	}
+	s, err = h2.NewStream(ctx, h1.ID(), "/testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hello"))
+	if _, err := s.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Fatalf("expected the inbound stream to be reset, got %v", err)
+	}
+
+	if err := h2.Network().ClosePeer(h1.ID()); err != nil {
+		t.Fatal(err)
+	}
+	waitCounts(0, 0)
+}
+
+func TestHostStreamHandlerWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	h1.SetStreamHandlerWithContext("/testing", func(ctx context.Context, s network.Stream) {
+		started <- struct{}{}
+		<-ctx.Done()
+		cancelled <- struct{}{}
+	})
+
+	waitCancelled := func(reason string) {
+		t.Helper()
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the context to be cancelled when %s", reason)
+		}
+	}
+
+	openStream := func() {
+		t.Helper()
+		if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+			t.Fatal(err)
+		}
+		s, err := h2.NewStream(ctx, h1.ID(), "/testing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the handler to start")
+		}
+	}
+
+	openStream()
+	if err := h2.Network().ClosePeer(h1.ID()); err != nil {
+		t.Fatal(err)
+	}
+	waitCancelled("the connection closes")
+
+	openStream()
+	h1.Close()
+	waitCancelled("the host closes")
+}
+
+func TestHostPeerConnectedEvent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	sub, err := h1.EventBus().Subscribe(&EvtPeerConnected{}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	start := time.Now()
+	if err := h1.Connect(ctx, h2.Peerstore().PeerInfo(h2.ID())); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	// already connected: no dial, no event.
+	if err := h1.Connect(ctx, h2.Peerstore().PeerInfo(h2.ID())); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(EvtPeerConnected)
+		if evt.Peer != h2.ID() || evt.Conn == nil || evt.Conn.RemotePeer() != h2.ID() {
+			t.Fatalf("unexpected event: %+v", evt)
+		}
+		if evt.Latency <= 0 || evt.Latency > elapsed {
+			t.Fatalf("expected a latency between 0 and %s, got %s", elapsed, evt.Latency)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the event")
+	}
+
+	select {
+	case e := <-sub.Out():
+		t.Fatalf("unexpected event: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHostPingPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{EnablePing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+	h3 := New(swarmt.GenSwarm(t, ctx))
+	defer h3.Close()
+
+	if err := h1.Connect(ctx, h2.Peerstore().PeerInfo(h2.ID())); err != nil {
+		t.Fatal(err)
+	}
+	rtt, err := h1.PingPeer(ctx, h2.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("expected a positive RTT, got %s", rtt)
+	}
+	if h1.Peerstore().LatencyEWMA(h2.ID()) == 0 {
+		t.Fatal("expected the RTT to be recorded")
+	}
+
+	if err := h1.Connect(ctx, h3.Peerstore().PeerInfo(h3.ID())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h1.PingPeer(ctx, h3.ID()); err != ErrProtocolNotSupported {
+		t.Fatalf("expected %s, got %v", ErrProtocolNotSupported, err)
+	}
+}
+
+type testService struct {
+	started, stopped int32
+	streams          chan network.Stream
+}
+
+func (s *testService) Protocol() protocol.ID { return "/test/service" }
+
+func (s *testService) Start(host.Host) error {
+	atomic.AddInt32(&s.started, 1)
+	return nil
+}
+
+func (s *testService) Stop() error {
+	atomic.AddInt32(&s.stopped, 1)
+	return nil
+}
+
+func (s *testService) HandleStream(str network.Stream) { s.streams <- str }
+
+func TestHostRegisterService(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	svc := &testService{streams: make(chan network.Stream, 1)}
+	if err := h1.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := h1.Register(svc); err != nil {
+		t.Fatalf("registering a service again should be a no-op, got %s", err)
+	}
+	if err := h1.Register(&testService{}); err == nil {
+		t.Fatal("expected registering another service for the same protocol to fail")
+	}
+	if n := atomic.LoadInt32(&svc.started); n != 1 {
+		t.Fatalf("expected the service to be started once, got %d", n)
+	}
+
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := h2.NewStream(ctx, h1.ID(), svc.Protocol())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hi"))
+	select {
+	case str := <-svc.streams:
+		str.Reset()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the service didn't handle the stream")
+	}
+	s.Reset()
+
+	if err := h1.Unregister(svc.Protocol()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&svc.stopped); n != 1 {
+		t.Fatalf("expected the service to be stopped once, got %d", n)
+	}
+	if h1.HasProtocol(h1.ID(), svc.Protocol()) {
+		t.Fatal("expected the stream handler to be removed")
+	}
+
+	// services still registered are stopped when the host closes.
+	if err := h1.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+	h1.Close()
+	if n := atomic.LoadInt32(&svc.stopped); n != 2 {
+		t.Fatalf("expected the service to be stopped on close, got %d", n)
+	}
+	if err := h1.Register(svc); err == nil {
+		t.Fatal("expected registering a service on a closed host to fail")
+	}
+}
+
+func TestHostConnectDialError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	h2pi := h2.Peerstore().PeerInfo(h2.ID())
+	h2.Close()
+
+	err := h1.Connect(ctx, h2pi)
+	var derr *DialError
+	if !errors.As(err, &derr) {
+		t.Fatalf("expected a *DialError, got %v", err)
+	}
+	if derr.Peer != h2pi.ID || len(derr.Errors) != len(h2pi.Addrs) {
+		t.Fatalf("expected one error per address of %s, got %s", h2pi.ID, derr)
+	}
+	for _, ae := range derr.Errors {
+		if !containsAddr(h2pi.Addrs, ae.Addr) || ae.Err == nil {
+			t.Fatalf("unexpected address error %s", ae)
+		}
+	}
+
+	var aerr AddrDialError
+	if !errors.As(err, &aerr) || aerr.Addr == nil {
+		t.Fatalf("expected the error to unwrap to an AddrDialError, got %v", err)
+	}
+}
+
+func TestHostWaitForConnect(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := h1.WaitForConnect(tctx, h2.ID()); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- h1.WaitForConnect(ctx, h2.ID()) }()
+
+	// an inbound connection, dialed by h2, unblocks h1.
+	time.Sleep(50 * time.Millisecond)
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the connection")
+	}
+
+	// already connected.
+	if err := h1.WaitForConnect(ctx, h2.ID()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostStreamHandlerWithConnLimit(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	const pid = protocol.ID("/test/limited")
+	h1.SetStreamHandlerWithConnLimit(pid, 1, func(s network.Stream) {
+		// echo until the remote closes the stream.
+		io.Copy(s, s)
+		s.Close()
+	})
+
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	echo := func(s network.Stream) error {
+		if _, err := s.Write([]byte("a")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(s, make([]byte, 1))
+		return err
+	}
+
+	s1, err := h2.NewStream(ctx, h1.ID(), pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(s1); err != nil {
+		t.Fatal(err)
+	}
+	if n := h1.ActiveStreamCount(pid); n != 1 {
+		t.Fatalf("expected 1 active stream, got %d", n)
+	}
+
+	s2, err := h2.NewStream(ctx, h1.ID(), pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(s2); err == nil {
+		t.Fatal("expected the stream over the limit to be reset")
+	}
+	s2.Reset()
+	if n := h1.ActiveStreamCount(pid); n != 1 {
+		t.Fatalf("expected 1 active stream, got %d", n)
+	}
+
+	// closing the first stream frees its slot.
+	s1.Close()
+	ioutil.ReadAll(s1)
+	deadline := time.Now().Add(5 * time.Second)
+	for h1.ActiveStreamCount(pid) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the slot to be released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s3, err := h2.NewStream(ctx, h1.ID(), pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Reset()
+	if err := echo(s3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewStreamRetries(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+
+	// reset all the inbound streams of the first two connections before
+	// negotiating their protocol.
+	var mx sync.Mutex
+	conns := make(map[network.Conn]int)
+	h1.Network().SetStreamHandler(func(s network.Stream) {
+		mx.Lock()
+		if _, ok := conns[s.Conn()]; !ok {
+			conns[s.Conn()] = len(conns)
+		}
+		n := conns[s.Conn()]
+		mx.Unlock()
+		if n < 2 {
+			s.Reset()
+			return
+		}
+		h1.newStreamHandler(s)
+	})
+	h1.SetStreamHandler(protocol.ID("/test/retry"), func(s network.Stream) {
+		// writing flushes the lazy protocol acknowledgement.
+		s.Write([]byte("ok"))
+		s.Close()
+	})
+
+	for _, tc := range []struct {
+		retries int
+		ok      bool
+	}{{1, false}, {2, true}} {
+		mx.Lock()
+		conns = make(map[network.Conn]int)
+		mx.Unlock()
+		h2, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+			NewStreamRetries:      tc.retries,
+			NewStreamRetryBackoff: 50 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h2.Peerstore().AddAddrs(h1.ID(), h1.Addrs(), peerstore.PermanentAddrTTL)
+
+		start := time.Now()
+		s, err := h2.NewStream(ctx, h1.ID(), protocol.ID("/test/retry"))
+		if tc.ok {
+			if err != nil {
+				t.Fatalf("expected NewStream to succeed after %d retries, got %s", tc.retries, err)
+			}
+			// the retries back off 50ms, then 100ms.
+			if took := time.Since(start); took < 150*time.Millisecond {
+				t.Fatalf("expected the retries to back off, took %s", took)
+			}
+			s.Reset()
+		} else {
+			if err == nil {
+				t.Fatal("expected NewStream to fail")
+			}
+			if !errors.Is(err, mux.ErrReset) && !errors.Is(err, io.EOF) {
+				t.Fatalf("expected the error to wrap the resets, got %s", err)
+			}
+		}
+		h2.Close()
+	}
+}
+
+func TestHostConnectedness(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	var h Host = h1
+	if c := h.Connectedness(h2.ID()); c != network.NotConnected {
+		t.Fatalf("expected NotConnected, got %d", c)
+	}
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	if c := h.Connectedness(h2.ID()); c != network.Connected {
+		t.Fatalf("expected Connected, got %d", c)
+	}
+}
+
+func TestHostRelayAddrs(t *testing.T) {
+	ctx := context.Background()
+	var mx sync.Mutex
+	var relayAddrs []ma.Multiaddr
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		RelayAddrs: func() []ma.Multiaddr {
+			mx.Lock()
+			defer mx.Unlock()
+			return relayAddrs
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.Start()
+
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated), eventbus.BufSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	own := h.Addrs()
+	relay := ma.StringCast("/ip4/1.2.3.4/tcp/1234/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC/p2p-circuit")
+	mx.Lock()
+	relayAddrs = []ma.Multiaddr{relay}
+	mx.Unlock()
+
+	addrs := h.Addrs()
+	if len(addrs) != len(own)+1 || !addrs[len(addrs)-1].Equal(relay) {
+		t.Fatalf("expected the relay address to be appended to %s, got %s", own, addrs)
+	}
+
+	h.CheckForAddressChanges()
+	select {
+	case e := <-sub.Out():
+		evt := e.(event.EvtLocalAddressesUpdated)
+		if len(evt.Current) != len(addrs) {
+			t.Fatalf("expected the current addresses to be %s, got %v", addrs, evt.Current)
+		}
+		found := false
+		for _, u := range evt.Current {
+			if u.Address.Equal(relay) && u.Action == event.Added {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected the relay address to be added, got %v", evt.Current)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an address update event")
+	}
+}
+
+func TestHostStreamAndConnectionCount(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		s.Write([]byte("ok"))
+		s.Close()
+	})
+
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	if n := h1.ConnectionCount(); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+
+	waitForCount := func(count func() int, expected int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for count() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected a count of %d, got %d", expected, count())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// wait for the identify streams to close.
+	waitForCount(h1.StreamCount, 0)
+
+	s, err := h1.NewStream(ctx, h2.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(s); err != nil {
+		t.Fatal(err)
+	}
+	if n := h1.StreamCount(); n != 1 {
+		t.Fatalf("expected 1 stream, got %d", n)
+	}
+	s.Close()
+	waitForCount(h1.StreamCount, 0)
+
+	h1.Network().ClosePeer(h2.ID())
+	waitForCount(h1.ConnectionCount, 0)
+}
+
+func TestHostBroadcastProtocolUpdate(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// bypass the host so that no protocol update is emitted.
+	const pid = "/test/broadcast"
+	h1.Mux().AddHandler(pid, func(string, io.ReadWriteCloser) error { return nil })
+
+	if err := h1.BroadcastProtocolUpdate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := h2.WaitForProtocol(wctx, h1.ID(), pid); err != nil {
+		t.Fatalf("expected %s to learn about %s: %s", h2.ID(), pid, err)
+	}
+}
+
+func TestHostStreamHandlerPanic(t *testing.T) {
+	ctx := context.Background()
+
+	type recovered struct {
+		pid protocol.ID
+		r   interface{}
+	}
+	panics := make(chan recovered, 1)
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		StreamHandlerPanicHandler: func(pid protocol.ID, s network.Stream, r interface{}) {
+			s.Reset()
+			panics <- recovered{pid, r}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	for _, h := range []*BasicHost{h1, h2} {
+		h.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+			panic("boom")
+		})
+	}
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the default handler resets the stream.
+	s, err := h1.NewStream(ctx, h2.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hi"))
+	if _, err := ioutil.ReadAll(s); err == nil {
+		t.Fatal("expected the stream to be reset")
+	}
+
+	s, err = h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+	s.Write([]byte("hi"))
+	select {
+	case p := <-panics:
+		if p.pid != protocol.TestingID || p.r != "boom" {
+			t.Fatalf("unexpected panic %v for %s", p.r, p.pid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the panic handler to be called")
+	}
+}
+
+func TestHostPeerProtocols(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) { s.Close() })
+
+	before := time.Now()
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h1.Peerstore().AddProtocols(h2.ID(), "/from/user"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sources := make(map[protocol.ID]ProtocolWithSource)
+		for _, pws := range h1.PeerProtocols(h2.ID()) {
+			sources[pws.Protocol] = pws
+		}
+		tp, user := sources[protocol.TestingID], sources["/from/user"]
+		if tp.Source == ProtocolSourceIdentify {
+			if tp.UpdatedAt.Before(before) {
+				t.Fatalf("unexpected update time %s", tp.UpdatedAt)
+			}
+			if user.Source != ProtocolSourcePeerstore || !user.UpdatedAt.IsZero() {
+				t.Fatalf("expected /from/user to come from the peerstore, got %+v", user)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the testing protocol to come from identify, got %+v", tp)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// what identify told us is forgotten with the last connection.
+	if err := h1.Network().ClosePeer(h2.ID()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		h1.protoUpdatedMx.Lock()
+		_, updated := h1.protoUpdated[h2.ID()]
+		_, sourced := h1.protoSources[h2.ID()]
+		h1.protoUpdatedMx.Unlock()
+		if !updated && !sourced {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected the protocol updates of h2 to be forgotten")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, pws := range h1.PeerProtocols(h2.ID()) {
+		if pws.Source != ProtocolSourcePeerstore {
+			t.Fatalf("expected %s to come from the peerstore, got %+v", pws.Protocol, pws)
+		}
+	}
+}
+
+func TestHostProtocolsAfterIdentify(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) { s.Close() })
+
+	// the inbound side is identified in the background, so this races with
+	// newConnHandler.
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	conns := h1.Network().ConnsToPeer(h2.ID())
+	if len(conns) == 0 {
+		t.Fatal("expected a connection")
+	}
+
+	protos, err := h1.ProtocolsAfterIdentify(ctx, conns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, p := range protos {
+		if p == protocol.TestingID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected %s in %v", protocol.TestingID, protos)
+	}
+
+	conns[0].Close()
+	if _, err := h1.ProtocolsAfterIdentify(ctx, conns[0]); err == nil {
+		t.Fatal("expected an error for a closed connection")
+	}
+}
+
+func TestHostProbeAddr(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h := New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	for _, a := range h.Addrs() {
+		if err := h.ProbeAddr(ctx, a); err != nil {
+			t.Fatalf("expected %s to be reachable: %s", a, err)
+		}
+	}
+	p2pAddrs, err := h.P2PAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pa := range p2pAddrs {
+		if err := h.ProbeAddr(ctx, pa); err != nil {
+			t.Fatalf("expected %s to be reachable: %s", pa, err)
+		}
+	}
+
+	// a closed port.
+	l, err := manet.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Multiaddr()
+	l.Close()
+	if err := h.ProbeAddr(ctx, closed); err == nil {
+		t.Fatalf("expected %s to be unreachable", closed)
+	}
+
+	// something else than a libp2p listener.
+	l, err = manet.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		c.Close()
+	}()
+	if err := h.ProbeAddr(ctx, l.Multiaddr()); err == nil {
+		t.Fatal("expected probing a non libp2p listener to fail")
+	}
+
+	if err := h.ProbeAddr(ctx, ma.StringCast("/ip4/127.0.0.1/udp/1234/quic")); err == nil {
+		t.Fatal("expected probing a quic address to fail")
+	}
+}
+
+func TestHostMaxPendingOutboundStreamsPerPeer(t *testing.T) {
+	ctx := context.Background()
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{MaxPendingOutboundStreamsPerPeer: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		s.Write([]byte("ok"))
+		s.Close()
+	})
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	// known protocols are selected lazily, without waiting for h2.
+	h1.Peerstore().AddProtocols(h2.ID(), string(protocol.TestingID))
+
+	var pending []network.Stream
+	for i := 0; i < 2; i++ {
+		s, err := h1.NewStream(ctx, h2.ID(), protocol.TestingID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Reset()
+		pending = append(pending, s)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := h1.NewStream(tctx, h2.ID(), protocol.TestingID); err != context.DeadlineExceeded {
+		t.Fatalf("expected NewStream to block, got %v", err)
+	}
+
+	// reading the acknowledgement frees a slot.
+	if _, err := io.ReadFull(pending[0], make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	s, err := h1.NewStream(tctx, h2.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+
+	// and so does closing a stream.
+	pending[1].Close()
+	s, err = h1.NewStream(tctx, h2.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Reset()
+}
+
+type tagRecordingConnMgr struct {
+	connmgr.NullConnMgr
+
+	mx   sync.Mutex
+	tags map[peer.ID]map[string]int
+}
+
+func (cm *tagRecordingConnMgr) TagPeer(p peer.ID, tag string, val int) {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+	if cm.tags[p] == nil {
+		cm.tags[p] = make(map[string]int)
+	}
+	cm.tags[p][tag] = val
+}
+
+func TestHostConnectWithPriority(t *testing.T) {
+	ctx := context.Background()
+	cm := &tagRecordingConnMgr{tags: make(map[peer.ID]map[string]int)}
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{ConnManager: cm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	if err := h1.ConnectWithPriority(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}, 42); err != nil {
+		t.Fatal(err)
+	}
+	if h1.Network().Connectedness(h2.ID()) != network.Connected {
+		t.Fatal("expected to be connected")
+	}
+
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+	if v, ok := cm.tags[h2.ID()][ConnectPriorityTag]; !ok || v != 42 {
+		t.Fatalf("expected tag %s=42, got %v", ConnectPriorityTag, cm.tags[h2.ID()])
+	}
+}
+
+func TestHostListenAddrChangeHook(t *testing.T) {
+	ctx := context.Background()
+	var mx sync.Mutex
+	var relayAddrs, added, removed []ma.Multiaddr
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		RelayAddrs: func() []ma.Multiaddr {
+			mx.Lock()
+			defer mx.Unlock()
+			return relayAddrs
+		},
+		ListenAddrChangeHook: func(a, r []ma.Multiaddr) {
+			mx.Lock()
+			defer mx.Unlock()
+			added = append(added, a...)
+			removed = append(removed, r...)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.Start()
+	h.CheckForAddressChanges()
+
+	relay := ma.StringCast("/ip4/1.2.3.4/tcp/1234/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC/p2p-circuit")
+	// the background address check may call the hook instead of us, so
+	// wait for it rather than checking right after CheckForAddressChanges.
+	waitFor := func(addrs *[]ma.Multiaddr) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			h.CheckForAddressChanges()
+			mx.Lock()
+			found := containsAddr(*addrs, relay)
+			mx.Unlock()
+			if found {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("hook wasn't called with %s", relay)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	mx.Lock()
+	relayAddrs = []ma.Multiaddr{relay}
+	mx.Unlock()
+	waitFor(&added)
+
+	mx.Lock()
+	relayAddrs = nil
+	mx.Unlock()
+	waitFor(&removed)
+}
+
+func TestHostDebugHTTP(t *testing.T) {
+	ctx := context.Background()
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{DebugHTTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {})
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string, v interface{}) {
+		t.Helper()
+		resp, err := http.Get("http://" + h1.DebugHTTPAddr().String() + DebugHTTPPrefix + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %s for %s", resp.Status, path)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var peers []debugPeer
+	get("peers", &peers)
+	if len(peers) != 1 || peers[0].ID != h2.ID().Pretty() {
+		t.Fatalf("expected %s to be the only peer, got %+v", h2.ID(), peers)
+	}
+
+	var protos []string
+	get("protocols", &protos)
+	found := false
+	for _, p := range protos {
+		if p == string(protocol.TestingID) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected %s in %v", protocol.TestingID, protos)
+	}
+
+	var addrs debugAddrs
+	get("addrs", &addrs)
+	if len(addrs.Listen) == 0 || len(addrs.Advertised) == 0 {
+		t.Fatalf("expected addresses, got %+v", addrs)
+	}
+
+	var streams []debugStream
+	get("streams", &streams)
+
+	addr := h1.DebugHTTPAddr().String()
+	h1.Close()
+	if _, err := http.Get("http://" + addr + DebugHTTPPrefix + "peers"); err == nil {
+		t.Fatal("expected the debug server to be closed")
+	}
+}
+
+func TestHostSnapshot(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) {})
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := h1.NewStream(ctx, h2.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	snap := h1.Snapshot()
+	if len(snap.Peers) != 1 || snap.Peers[0].ID != h2.ID().Pretty() {
+		t.Fatalf("expected %s to be the only peer, got %+v", h2.ID(), snap.Peers)
+	}
+	found := false
+	for _, p := range snap.Peers[0].Protocols {
+		if p == string(protocol.TestingID) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected %s in %v", protocol.TestingID, snap.Peers[0].Protocols)
+	}
+	found = false
+	for _, st := range snap.Streams {
+		if st.Protocol == string(protocol.TestingID) && st.Direction == "outbound" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected an outbound %s stream, got %+v", protocol.TestingID, snap.Streams)
+	}
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded HostSnapshot
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(snap) {
+		t.Fatalf("expected %+v to round trip, got %+v", snap, decoded)
+	}
+
+	decoded.Peers[0].Protocols = decoded.Peers[0].Protocols[1:]
+	if decoded.Equal(snap) {
+		t.Fatal("expected snapshots with different protocols to differ")
+	}
+}
+
+type streamCountConn struct {
+	network.Conn
+	streams int
+}
+
+func (c *streamCountConn) GetStreams() []network.Stream {
+	return make([]network.Stream, c.streams)
+}
+
+func TestDialStrategies(t *testing.T) {
+	a, b, c := &streamCountConn{streams: 2}, &streamCountConn{streams: 1}, &streamCountConn{streams: 1}
+	conns := []network.Conn{a, b, c}
+
+	if got := LeastLoadedConn.SelectConn(conns); got != c {
+		t.Fatalf("expected the newest least loaded connection, got %v", got)
+	}
+	if got := MostRecentConn.SelectConn(conns); got != c {
+		t.Fatalf("expected the newest connection, got %v", got)
+	}
+	if got := RandomConn.SelectConn(conns); got != a && got != b && got != c {
+		t.Fatalf("unexpected connection %v", got)
+	}
+	for _, s := range []DialStrategy{LeastLoadedConn, MostRecentConn, RandomConn} {
+		if s.SelectConn(nil) != nil {
+			t.Fatal("expected no connection to be selected")
+		}
+	}
+}
+
+func TestHostStreamDialStrategy(t *testing.T) {
+	ctx := context.Background()
+	var selected int32
+	var chosen network.Conn
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		StreamDialStrategy: DialStrategyFunc(func(conns []network.Conn) network.Conn {
+			atomic.AddInt32(&selected, 1)
+			chosen = conns[0]
+			return chosen
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) { s.Close() })
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := h1.NewStream(ctx, h2.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if atomic.LoadInt32(&selected) == 0 {
+		t.Fatal("expected the strategy to be used")
+	}
+	if s.Conn() != chosen {
+		t.Fatal("expected the stream to be opened on the selected connection")
+	}
+}
+
+func TestHostStreamHandlerDeregisterHook(t *testing.T) {
+	h := New(swarmt.GenSwarm(t, context.Background()))
+	defer h.Close()
+
+	var removed int32
+	onRemove := func() { atomic.AddInt32(&removed, 1) }
+	handler := func(s network.Stream) { s.Close() }
+
+	h.SetStreamHandlerWithDeregisterHook(protocol.TestingID, handler, onRemove)
+	if atomic.LoadInt32(&removed) != 0 {
+		t.Fatal("hook called before the handler was removed")
+	}
+	h.RemoveStreamHandler(protocol.TestingID)
+	if atomic.LoadInt32(&removed) != 1 {
+		t.Fatal("expected the hook to be called on removal")
+	}
+	h.RemoveStreamHandler(protocol.TestingID)
+	if atomic.LoadInt32(&removed) != 1 {
+		t.Fatal("expected the hook to be called once")
+	}
+
+	// replacing the handler removes it too.
+	h.SetStreamHandlerWithDeregisterHook(protocol.TestingID, handler, onRemove)
+	h.SetStreamHandler(protocol.TestingID, handler)
+	if atomic.LoadInt32(&removed) != 2 {
+		t.Fatal("expected the hook to be called when the handler is replaced")
+	}
+	h.RemoveStreamHandler(protocol.TestingID)
+	if atomic.LoadInt32(&removed) != 2 {
+		t.Fatal("expected the hook not to be called for the new handler")
+	}
+}
+
+func TestHostStreamWriteTimeout(t *testing.T) {
+	ctx := context.Background()
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{StreamWriteTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	// never read, so that the writer eventually blocks.
+	done := make(chan struct{})
+	defer close(done)
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		s.Write([]byte("ack"))
+		<-done
+		s.Reset()
+	})
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := h1.NewStream(ctx, h2.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+
+	// writing slowly is fine, the deadline is pushed back on every write.
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := s.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := s.Write(buf); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-errCh:
+		if nerr, ok := err.(interface{ Timeout() bool }); !ok || !nerr.Timeout() {
+			t.Fatalf("expected a timeout error, got %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("write didn't time out")
+	}
+}
+
+func TestHostProtocolPeers(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h3 := New(swarmt.GenSwarm(t, ctx))
+	defer h3.Close()
+
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) { s.Close() })
+	for _, h := range []*BasicHost{h2, h3} {
+		if err := h1.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a peer we aren't connected to.
+	if err := h1.Peerstore().AddProtocols(test.RandPeerIDFatal(t), string(protocol.TestingID)); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := h1.ProtocolPeers(protocol.TestingID)
+	if len(peers) != 1 || peers[0] != h2.ID() {
+		t.Fatalf("expected only %s to support %s, got %v", h2.ID(), protocol.TestingID, peers)
+	}
+	if peers := h1.ProtocolPeers("/unknown"); len(peers) != 0 {
+		t.Fatalf("expected no peers, got %v", peers)
+	}
+}
+
+func TestHostSetStreamHandlers(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	sub, err := h1.EventBus().Subscribe(&event.EvtLocalProtocolsUpdated{}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	h1.SetStreamHandlers(map[protocol.ID]network.StreamHandler{
+		"/svc/a": func(s network.Stream) { s.Write([]byte("a")); s.Close() },
+		"/svc/b": func(s network.Stream) { s.Write([]byte("b")); s.Close() },
+	})
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(event.EvtLocalProtocolsUpdated)
+		if len(evt.Added) != 2 || evt.Added[0] != "/svc/a" || evt.Added[1] != "/svc/b" {
+			t.Fatalf("expected both protocols to be added, got %v", evt.Added)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the event")
+	}
+	select {
+	case e := <-sub.Out():
+		t.Fatalf("expected a single event, got %v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, pid := range []protocol.ID{"/svc/a", "/svc/b"} {
+		s, err := h2.NewStream(ctx, h1.ID(), pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != string(pid[len(pid)-1]) {
+			t.Fatalf("unexpected response %q from %s", b, pid)
+		}
+	}
+}
+
+type countingStream struct {
+	network.Stream
+	written *int32
+}
+
+func (s *countingStream) Write(b []byte) (int, error) {
+	atomic.AddInt32(s.written, int32(len(b)))
+	return s.Stream.Write(b)
+}
+
+func TestHostStreamInterceptor(t *testing.T) {
+	ctx := context.Background()
+	var written int32
+	var mx sync.Mutex
+	var dirs []network.Direction
+	interceptor := StreamInterceptorFunc(func(dir network.Direction, s network.Stream) (network.Stream, error) {
+		// identify streams are intercepted too.
+		if s.Protocol() != protocol.TestingID && s.Protocol() != "/rejected" {
+			return s, nil
+		}
+		mx.Lock()
+		dirs = append(dirs, dir)
+		mx.Unlock()
+		if s.Protocol() == "/rejected" {
+			return nil, errors.New("rejected")
+		}
+		return &countingStream{Stream: s, written: &written}, nil
+	})
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{StreamInterceptor: interceptor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		s.Write([]byte("hello"))
+		s.Close()
+	})
+	h1.SetStreamHandler("/rejected", func(s network.Stream) {
+		t.Error("rejected stream handled")
+	})
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		ioutil.ReadAll(s)
+		s.Close()
+	})
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// inbound
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(s); err != nil || string(b) != "hello" {
+		t.Fatalf("unexpected response %q: %v", b, err)
+	}
+	s, err = h2.NewStream(ctx, h1.ID(), "/rejected")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(s); err == nil {
+		t.Fatal("expected the rejected stream to be reset")
+	}
+
+	// outbound
+	s, err = h1.NewStream(ctx, h2.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if n := atomic.LoadInt32(&written); n != int32(len("hello")+len("hi")) {
+		t.Fatalf("expected the intercepted streams to be used, %d bytes written", n)
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	if len(dirs) != 3 || dirs[0] != network.DirInbound || dirs[1] != network.DirInbound || dirs[2] != network.DirOutbound {
+		t.Fatalf("unexpected directions %v", dirs)
+	}
+}
+
+func TestHostForEachConnAndPeer(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h3 := New(swarmt.GenSwarm(t, ctx))
+	defer h3.Close()
+
+	for _, h := range []*BasicHost{h2, h3} {
+		if err := h1.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peers := make(map[peer.ID]bool)
+	h1.ForEachPeer(func(p peer.ID) bool {
+		peers[p] = true
+		return true
+	})
+	if len(peers) != 2 || !peers[h2.ID()] || !peers[h3.ID()] {
+		t.Fatalf("expected h2 and h3, got %v", peers)
+	}
+
+	n := 0
+	h1.ForEachConn(func(c network.Conn) bool {
+		n++
+		return true
+	})
+	if n != len(h1.Network().Conns()) {
+		t.Fatalf("expected %d connections, visited %d", len(h1.Network().Conns()), n)
+	}
+
+	// stop early, closing the visited connection.
+	n = 0
+	h1.ForEachConn(func(c network.Conn) bool {
+		n++
+		c.Close()
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("expected the iteration to stop, visited %d", n)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := 0
+		h1.ForEachPeer(func(p peer.ID) bool {
+			n++
+			return true
+		})
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a single peer left, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHostConcurrentConnect(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	sub, err := h1.EventBus().Subscribe(new(EvtPeerConnected), eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if conns := h1.Network().ConnsToPeer(h2.ID()); len(conns) != 1 {
+		t.Fatalf("expected a single connection, got %d", len(conns))
+	}
+	<-sub.Out()
+	select {
+	case e := <-sub.Out():
+		t.Fatalf("expected a single connection attempt, got %v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHostConnectAbandonedAttempt(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	// the first caller gives up right away, the second one must still
+	// connect.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- h1.Connect(cctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}) }()
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	<-errCh
+}
+
+type traceIDKey struct{}
+
+func TestHostContextPropagation(t *testing.T) {
+	ctx := context.Background()
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		ContextPropagationKeys: []interface{}{traceIDKey{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	traces := make(chan interface{}, 1)
+	h1.SetStreamHandlerWithContext(protocol.TestingID, func(ctx context.Context, s network.Stream) {
+		traces <- ctx.Value(traceIDKey{})
+		s.Write([]byte("ok"))
+		s.Close()
+	})
+
+	tctx := context.WithValue(ctx, traceIDKey{}, "trace-1")
+	if err := h1.Connect(tctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(s); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case trace := <-traces:
+		if trace != "trace-1" {
+			t.Fatalf("expected the trace ID to be propagated, got %v", trace)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+}
+
+func TestDialAddressPrioritizers(t *testing.T) {
+	public := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	quic := ma.StringCast("/ip4/1.2.3.4/udp/4001/quic")
+	local := ma.StringCast("/ip4/192.168.1.2/tcp/4001")
+	loopback := ma.StringCast("/ip4/127.0.0.1/udp/4001/quic")
+	addrs := []ma.Multiaddr{public, quic, local, loopback}
+
+	check := func(got, expected []ma.Multiaddr) {
+		t.Helper()
+		if len(got) != len(expected) {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+		for i := range got {
+			if !got[i].Equal(expected[i]) {
+				t.Fatalf("expected %s, got %s", expected, got)
+			}
+		}
+	}
+	check(PrioritizeLocalAddrs(addrs), []ma.Multiaddr{local, loopback, public, quic})
+	check(PrioritizeQUIC(addrs), []ma.Multiaddr{quic, loopback, public, local})
+	// the input is left untouched.
+	check(addrs, []ma.Multiaddr{public, quic, local, loopback})
+}
+
+func TestHostDialAddressPrioritizer(t *testing.T) {
+	ctx := context.Background()
+	var called int32
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		DialAddressPrioritizer: func(addrs []ma.Multiaddr) []ma.Multiaddr {
+			atomic.AddInt32(&called, 1)
+			return PrioritizeLocalAddrs(addrs)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&called) == 0 {
+		t.Fatal("expected the prioritizer to be called")
+	}
+}
+
+func TestHostAwaitIdentify(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	if err := h1.AwaitIdentify(ctx, h2.ID()); err == nil {
+		t.Fatal("expected an error when not connected")
+	}
+
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) { s.Close() })
+	// h1 identifies the inbound connection in the background.
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h1.AwaitIdentify(ctx, h2.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if !h1.HasProtocol(h2.ID(), protocol.TestingID) {
+		t.Fatal("expected the protocols of h2 to be known once identified")
+	}
+}
+
+func TestHostStreamHandlerAuthRequired(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h3 := New(swarmt.GenSwarm(t, ctx))
+	defer h3.Close()
+
+	sub, err := h1.EventBus().Subscribe(new(EvtStreamNegotiationFailed), eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	var handled int32
+	h1.SetStreamHandlerAuthRequired(protocol.TestingID, []peer.ID{h2.ID()}, func(s network.Stream) {
+		atomic.AddInt32(&handled, 1)
+		s.Write([]byte("ok"))
+		s.Close()
+	})
+
+	open := func(h *BasicHost) error {
+		if err := h.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+		s, err := h.NewStream(ctx, h1.ID(), protocol.TestingID)
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(s)
+		return err
+	}
+
+	if err := open(h2); err != nil {
+		t.Fatal(err)
+	}
+	if err := open(h3); err == nil {
+		t.Fatal("expected the stream of h3 to be reset")
+	}
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatalf("expected a single stream to be handled, got %d", n)
+	}
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(EvtStreamNegotiationFailed)
+		if evt.RemotePeer != h3.ID() || evt.Reason != AuthRejected || evt.Err != ErrAuthRejected {
+			t.Fatalf("unexpected event %+v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the event")
+	}
+
+	// the rule goes away with the handler.
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		s.Write([]byte("ok"))
+		s.Close()
+	})
+	if err := open(h3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostConnectedSince(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	if _, err := h1.ConnectedSince(h2.ID()); err != identify.ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	before := time.Now()
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	since, err := h1.ConnectedSince(h2.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since.Before(before) || since.After(time.Now()) {
+		t.Fatalf("unexpected connection time %s", since)
+	}
+
+	// a new session starts once disconnected.
+	h1.Network().ClosePeer(h2.ID())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := h1.ConnectedSince(h2.ID()); err == identify.ErrNotConnected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the session to end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	again, err := h1.ConnectedSince(h2.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.After(since) {
+		t.Fatalf("expected a new connection time, got %s after %s", again, since)
+	}
+}
+
+func TestHostAllowedRemoteAddrs(t *testing.T) {
+	ctx := context.Background()
+	var allow int32
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		AllowedRemoteAddrs: func(a ma.Multiaddr) bool {
+			return atomic.LoadInt32(&allow) == 1 && manet.IsIPLoopback(a)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	// the connection of h2 is established, then closed by h1.
+	h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()})
+	deadline := time.Now().Add(5 * time.Second)
+	for h1.Network().Connectedness(h2.ID()) == network.Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// outbound connections aren't filtered.
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	h1.Network().ClosePeer(h2.ID())
+	for h2.Network().Connectedness(h1.ID()) == network.Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("expected h2 to notice the connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	atomic.StoreInt32(&allow, 1)
+	addrs := make([]ma.Multiaddr, 0)
+	for _, a := range h1.Addrs() {
+		if manet.IsIPLoopback(a) {
+			addrs = append(addrs, a)
+		}
+	}
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: addrs}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h2.AwaitIdentify(ctx, h1.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if h1.Network().Connectedness(h2.ID()) != network.Connected {
+		t.Fatal("expected the loopback connection to be accepted")
+	}
+}
+
+func TestHostReconfigure(t *testing.T) {
+	ctx := context.Background()
+	h := New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	h.Start()
+
+	sub, err := h.EventBus().Subscribe([]interface{}{new(event.EvtLocalAddressesUpdated), new(EvtHostReconfigured)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	maddr := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+	err = h.Reconfigure(AddrsFactory(func([]ma.Multiaddr) []ma.Multiaddr {
+		return []ma.Multiaddr{maddr}
+	}), DialLimits{MaxConcurrentDials: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := h.Addrs(); len(addrs) != 1 || !addrs[0].Equal(maddr) {
+		t.Fatalf("expected [%s], got %s", maddr, addrs)
+	}
+	if h.getDialLimiter() == nil {
+		t.Fatal("expected dials to be limited")
+	}
+
+	for _, want := range []string{"addrs", "reconfigured"} {
+		select {
+		case e := <-sub.Out():
+			switch e.(type) {
+			case event.EvtLocalAddressesUpdated:
+				if want != "addrs" {
+					t.Fatalf("unexpected event %T", e)
+				}
+			case EvtHostReconfigured:
+				if want != "reconfigured" {
+					t.Fatalf("unexpected event %T", e)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the %s event", want)
+		}
+	}
+
+	// invalid options are rejected and nothing is applied.
+	err = h.Reconfigure(AddrsFactory(DefaultAddrsFactory), DialLimits{MaxConcurrentDials: -1})
+	if err == nil {
+		t.Fatal("expected invalid dial limits to be rejected")
+	}
+	if addrs := h.Addrs(); len(addrs) != 1 || !addrs[0].Equal(maddr) {
+		t.Fatalf("expected the addrs factory to be unchanged, got %s", addrs)
+	}
+}
+
+func TestHostProtocolPreference(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	// prefers the newest 1.x version.
+	h2, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		ProtocolPreference: func(offered, supported []protocol.ID) protocol.ID {
+			var best protocol.ID
+			for _, p := range offered {
+				if strings.HasPrefix(string(p), "/testing/1.") && containsProtocol(supported, p) && p > best {
+					best = p
+				}
+			}
+			return best
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+
+	connectedOn := make(chan protocol.ID, 1)
+	handler := func(s network.Stream) {
+		connectedOn <- s.Protocol()
+		// completes the lazy handshake.
+		s.Write([]byte("hello"))
+		s.Close()
+	}
+	for _, p := range []protocol.ID{"/testing/1.0.0", "/testing/1.1.0", "/testing/2.0.0"} {
+		h1.SetStreamHandler(p, handler)
+	}
+
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+	if err := h2.AwaitIdentify(ctx, h1.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := h2.NewStream(ctx, h1.ID(), "/testing/1.0.0", "/testing/1.1.0", "/testing/2.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Protocol() != "/testing/1.1.0" {
+		t.Fatalf("expected /testing/1.1.0, got %s", s.Protocol())
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	assertWait(t, connectedOn, "/testing/1.1.0")
+	s.Close()
+
+	// without a match, the protocol is negotiated.
+	s, err = h2.NewStream(ctx, h1.ID(), "/testing/2.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertWait(t, connectedOn, "/testing/2.0.0")
+	s.Close()
+}
+
+func TestHostDisconnect(t *testing.T) {
+	ctx := context.Background()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), peerstore.PermanentAddrTTL)
+
+	// /drain closes the stream once we did, /stuck never does.
+	h2.SetStreamHandler("/drain", func(s network.Stream) {
+		ioutil.ReadAll(s)
+		s.Close()
+	})
+	block := make(chan struct{})
+	defer close(block)
+	h2.SetStreamHandler("/stuck", func(s network.Stream) {
+		<-block
+	})
+
+	openStream := func(pid protocol.ID) {
+		s, err := h1.NewStream(ctx, h2.ID(), pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		// waits for the response, as a client would.
+		go ioutil.ReadAll(s)
+	}
+
+	openStream("/drain")
+	tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := h1.Disconnect(tctx, h2.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if h1.Network().Connectedness(h2.ID()) == network.Connected {
+		t.Fatal("expected to be disconnected")
+	}
+	if err := h1.Disconnect(ctx, h2.ID()); err != identify.ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	openStream("/stuck")
+	tctx, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := h1.Disconnect(tctx, h2.ID()); err != context.DeadlineExceeded {
+		t.Fatalf("expected the stuck stream to time out, got %v", err)
+	}
+	if h1.Network().Connectedness(h2.ID()) == network.Connected {
+		t.Fatal("expected to be disconnected")
+	}
+}
+
+func TestHostStreamReadTimeout(t *testing.T) {
+	ctx := context.Background()
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{StreamReadTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	reads := make(chan error, 4)
+	h1.SetStreamHandler(protocol.TestingID, func(s network.Stream) {
+		defer s.Reset()
+		buf := make([]byte, 4)
+		for {
+			_, err := io.ReadFull(s, buf)
+			reads <- err
+			if err != nil {
+				return
+			}
+		}
+	})
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+
+	// writing slowly is fine, the deadline is pushed back on every read.
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := s.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-reads; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// then the handler times out once we stop writing.
+	select {
+	case err := <-reads:
+		if nerr, ok := err.(interface{ Timeout() bool }); !ok || !nerr.Timeout() {
+			t.Fatalf("expected a timeout error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the read to time out")
+	}
+}
+
+func TestHostSwarm(t *testing.T) {
+	ctx := context.Background()
+	sw := swarmt.GenSwarm(t, ctx)
+	h := New(sw)
+	defer h.Close()
+	if h.Swarm() != sw {
+		t.Fatal("expected the swarm of the host")
+	}
+
+	// any other network implementation.
+	other := New(struct{ network.Network }{swarmt.GenSwarm(t, ctx)})
+	defer other.Close()
+	if other.Swarm() != nil {
+		t.Fatal("expected no swarm")
+	}
+}
+
+func TestHostAddResolvedAddrs(t *testing.T) {
+	ctx := context.Background()
+	h := New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	p, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1 := ma.StringCast("/ip4/192.0.2.1/tcp/1")
+	a2 := ma.StringCast("/ip4/192.0.2.2/tcp/2")
+	h.Peerstore().AddAddr(p, a1, peerstore.PermanentAddrTTL)
+	h.addResolvedAddrs(p, []ma.Multiaddr{a1}, []ma.Multiaddr{a1, a2, a2})
+
+	addrs := h.Peerstore().Addrs(p)
+	if len(addrs) != 2 || !containsAddr(addrs, a1) || !containsAddr(addrs, a2) {
+		t.Fatalf("expected [%s %s], got %s", a1, a2, addrs)
+	}
+}
+
+// BenchmarkHostAddResolvedAddrs adds the addresses of a peer with 64 known
+// addresses, half of which needed resolving.
+func BenchmarkHostAddResolvedAddrs(b *testing.B) {
+	ctx := context.Background()
+	local, err := test.RandPeerID()
+	if err != nil {
+		b.Fatal(err)
+	}
+	sw := swarm.NewSwarm(ctx, local, pstoremem.NewPeerstore(), nil)
+	defer sw.Close()
+	h := &BasicHost{network: sw}
+	p, err := test.RandPeerID()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var known, resolved []ma.Multiaddr
+	for i := 0; i < 64; i++ {
+		a := ma.StringCast(fmt.Sprintf("/ip4/192.0.2.%d/tcp/%d", i, 1000+i))
+		if i < 32 {
+			known = append(known, a)
+		}
+		resolved = append(resolved, a)
+	}
+	h.Peerstore().AddAddrs(p, known, peerstore.PermanentAddrTTL)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.addResolvedAddrs(p, known, resolved)
+	}
+}
+
+type recordedSpan struct {
+	name  string
+	attrs map[string]string
+	ended bool
+}
+
+func (s *recordedSpan) SetAttribute(key, value string) { s.attrs[key] = value }
+func (s *recordedSpan) End()                           { s.ended = true }
+
+type recordingTracer struct {
+	mx    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	s := &recordedSpan{name: name, attrs: make(map[string]string)}
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+func TestHostTracer(t *testing.T) {
+	ctx := context.Background()
+	tracer := &recordingTracer{}
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{Tracer: tracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) { s.Close() })
+
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := h1.NewStream(ctx, h2.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := h1.NewStream(ctx, h2.ID(), "/unsupported"); err == nil {
+		t.Fatal("expected the negotiation to fail")
+	}
+
+	tracer.mx.Lock()
+	defer tracer.mx.Unlock()
+	if len(tracer.spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(tracer.spans))
+	}
+	connect, stream, failed := tracer.spans[0], tracer.spans[1], tracer.spans[2]
+	if connect.name != ConnectSpanName || connect.attrs["peer.id"] != h2.ID().Pretty() ||
+		connect.attrs["transport"] != "tcp" || !connect.ended {
+		t.Fatalf("unexpected connect span: %+v", connect)
+	}
+	if stream.name != NewStreamSpanName || stream.attrs["protocol"] != string(protocol.TestingID) ||
+		stream.attrs["transport"] != "tcp" || stream.attrs["error"] != "" || !stream.ended {
+		t.Fatalf("unexpected stream span: %+v", stream)
+	}
+	if failed.name != NewStreamSpanName || failed.attrs["error"] == "" || !failed.ended {
+		t.Fatalf("unexpected failed stream span: %+v", failed)
+	}
+}
+
+func TestHostStreamHandlerCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	h1, h2 := New(swarmt.GenSwarm(t, ctx)), New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	var calls int32
+	h1.SetStreamHandlerWithCircuitBreaker(protocol.TestingID, 2, 5*time.Second, 300*time.Millisecond, func(s network.Stream) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("boom")
+	})
+	h2.EnableHandlerErrors(protocol.TestingID)
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	handlerError := func() string {
+		s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Read(make([]byte, 1))
+		herr, ok := err.(*StreamHandlerError)
+		if !ok {
+			t.Fatalf("expected a StreamHandlerError, got %v", err)
+		}
+		return herr.Message
+	}
+
+	for i := 0; i < 3; i++ {
+		if msg := handlerError(); msg != "boom" {
+			t.Fatalf("expected the handler error, got %s", msg)
+		}
+	}
+	if msg := handlerError(); msg != ErrCircuitOpen.Error() {
+		t.Fatalf("expected the circuit to be open, got %s", msg)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expected the handler to run 3 times, ran %d times", n)
+	}
+
+	time.Sleep(350 * time.Millisecond)
+	if msg := handlerError(); msg != "boom" {
+		t.Fatalf("expected the circuit to be closed after the cooldown, got %s", msg)
+	}
+}
+
+func TestHostLocalPeerInfo(t *testing.T) {
+	ctx := context.Background()
+	h := New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	h.SetStreamHandler(protocol.TestingID, func(s network.Stream) { s.Close() })
+
+	info := h.LocalPeerInfo()
+	if info.ID != h.ID() {
+		t.Fatalf("expected %s, got %s", h.ID(), info.ID)
+	}
+	if addrs := h.Addrs(); len(info.Addrs) != len(addrs) {
+		t.Fatalf("expected %s, got %s", addrs, info.Addrs)
+	}
+	if !containsProtocol(info.Protocols, protocol.TestingID) || !containsProtocol(info.Protocols, identify.ID) {
+		t.Fatalf("expected the handled protocols, got %s", info.Protocols)
+	}
+
+	h.RemoveStreamHandler(protocol.TestingID)
+	if containsProtocol(h.LocalPeerInfo().Protocols, protocol.TestingID) {
+		t.Fatal("expected the removed protocol to be gone")
+	}
+}
+
+func TestHostIdentifySkipIfFresh(t *testing.T) {
+	ctx := context.Background()
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{IdentifySkipIfFresh: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+
+	// counts the identify requests of h1.
+	var identifies int32
+	h2, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		StreamInterceptor: StreamInterceptorFunc(func(dir network.Direction, s network.Stream) (network.Stream, error) {
+			if dir == network.DirInbound && s.Protocol() == identify.ID {
+				atomic.AddInt32(&identifies, 1)
+			}
+			return s, nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+	h2.SetStreamHandler(protocol.TestingID, func(s network.Stream) { s.Close() })
+
+	pi := peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}
+	for i := 0; i < 2; i++ {
+		if err := h1.Connect(ctx, pi); err != nil {
+			t.Fatal(err)
+		}
+		if err := h1.AwaitIdentify(ctx, h2.ID()); err != nil {
+			t.Fatal(err)
+		}
+		if protos, _ := h1.Peerstore().SupportsProtocols(h2.ID(), string(protocol.TestingID)); len(protos) != 1 {
+			t.Fatalf("expected the protocols of h2 to be known, got %s", protos)
+		}
+		// the connection handler identifies the connection concurrently.
+		time.Sleep(100 * time.Millisecond)
+		h1.Network().ClosePeer(h2.ID())
+	}
+	if n := atomic.LoadInt32(&identifies); n != 1 {
+		t.Fatalf("expected h2 to be identified once, got %d identifies", n)
+	}
+}
+
+// auditStream stands for a stream wrapped by a StreamInterceptor.
+type auditStream struct {
+	network.Stream
+}
+
+func TestHostTagStreamWrapped(t *testing.T) {
+	ctx := context.Background()
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{
+		StreamInterceptor: StreamInterceptorFunc(func(dir network.Direction, s network.Stream) (network.Stream, error) {
+			return &auditStream{Stream: s}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	tagged := make(chan struct{}, 1)
+	h1.SetStreamHandlerWithContext(protocol.TestingID, func(ctx context.Context, s network.Stream) {
+		h1.TagStream(s, "foo", 1)
+		tagged <- struct{}{}
+		ioutil.ReadAll(s)
+		s.Close()
+	})
+	if err := h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())); err != nil {
+		t.Fatal(err)
+	}
+	s, err := h2.NewStream(ctx, h1.ID(), protocol.TestingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	<-tagged
+	s.Close()
+	ioutil.ReadAll(s)
+
+	// the tags are removed with the stream.
+	for i := 0; ; i++ {
+		n := 0
+		h1.streamTags.Range(func(_, _ interface{}) bool {
+			n++
+			return true
+		})
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected no tagged streams, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
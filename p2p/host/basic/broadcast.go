@@ -0,0 +1,78 @@
+package basichost
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// BroadcastResult is the outcome of sending a broadcast message to a peer.
+type BroadcastResult struct {
+	Peer peer.ID
+	Err  error
+}
+
+// Broadcast sends data to all the peers we're connected to, each on a new
+// stream for proto, and returns the error, if any, for each peer. Peers that
+// don't support proto are skipped and don't appear in the result.
+func (h *BasicHost) Broadcast(ctx context.Context, proto protocol.ID, data []byte) map[peer.ID]error {
+	errs := make(map[peer.ID]error)
+	for res := range h.BroadcastAsync(ctx, proto, data) {
+		errs[res.Peer] = res.Err
+	}
+	return errs
+}
+
+// BroadcastAsync is like Broadcast but sends the messages concurrently,
+// returning a channel of results that is closed once data was sent, or
+// failed to be sent, to all the peers.
+func (h *BasicHost) BroadcastAsync(ctx context.Context, proto protocol.ID, data []byte) <-chan BroadcastResult {
+	peers := h.Network().Peers()
+	results := make(chan BroadcastResult, len(peers))
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			err := h.sendTo(ctx, p, proto, data)
+			if err == msmux.ErrNotSupported {
+				return
+			}
+			results <- BroadcastResult{Peer: p, Err: err}
+		}(p)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// sendTo sends data to p on a new stream for proto, without dialing.
+func (h *BasicHost) sendTo(ctx context.Context, p peer.ID, proto protocol.ID, data []byte) error {
+	s, err := h.NewStream(network.WithNoDial(ctx, "broadcast"), p, proto)
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := s.SetWriteDeadline(deadline); err != nil {
+			s.Reset()
+			return err
+		}
+	}
+	if _, err := s.Write(data); err != nil {
+		s.Reset()
+		return err
+	}
+	go helpers.FullClose(s)
+	return nil
+}
@@ -0,0 +1,76 @@
+package basichost
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// ErrCircuitOpen is the error reported to the openers of the streams refused
+// by a handler set with SetStreamHandlerWithCircuitBreaker while its circuit
+// is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// circuitBreaker opens once more than threshold failures happened within
+// window, and closes again after cooldown.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mx        sync.Mutex
+	failures  []time.Time
+	openUntil time.Time
+}
+
+func (cb *circuitBreaker) allow() bool {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	return !time.Now().Before(cb.openUntil)
+}
+
+func (cb *circuitBreaker) fail() {
+	now := time.Now()
+
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+
+	recent := cb.failures[:0]
+	for _, t := range cb.failures {
+		if now.Sub(t) < cb.window {
+			recent = append(recent, t)
+		}
+	}
+	cb.failures = append(recent, now)
+
+	if len(cb.failures) > cb.threshold {
+		cb.openUntil = now.Add(cb.cooldown)
+		cb.failures = nil
+	}
+}
+
+// SetStreamHandlerWithCircuitBreaker sets a protocol handler that stops taking
+// streams for cooldown once it failed more than threshold times within
+// window. Errors are reported to the opener of the stream as with
+// SetStreamHandlerWithError, and the streams refused while the circuit is
+// open fail with ErrCircuitOpen, without running the handler. After the
+// cooldown, the handler is given streams again and its failures are counted
+// from zero.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlerWithCircuitBreaker(pid protocol.ID, threshold int, window, cooldown time.Duration, handler func(network.Stream) error) {
+	cb := &circuitBreaker{threshold: threshold, window: window, cooldown: cooldown}
+	h.SetStreamHandlerWithError(pid, func(s network.Stream) error {
+		if !cb.allow() {
+			h.log.Debugf("circuit open for %s, refusing the stream from %s", pid, s.Conn().RemotePeer())
+			return ErrCircuitOpen
+		}
+		err := handler(s)
+		if err != nil {
+			cb.fail()
+		}
+		return err
+	})
+}
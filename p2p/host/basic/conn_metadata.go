@@ -0,0 +1,15 @@
+package basichost
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// ConnectionMetadata returns the metadata store of c, where applications can
+// keep per-connection state such as session tokens or negotiated
+// capabilities. The store is dropped once c is closed.
+func (h *BasicHost) ConnectionMetadata(c network.Conn) *sync.Map {
+	v, _ := h.connMetadata.LoadOrStore(c, new(sync.Map))
+	return v.(*sync.Map)
+}
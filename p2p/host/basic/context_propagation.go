@@ -0,0 +1,44 @@
+package basichost
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// propagatedValues are the values of the ContextPropagationKeys found in the
+// context of the call that established a connection.
+type propagatedValues struct {
+	keys, vals []interface{}
+}
+
+// recordContextValues records the values of the ContextPropagationKeys in ctx
+// for c, unless values were already recorded for it.
+func (h *BasicHost) recordContextValues(ctx context.Context, c network.Conn) {
+	if len(h.propagationKeys) == 0 {
+		return
+	}
+	var pv propagatedValues
+	for _, k := range h.propagationKeys {
+		if v := ctx.Value(k); v != nil {
+			pv.keys = append(pv.keys, k)
+			pv.vals = append(pv.vals, v)
+		}
+	}
+	if len(pv.keys) > 0 {
+		h.connCtxValues.LoadOrStore(c, &pv)
+	}
+}
+
+// propagateContextValues returns ctx with the values recorded for c.
+func (h *BasicHost) propagateContextValues(ctx context.Context, c network.Conn) context.Context {
+	v, ok := h.connCtxValues.Load(c)
+	if !ok {
+		return ctx
+	}
+	pv := v.(*propagatedValues)
+	for i, k := range pv.keys {
+		ctx = context.WithValue(ctx, k, pv.vals[i])
+	}
+	return ctx
+}
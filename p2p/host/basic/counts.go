@@ -0,0 +1,56 @@
+package basichost
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+)
+
+// StreamCount returns the number of streams currently open, in both
+// directions, without iterating over the connections of the network.
+func (h *BasicHost) StreamCount() int {
+	return int(atomic.LoadInt32(&h.numStreams))
+}
+
+// ConnectionCount returns the number of connections currently open, in both
+// directions, without iterating over the network.
+func (h *BasicHost) ConnectionCount() int {
+	return int(atomic.LoadInt32(&h.numConns))
+}
+
+// ForEachConn calls f with each open connection until it returns false,
+// without allocating a snapshot of the connections like Network().Conns().
+// Connections opened or closed during the iteration may or may not be
+// visited. f may close connections.
+func (h *BasicHost) ForEachConn(f func(network.Conn) bool) {
+	h.conns.Range(func(k, _ interface{}) bool {
+		return f(k.(network.Conn))
+	})
+}
+
+// ForEachPeer calls f with each connected peer until it returns false, like
+// ForEachConn.
+func (h *BasicHost) ForEachPeer(f func(peer.ID) bool) {
+	h.peers.Range(func(k, _ interface{}) bool {
+		return f(k.(peer.ID))
+	})
+}
+
+// ConnectedSince returns the time the first connection to p was opened, since
+// which we kept at least one connection to p open. It returns
+// identify.ErrNotConnected if we aren't connected to p.
+func (h *BasicHost) ConnectedSince(p peer.ID) (time.Time, error) {
+	v, ok := h.connectedSince.Load(p)
+	if !ok {
+		return time.Time{}, identify.ErrNotConnected
+	}
+	return v.(time.Time), nil
+}
+
+func (h *BasicHost) openedStreamNotify(_ network.Network, _ network.Stream) {
+	atomic.AddInt32(&h.numStreams, 1)
+}
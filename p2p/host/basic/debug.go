@@ -0,0 +1,143 @@
+package basichost
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/jbenet/goprocess"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DebugHTTPPrefix is the path prefix of the debug endpoints served by
+// BasicHost.ServeHTTP.
+const DebugHTTPPrefix = "/debug/libp2p/"
+
+type debugPeer struct {
+	ID    string   `json:"id"`
+	Addrs []string `json:"addrs"`
+}
+
+type debugStream struct {
+	Peer      string `json:"peer"`
+	Protocol  string `json:"protocol"`
+	Direction string `json:"direction"`
+}
+
+type debugAddrs struct {
+	Listen     []string `json:"listen"`
+	Advertised []string `json:"advertised"`
+}
+
+// ServeHTTP serves a JSON snapshot of the host state for debugging:
+//
+//   /debug/libp2p/peers      connected peers and their connection addresses
+//   /debug/libp2p/protocols  protocols we handle
+//   /debug/libp2p/streams    open streams
+//   /debug/libp2p/addrs      listen and advertised addresses
+//
+// It's served on the loopback interface by the DebugHTTP option, and can be
+// mounted on any other server.
+func (h *BasicHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var v interface{}
+	switch r.URL.Path {
+	case DebugHTTPPrefix + "peers":
+		v = h.debugPeers()
+	case DebugHTTPPrefix + "protocols":
+		protos := h.Mux().Protocols()
+		sort.Strings(protos)
+		v = protos
+	case DebugHTTPPrefix + "streams":
+		v = h.debugStreams()
+	case DebugHTTPPrefix + "addrs":
+		v = debugAddrs{
+			Listen:     addrStrings(h.Network().ListenAddresses()),
+			Advertised: addrStrings(h.Addrs()),
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.log.Debugf("error writing debug response: %s", err)
+	}
+}
+
+func (h *BasicHost) debugPeers() []debugPeer {
+	peers := make([]debugPeer, 0)
+	for _, p := range h.Network().Peers() {
+		dp := debugPeer{ID: p.Pretty(), Addrs: make([]string, 0)}
+		for _, c := range h.Network().ConnsToPeer(p) {
+			dp.Addrs = append(dp.Addrs, c.RemoteMultiaddr().String())
+		}
+		peers = append(peers, dp)
+	}
+	return peers
+}
+
+func (h *BasicHost) debugStreams() []debugStream {
+	streams := make([]debugStream, 0)
+	for _, c := range h.Network().Conns() {
+		for _, s := range c.GetStreams() {
+			streams = append(streams, debugStream{
+				Peer:      c.RemotePeer().Pretty(),
+				Protocol:  string(s.Protocol()),
+				Direction: directionString(s.Stat().Direction),
+			})
+		}
+	}
+	return streams
+}
+
+func addrStrings(addrs []ma.Multiaddr) []string {
+	strs := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		strs = append(strs, a.String())
+	}
+	return strs
+}
+
+func directionString(d network.Direction) string {
+	switch d {
+	case network.DirInbound:
+		return "inbound"
+	case network.DirOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+// startDebugHTTP listens on the given loopback port and serves ServeHTTP
+// until the host closes.
+func (h *BasicHost) startDebugHTTP(port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for the debug HTTP server: %s", err)
+	}
+	h.debugAddr = l.Addr()
+
+	srv := &http.Server{Handler: h}
+	h.proc.Go(func(proc goprocess.Process) {
+		go func() {
+			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				h.log.Warnf("debug HTTP server failed: %s", err)
+			}
+		}()
+		<-proc.Closing()
+		srv.Close()
+	})
+	return nil
+}
+
+// DebugHTTPAddr returns the address of the debug HTTP server started by the
+// DebugHTTP option, or nil if it's disabled.
+func (h *BasicHost) DebugHTTPAddr() net.Addr {
+	return h.debugAddr
+}
@@ -0,0 +1,137 @@
+package basichost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// SetDefaultStreamHandler sets a handler for the inbound streams proposing a
+// protocol no other handler matches, instead of rejecting the protocol. The
+// handler gets the stream right after the multistream header was exchanged:
+// the first thing it reads is the unmatched, multistream-select encoded
+// protocol line, letting the application implement its own negotiation.
+// (Threadsafe)
+func (h *BasicHost) SetDefaultStreamHandler(handler network.StreamHandler) {
+	handle := h.muxHandler("", handler)
+
+	h.defaultHandlerMx.Lock()
+	h.defaultHandle = handle
+	h.defaultHandlerMx.Unlock()
+}
+
+// RemoveDefaultStreamHandler removes the handler set with
+// SetDefaultStreamHandler, unmatched protocols are rejected again.
+// (Threadsafe)
+func (h *BasicHost) RemoveDefaultStreamHandler() {
+	h.defaultHandlerMx.Lock()
+	h.defaultHandle = nil
+	h.defaultHandlerMx.Unlock()
+}
+
+func (h *BasicHost) defaultHandler() msmux.HandlerFunc {
+	h.defaultHandlerMx.RLock()
+	defer h.defaultHandlerMx.RUnlock()
+	return h.defaultHandle
+}
+
+// negotiateWithDefault performs the listener side of multistream-select on s,
+// like the NegotiateLazy of mux, but handing the stream to the default
+// stream handler dh when no handler of mux matches the proposed protocol.
+func (h *BasicHost) negotiateWithDefault(s network.Stream, mux *msmux.MultistreamMuxer, dh msmux.HandlerFunc) (io.ReadWriteCloser, string, msmux.HandlerFunc, error) {
+	tok, err := msmux.ReadNextToken(s)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if tok != msmux.ProtocolID {
+		return nil, "", nil, msmux.ErrIncorrectVersion
+	}
+	if err := delimWrite(s, []byte(msmux.ProtocolID)); err != nil {
+		return nil, "", nil, err
+	}
+
+	for {
+		tok, err := msmux.ReadNextToken(s)
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		if tok == "ls" {
+			if err := mux.Ls(s); err != nil {
+				return nil, "", nil, err
+			}
+			continue
+		}
+
+		handle, ok := lookupHandler(mux, tok)
+		if !ok {
+			// give the default handler the protocol line we consumed.
+			var line bytes.Buffer
+			if err := delimWrite(&line, []byte(tok)); err != nil {
+				return nil, "", nil, err
+			}
+			return &prefixedStream{Stream: s, r: io.MultiReader(&line, s)}, tok, dh, nil
+		}
+
+		if err := delimWrite(s, []byte(tok)); err != nil {
+			return nil, "", nil, err
+		}
+		return s, tok, handle, nil
+	}
+}
+
+// lookupHandler returns the handler the Host's Mux selects for proto.
+func (h *BasicHost) lookupHandler(proto string) (msmux.HandlerFunc, bool) {
+	return lookupHandler(h.mux, proto)
+}
+
+// lookupHandler returns the handler mux selects for proto by running an
+// in-memory negotiation against it.
+func lookupHandler(mux *msmux.MultistreamMuxer, proto string) (msmux.HandlerFunc, bool) {
+	var in bytes.Buffer
+	if err := delimWrite(&in, []byte(msmux.ProtocolID)); err != nil {
+		return nil, false
+	}
+	if err := delimWrite(&in, []byte(proto)); err != nil {
+		return nil, false
+	}
+
+	_, _, handle, err := mux.NegotiateLazy(lookupConn{&in})
+	if err != nil {
+		return nil, false
+	}
+	return handle, true
+}
+
+// lookupConn feeds a canned negotiation to the muxer, discarding its replies.
+type lookupConn struct {
+	io.Reader
+}
+
+func (lookupConn) Write(b []byte) (int, error) { return len(b), nil }
+func (lookupConn) Close() error                { return nil }
+
+// delimWrite writes a multistream-select message.
+func delimWrite(w io.Writer, msg []byte) error {
+	buf := make([]byte, binary.MaxVarintLen64+len(msg)+1)
+	n := binary.PutUvarint(buf, uint64(len(msg)+1))
+	n += copy(buf[n:], msg)
+	buf[n] = '\n'
+	_, err := w.Write(buf[:n+1])
+	return err
+}
+
+// prefixedStream is a stream whose reads are served by r, typically data
+// already read from the stream followed by the stream itself.
+type prefixedStream struct {
+	network.Stream
+	r io.Reader
+}
+
+func (s *prefixedStream) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
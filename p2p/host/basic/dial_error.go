@@ -0,0 +1,75 @@
+package basichost
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DialError is returned by Connect when dialing all the addresses of a peer
+// failed. It unwraps to one AddrDialError per address the swarm reported.
+type DialError struct {
+	Peer   peer.ID
+	Errors []AddrDialError
+	// Cause is the error that ended the dial, if any, e.g. the context
+	// expiring.
+	Cause error
+}
+
+func (e *DialError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "failed to dial %s:", e.Peer)
+	if e.Cause != nil {
+		fmt.Fprintf(&b, " %s", e.Cause)
+	}
+	for _, ae := range e.Errors {
+		fmt.Fprintf(&b, "\n  * [%s] %s", ae.Addr, ae.Err)
+	}
+	return b.String()
+}
+
+// Unwrap returns the per-address errors, and the cause, if any, so that
+// errors.As and errors.Is see them.
+func (e *DialError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors)+1)
+	for _, ae := range e.Errors {
+		errs = append(errs, ae)
+	}
+	if e.Cause != nil {
+		errs = append(errs, e.Cause)
+	}
+	return errs
+}
+
+// AddrDialError is the error dialing a single address of a peer.
+type AddrDialError struct {
+	Addr ma.Multiaddr
+	Err  error
+}
+
+func (e AddrDialError) Error() string {
+	return fmt.Sprintf("failed to dial %s: %s", e.Addr, e.Err)
+}
+
+func (e AddrDialError) Unwrap() error {
+	return e.Err
+}
+
+// dialError turns the dial error of the swarm into a DialError when it
+// carries per-address errors. Other errors are returned as is.
+func dialError(p peer.ID, err error) error {
+	var serr *swarm.DialError
+	if !errors.As(err, &serr) || len(serr.DialErrors) == 0 {
+		return err
+	}
+	derr := &DialError{Peer: p, Cause: serr.Cause}
+	for _, te := range serr.DialErrors {
+		derr.Errors = append(derr.Errors, AddrDialError{Addr: te.Address, Err: te.Cause})
+	}
+	return derr
+}
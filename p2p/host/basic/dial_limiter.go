@@ -0,0 +1,172 @@
+package basichost
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DialStats reports the state of the outbound dial limiter of a host. See
+// HostOpts.MaxConcurrentDials and HostOpts.MaxConcurrentDialsPerPeer.
+type DialStats struct {
+	// Active is the number of dials currently in progress.
+	Active int
+	// Queued is the number of Connect calls currently waiting for a slot.
+	Queued int
+	// TotalQueued is the number of Connect calls that had to wait for a
+	// slot so far.
+	TotalQueued uint64
+	// TotalWaitTime is the cumulative time Connect calls spent waiting.
+	TotalWaitTime time.Duration
+	// MaxWaitTime is the longest time a Connect call spent waiting.
+	MaxWaitTime time.Duration
+}
+
+type dialWaiter struct {
+	p     peer.ID
+	ready chan struct{}
+}
+
+// dialLimiter bounds the number of concurrent outbound dials, globally and
+// per peer. Waiting dials are admitted in FIFO order; a dial blocked by its
+// peer's limit doesn't hold up dials to other peers.
+type dialLimiter struct {
+	limit        int
+	perPeerLimit int
+
+	mx         sync.Mutex
+	active     int
+	activePeer map[peer.ID]int
+	waiting    *list.List
+
+	totalQueued   uint64
+	totalWaitTime time.Duration
+	maxWaitTime   time.Duration
+}
+
+// newDialLimiter creates a dialLimiter. A limit of 0 means unlimited.
+func newDialLimiter(limit, perPeerLimit int) *dialLimiter {
+	return &dialLimiter{
+		limit:        limit,
+		perPeerLimit: perPeerLimit,
+		activePeer:   make(map[peer.ID]int),
+		waiting:      list.New(),
+	}
+}
+
+func (dl *dialLimiter) canDial(p peer.ID) bool {
+	return (dl.limit <= 0 || dl.active < dl.limit) &&
+		(dl.perPeerLimit <= 0 || dl.activePeer[p] < dl.perPeerLimit)
+}
+
+func (dl *dialLimiter) admit(p peer.ID) {
+	dl.active++
+	dl.activePeer[p]++
+}
+
+// acquire blocks until a dial to p may proceed or ctx is done. Every
+// successful acquire must be followed by a release.
+func (dl *dialLimiter) acquire(ctx context.Context, p peer.ID) error {
+	dl.mx.Lock()
+	if dl.waiting.Len() == 0 && dl.canDial(p) {
+		dl.admit(p)
+		dl.mx.Unlock()
+		return nil
+	}
+
+	w := &dialWaiter{p: p, ready: make(chan struct{})}
+	e := dl.waiting.PushBack(w)
+	dl.totalQueued++
+	// a waiter may be blocked by its peer's limit only.
+	dl.admitWaiting()
+	dl.mx.Unlock()
+
+	start := time.Now()
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+	}
+
+	dl.mx.Lock()
+	defer dl.mx.Unlock()
+
+	wait := time.Since(start)
+	dl.totalWaitTime += wait
+	if wait > dl.maxWaitTime {
+		dl.maxWaitTime = wait
+	}
+
+	select {
+	case <-w.ready:
+		return nil
+	default:
+	}
+	dl.waiting.Remove(e)
+	return ctx.Err()
+}
+
+// release frees the slot of a dial to p.
+func (dl *dialLimiter) release(p peer.ID) {
+	dl.mx.Lock()
+	defer dl.mx.Unlock()
+
+	dl.active--
+	if dl.activePeer[p]--; dl.activePeer[p] <= 0 {
+		delete(dl.activePeer, p)
+	}
+	dl.admitWaiting()
+}
+
+// admitWaiting admits, in order, the waiting dials that may proceed.
+func (dl *dialLimiter) admitWaiting() {
+	for e := dl.waiting.Front(); e != nil; {
+		next := e.Next()
+		w := e.Value.(*dialWaiter)
+		if dl.limit > 0 && dl.active >= dl.limit {
+			return
+		}
+		if dl.canDial(w.p) {
+			dl.waiting.Remove(e)
+			dl.admit(w.p)
+			close(w.ready)
+		}
+		e = next
+	}
+}
+
+// setLimits changes the limits, admitting the waiting dials that may now
+// proceed.
+func (dl *dialLimiter) setLimits(limit, perPeerLimit int) {
+	dl.mx.Lock()
+	defer dl.mx.Unlock()
+
+	dl.limit = limit
+	dl.perPeerLimit = perPeerLimit
+	dl.admitWaiting()
+}
+
+func (dl *dialLimiter) stats() DialStats {
+	dl.mx.Lock()
+	defer dl.mx.Unlock()
+
+	return DialStats{
+		Active:        dl.active,
+		Queued:        dl.waiting.Len(),
+		TotalQueued:   dl.totalQueued,
+		TotalWaitTime: dl.totalWaitTime,
+		MaxWaitTime:   dl.maxWaitTime,
+	}
+}
+
+// DialStats returns statistics about the outbound dial limiter. All values
+// are zero when no limit is configured.
+func (h *BasicHost) DialStats() DialStats {
+	dl := h.getDialLimiter()
+	if dl == nil {
+		return DialStats{}
+	}
+	return dl.stats()
+}
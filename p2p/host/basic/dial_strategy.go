@@ -0,0 +1,54 @@
+package basichost
+
+import (
+	"math/rand"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// DialStrategy selects the connection to a peer new streams are opened on.
+// SelectConn is called with the open connections to the peer, oldest first,
+// and may return nil to let the network pick one.
+type DialStrategy interface {
+	SelectConn([]network.Conn) network.Conn
+}
+
+// DialStrategyFunc is a function implementing DialStrategy.
+type DialStrategyFunc func([]network.Conn) network.Conn
+
+// SelectConn calls f(conns).
+func (f DialStrategyFunc) SelectConn(conns []network.Conn) network.Conn {
+	return f(conns)
+}
+
+var (
+	// LeastLoadedConn selects the connection with the fewest open streams,
+	// the newest one among equally loaded connections.
+	LeastLoadedConn DialStrategy = DialStrategyFunc(func(conns []network.Conn) network.Conn {
+		var best network.Conn
+		bestLen := 0
+		for _, c := range conns {
+			if n := len(c.GetStreams()); best == nil || n <= bestLen {
+				best, bestLen = c, n
+			}
+		}
+		return best
+	})
+
+	// MostRecentConn selects the newest connection.
+	MostRecentConn DialStrategy = DialStrategyFunc(func(conns []network.Conn) network.Conn {
+		if len(conns) == 0 {
+			return nil
+		}
+		return conns[len(conns)-1]
+	})
+
+	// RandomConn selects a random connection, spreading the streams over
+	// all the connections.
+	RandomConn DialStrategy = DialStrategyFunc(func(conns []network.Conn) network.Conn {
+		if len(conns) == 0 {
+			return nil
+		}
+		return conns[rand.Intn(len(conns))]
+	})
+)
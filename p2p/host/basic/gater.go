@@ -0,0 +1,52 @@
+package basichost
+
+import (
+	"errors"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ErrGaterDisallowedConnection is returned by Connect when the connection
+// gater refuses to let us dial the peer.
+var ErrGaterDisallowedConnection = errors.New("gater disallows connection to peer")
+
+// ConnectionGater lets applications allow or deny connections at the host
+// level. See HostOpts.ConnectionGater.
+//
+// The host doesn't hook into the swarm: the dials the network makes on its
+// own, e.g. when NewStream isn't connected to the peer, aren't gated, and
+// inbound connections are only gated once they are fully established.
+type ConnectionGater interface {
+	// InterceptPeerDial tests whether Connect is permitted to dial the peer.
+	InterceptPeerDial(p peer.ID) (allow bool)
+
+	// InterceptAddrDial tests whether Connect is permitted to dial the peer
+	// on the given address. Only the addresses passed to Connect are
+	// filtered: the ones the peerstore already knows are still dialed. It's
+	// also used to filter the addresses produced by the AddrsFactory of the
+	// host, with p being the local peer.
+	InterceptAddrDial(p peer.ID, addr ma.Multiaddr) (allow bool)
+
+	// InterceptAccept tests whether an inbound connection is allowed. It's
+	// called after the connection was secured and upgraded, and the
+	// connection is closed when it returns false.
+	InterceptAccept(cm network.ConnMultiaddrs) (allow bool)
+}
+
+// gateAddrs returns the addresses of p the gater allows us to dial.
+func (h *BasicHost) gateAddrs(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	if h.gater == nil {
+		return addrs
+	}
+
+	allowed := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if h.gater.InterceptAddrDial(p, a) {
+			allowed = append(allowed, a)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,180 @@
+package basichost
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// maxHandlerErrorSize is the maximum size of an error message sent to the
+// opener of a stream. Longer messages are truncated.
+const maxHandlerErrorSize = 1024
+
+// handlerErrorMarker starts a handler error frame. A multistream token is
+// never empty, so a zero length prefix can't be mistaken for one.
+const handlerErrorMarker = 0x00
+
+// StreamHandlerError is returned by the first Read on a stream opened with
+// NewStream, for a protocol EnableHandlerErrors was called for, when the
+// remote handler, registered with SetStreamHandlerWithError, failed before
+// writing anything to the stream.
+type StreamHandlerError struct {
+	Protocol protocol.ID
+	Message  string
+}
+
+func (e *StreamHandlerError) Error() string {
+	return fmt.Sprintf("remote stream handler for %s failed: %s", e.Protocol, e.Message)
+}
+
+// EnableHandlerErrors makes the streams we open for the given protocols
+// surface the errors of the remote handlers as *StreamHandlerError. The
+// error frames are sent in band, so the opener of a stream must enable them
+// for protocols served with SetStreamHandlerWithError; the first data read
+// from the streams of other protocols is left untouched.
+// (Threadsafe)
+func (h *BasicHost) EnableHandlerErrors(pids ...protocol.ID) {
+	h.handlerErrorProtos.add(pids...)
+}
+
+// SetStreamHandlerWithError sets a protocol handler that can report errors
+// to the opener of the stream. When the handler returns a non-nil error
+// without having written to the stream, a varint-framed error message is sent
+// to the remote peer, which surfaces it as a *StreamHandlerError if it called
+// EnableHandlerErrors for pid, and the stream is reset once the remote peer
+// read it. If the handler already wrote to the stream, the stream is simply
+// reset. A nil error leaves the stream as the handler left it. It also
+// enables handler errors for the streams we open for pid.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlerWithError(pid protocol.ID, handler func(network.Stream) error) {
+	h.EnableHandlerErrors(pid)
+	h.SetStreamHandler(pid, func(s network.Stream) {
+		ws := &writeTrackingStream{Stream: s}
+		err := handler(ws)
+		if err == nil {
+			return
+		}
+
+		h.log.Debugf("stream handler for %s failed: %s", pid, err)
+		if ws.written {
+			s.Reset()
+			return
+		}
+		if _, err := s.Write(encodeHandlerError(err)); err != nil {
+			s.Reset()
+			return
+		}
+		go resetAfterRemote(s)
+	})
+}
+
+func encodeHandlerError(err error) []byte {
+	msg := err.Error()
+	if len(msg) > maxHandlerErrorSize {
+		msg = msg[:maxHandlerErrorSize]
+	}
+
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(msg))
+	buf[0] = handlerErrorMarker
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(msg)))
+	n += copy(buf[n:], msg)
+	return buf[:n]
+}
+
+// writeTrackingStream records whether a handler wrote to its stream.
+type writeTrackingStream struct {
+	network.Stream
+	written bool
+}
+
+func (s *writeTrackingStream) Write(b []byte) (int, error) {
+	if len(b) > 0 {
+		s.written = true
+	}
+	return s.Stream.Write(b)
+}
+
+// handlerErrorStream checks whether an outbound stream starts with a handler
+// error frame, resetting the stream when it does. The frame may come in any
+// number of reads; when the first byte is a frame marker, it reads until the
+// frame is complete or turns out not to be one.
+type handlerErrorStream struct {
+	network.Stream
+
+	checked bool
+	pending []byte
+	err     error
+}
+
+func (s *handlerErrorStream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return s.Stream.Read(b)
+	}
+
+	if !s.checked {
+		s.checked = true
+		s.err = s.check()
+		if _, ok := s.err.(*StreamHandlerError); ok {
+			return 0, s.err
+		}
+	}
+
+	if len(s.pending) > 0 {
+		n := copy(b, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.Stream.Read(b)
+}
+
+// check reads the handler error frame starting the stream, if any, and
+// returns it as a *StreamHandlerError. The bytes read that turn out not to
+// be a frame are kept in pending, and a read error is returned once they
+// are consumed.
+func (s *handlerErrorStream) check() error {
+	var (
+		one     [1]byte
+		readErr error
+	)
+	readByte := byteReaderFunc(func() (byte, error) {
+		if _, readErr = io.ReadFull(s.Stream, one[:]); readErr != nil {
+			return 0, readErr
+		}
+		s.pending = append(s.pending, one[0])
+		return one[0], nil
+	})
+
+	if b, err := readByte(); err != nil || b != handlerErrorMarker {
+		return err
+	}
+	l, err := binary.ReadUvarint(readByte)
+	if err != nil || l > maxHandlerErrorSize {
+		// only a read error is an error, the rest is data.
+		return readErr
+	}
+	msg := make([]byte, l)
+	n, err := io.ReadFull(s.Stream, msg)
+	s.pending = append(s.pending, msg[:n]...)
+	if err == io.ErrUnexpectedEOF {
+		// a truncated frame is data.
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+
+	s.pending = nil
+	s.Stream.Reset()
+	return &StreamHandlerError{Protocol: s.Protocol(), Message: string(msg)}
+}
+
+// byteReaderFunc adapts a function to io.ByteReader.
+type byteReaderFunc func() (byte, error)
+
+func (f byteReaderFunc) ReadByte() (byte, error) { return f() }
@@ -0,0 +1,115 @@
+package basichost
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	ggio "github.com/gogo/protobuf/io"
+	proto "github.com/gogo/protobuf/proto"
+)
+
+// healthCheckTimeout bounds the time a HealthChecker may take to answer a
+// remote peer.
+const healthCheckTimeout = time.Second * 10
+
+// maxHealthCheckResponseSize is the maximum size of an encoded health check
+// response.
+const maxHealthCheckResponseSize = 4096
+
+const (
+	healthServing    int32 = 0
+	healthNotServing int32 = 1
+)
+
+// HealthChecker reports the health of a service.
+type HealthChecker interface {
+	Check(context.Context) error
+}
+
+// HealthCheckError is returned by CheckPeerHealth when the remote peer
+// reports that it isn't healthy.
+type HealthCheckError struct {
+	Peer    peer.ID
+	Message string
+}
+
+func (e *HealthCheckError) Error() string {
+	return fmt.Sprintf("peer %s is unhealthy: %s", e.Peer, e.Message)
+}
+
+// healthCheckResponse is sent by the health check handler as soon as a
+// stream is opened. It's the varint length-prefixed encoding of:
+//
+//   message HealthCheckResponse {
+//     enum Status {
+//       SERVING = 0;
+//       NOT_SERVING = 1;
+//     }
+//     Status status = 1;
+//     string error = 2;
+//   }
+type healthCheckResponse struct {
+	Status int32  `protobuf:"varint,1,opt,name=status,proto3"`
+	Error  string `protobuf:"bytes,2,opt,name=error,proto3"`
+}
+
+func (m *healthCheckResponse) Reset()         { *m = healthCheckResponse{} }
+func (m *healthCheckResponse) String() string { return proto.CompactTextString(m) }
+func (*healthCheckResponse) ProtoMessage()    {}
+
+// RegisterHealthCheck sets a handler for pid answering remote peers with the
+// result of hc, see CheckPeerHealth.
+// (Threadsafe)
+func (h *BasicHost) RegisterHealthCheck(pid protocol.ID, hc HealthChecker) {
+	h.SetStreamHandler(pid, func(s network.Stream) {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		defer cancel()
+
+		resp := &healthCheckResponse{Status: healthServing}
+		if err := hc.Check(ctx); err != nil {
+			resp.Status = healthNotServing
+			resp.Error = err.Error()
+		}
+
+		if err := ggio.NewDelimitedWriter(s).WriteMsg(resp); err != nil {
+			h.log.Debugf("error writing health check response: %s", err)
+			s.Reset()
+			return
+		}
+		go helpers.FullClose(s)
+	})
+}
+
+// CheckPeerHealth asks p for its health through the health check protocol
+// pid. It returns a *HealthCheckError if p reports that it isn't healthy.
+func (h *BasicHost) CheckPeerHealth(ctx context.Context, p peer.ID, pid protocol.ID) error {
+	s, err := h.NewStream(ctx, p, pid)
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := s.SetReadDeadline(deadline); err != nil {
+			s.Reset()
+			return err
+		}
+	}
+
+	var resp healthCheckResponse
+	if err := ggio.NewDelimitedReader(s, maxHealthCheckResponseSize).ReadMsg(&resp); err != nil {
+		s.Reset()
+		return err
+	}
+	go helpers.FullClose(s)
+
+	if resp.Status != healthServing {
+		return &HealthCheckError{Peer: p, Message: resp.Error}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package basichost
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// StreamInterceptor is given every stream once its protocol is negotiated,
+// before an inbound stream is handed to its handler or an outbound stream is
+// returned by NewStream. It returns the stream to use instead, e.g. wrapping
+// it for compression or audit logging. When it returns an error, the stream
+// is reset: inbound streams are dropped and NewStream fails with the error.
+type StreamInterceptor interface {
+	Intercept(dir network.Direction, s network.Stream) (network.Stream, error)
+}
+
+// StreamInterceptorFunc is a function implementing StreamInterceptor.
+type StreamInterceptorFunc func(network.Direction, network.Stream) (network.Stream, error)
+
+// Intercept calls f(dir, s).
+func (f StreamInterceptorFunc) Intercept(dir network.Direction, s network.Stream) (network.Stream, error) {
+	return f(dir, s)
+}
+
+// interceptedStream is a stream returned by the StreamInterceptor. It keeps
+// the stream the interceptor was given for baseStream.
+type interceptedStream struct {
+	network.Stream
+	orig network.Stream
+}
+
+// interceptStream runs the StreamInterceptor, if any, on s, resetting s when
+// it fails.
+func (h *BasicHost) interceptStream(dir network.Direction, s network.Stream) (network.Stream, error) {
+	if h.interceptor == nil {
+		return s, nil
+	}
+	is, err := h.interceptor.Intercept(dir, s)
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+	if is != s {
+		is = &interceptedStream{Stream: is, orig: s}
+	}
+	return is, nil
+}
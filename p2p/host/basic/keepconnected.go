@@ -0,0 +1,209 @@
+package basichost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	// DefaultReconnectInitialBackoff is the default value of
+	// WithInitialBackoff.
+	DefaultReconnectInitialBackoff = time.Second
+
+	// DefaultReconnectMaxBackoff is the default value of WithMaxBackoff.
+	DefaultReconnectMaxBackoff = time.Minute
+
+	// DefaultReconnectMinUptime is the default value of WithMinUptime.
+	DefaultReconnectMinUptime = 10 * time.Second
+)
+
+var errHostClosed = errors.New("host closed")
+
+type reconnectConfig struct {
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	minUptime      time.Duration
+	maxAttempts    int
+}
+
+// ReconnectOption configures KeepConnected.
+type ReconnectOption func(*reconnectConfig)
+
+// WithInitialBackoff sets the time to wait after the first failed attempt to
+// reconnect. It doubles after every subsequent failure.
+func WithInitialBackoff(d time.Duration) ReconnectOption {
+	return func(cfg *reconnectConfig) {
+		cfg.initialBackoff = d
+	}
+}
+
+// WithMaxBackoff caps the time to wait between attempts to reconnect.
+func WithMaxBackoff(d time.Duration) ReconnectOption {
+	return func(cfg *reconnectConfig) {
+		cfg.maxBackoff = d
+	}
+}
+
+// WithMinUptime sets how long a connection must stay up for the backoff to be
+// reset to its initial value when it drops. Connections dropped sooner are
+// redialed after the current backoff, which keeps growing, so that a peer
+// closing every connection right away isn't redialed in a tight loop.
+func WithMinUptime(d time.Duration) ReconnectOption {
+	return func(cfg *reconnectConfig) {
+		cfg.minUptime = d
+	}
+}
+
+// WithMaxAttempts sets the number of consecutive failed attempts to reconnect
+// after which KeepConnected gives up. By default, it never does.
+func WithMaxAttempts(n int) ReconnectOption {
+	return func(cfg *reconnectConfig) {
+		cfg.maxAttempts = n
+	}
+}
+
+type keepConnectedLoop struct {
+	cancel context.CancelFunc
+}
+
+// KeepConnected connects to pi and redials it, with exponential backoff,
+// every time the connection drops. The backoff is reset once a connection
+// stayed up for the minimum uptime (see WithMinUptime). It blocks until ctx is cancelled or
+// StopKeepConnected is called for pi.ID, in which case it returns nil, or
+// until it gives up reconnecting (see WithMaxAttempts) or the host is closed.
+func (h *BasicHost) KeepConnected(ctx context.Context, pi peer.AddrInfo, opts ...ReconnectOption) error {
+	cfg := reconnectConfig{
+		initialBackoff: DefaultReconnectInitialBackoff,
+		maxBackoff:     DefaultReconnectMaxBackoff,
+		minUptime:      DefaultReconnectMinUptime,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	loop := &keepConnectedLoop{cancel: cancel}
+	h.keepConnectedMx.Lock()
+	if _, ok := h.keepConnected[pi.ID]; ok {
+		h.keepConnectedMx.Unlock()
+		return fmt.Errorf("already keeping connected to %s", pi.ID)
+	}
+	h.keepConnected[pi.ID] = loop
+	h.keepConnectedMx.Unlock()
+
+	defer func() {
+		h.keepConnectedMx.Lock()
+		if h.keepConnected[pi.ID] == loop {
+			delete(h.keepConnected, pi.ID)
+		}
+		h.keepConnectedMx.Unlock()
+	}()
+
+	disconnected := make(chan struct{}, 1)
+	notifee := &network.NotifyBundle{
+		DisconnectedF: func(_ network.Network, c network.Conn) {
+			if c.RemotePeer() != pi.ID {
+				return
+			}
+			select {
+			case disconnected <- struct{}{}:
+			default:
+			}
+		},
+	}
+	h.Network().Notify(notifee)
+	defer h.Network().StopNotify(notifee)
+
+	backoff := cfg.initialBackoff
+	attempts := 0
+
+	// pause waits for the current backoff and doubles it. It returns true,
+	// along with the error to return, when the loop must stop.
+	pause := func() (bool, error) {
+		t := time.NewTimer(backoff)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return true, nil
+		case <-h.proc.Closing():
+			return true, errHostClosed
+		}
+
+		backoff *= 2
+		if backoff > cfg.maxBackoff {
+			backoff = cfg.maxBackoff
+		}
+		return false, nil
+	}
+
+	var connectedAt time.Time
+	for {
+		if h.Network().Connectedness(pi.ID) == network.Connected {
+			if connectedAt.IsZero() {
+				connectedAt = time.Now()
+			}
+			// wait for a disconnection.
+			select {
+			case <-disconnected:
+				continue
+			case <-ctx.Done():
+				return nil
+			case <-h.proc.Closing():
+				return errHostClosed
+			}
+		}
+
+		if !connectedAt.IsZero() {
+			// the connection dropped.
+			if time.Since(connectedAt) >= cfg.minUptime {
+				backoff = cfg.initialBackoff
+			}
+			connectedAt = time.Time{}
+			h.log.Debugf("disconnected from %s, reconnecting in %s", pi.ID, backoff)
+			if stop, err := pause(); stop {
+				return err
+			}
+			continue
+		}
+
+		err := h.Connect(ctx, pi)
+		if err == nil {
+			// the connection may already be gone by now, which counts
+			// as a dropped connection.
+			attempts = 0
+			connectedAt = time.Now()
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		attempts++
+		if cfg.maxAttempts > 0 && attempts >= cfg.maxAttempts {
+			return fmt.Errorf("failed to reconnect to %s after %d attempts: %s", pi.ID, attempts, err)
+		}
+		h.log.Debugf("failed to reconnect to %s, retrying in %s: %s", pi.ID, backoff, err)
+		if stop, err := pause(); stop {
+			return err
+		}
+	}
+}
+
+// StopKeepConnected stops the KeepConnected loop for p, if any. It doesn't
+// close the connections to p.
+func (h *BasicHost) StopKeepConnected(p peer.ID) {
+	h.keepConnectedMx.Lock()
+	defer h.keepConnectedMx.Unlock()
+	if loop, ok := h.keepConnected[p]; ok {
+		loop.cancel()
+		delete(h.keepConnected, p)
+	}
+}
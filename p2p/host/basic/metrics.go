@@ -0,0 +1,129 @@
+package basichost
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "libp2p_host"
+
+// hostMetrics holds the Prometheus collectors updated by the host when
+// HostOpts.PrometheusRegisterer is set. All methods are no-ops on a nil
+// *hostMetrics.
+type hostMetrics struct {
+	streamsOpened    *prometheus.CounterVec
+	activeConns      *prometheus.GaugeVec
+	identifyDuration prometheus.Histogram
+	addrChanges      prometheus.Counter
+}
+
+// newHostMetrics registers the collectors of the host on r. Collectors
+// already registered, e.g. by another host, are reused.
+func newHostMetrics(r prometheus.Registerer) (*hostMetrics, error) {
+	streamsOpened, err := registerCollector(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "streams_opened_total",
+		Help:      "Number of streams opened, by protocol and direction.",
+	}, []string{"protocol", "direction"}))
+	if err != nil {
+		return nil, err
+	}
+	activeConns, err := registerCollector(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections_active",
+		Help:      "Number of open connections, by transport.",
+	}, []string{"transport"}))
+	if err != nil {
+		return nil, err
+	}
+	identifyDuration, err := registerCollector(r, prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "identify_duration_seconds",
+		Help:      "Time taken to identify new connections.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	addrChanges, err := registerCollector(r, prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "address_changes_total",
+		Help:      "Number of changes of the addresses of the host.",
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &hostMetrics{
+		streamsOpened:    streamsOpened.(*prometheus.CounterVec),
+		activeConns:      activeConns.(*prometheus.GaugeVec),
+		identifyDuration: identifyDuration.(prometheus.Histogram),
+		addrChanges:      addrChanges.(prometheus.Counter),
+	}, nil
+}
+
+// registerCollector registers c on r, returning the collector registered
+// before if there's one.
+func registerCollector(r prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	if err := r.Register(c); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		return are.ExistingCollector, nil
+	}
+	return c, nil
+}
+
+func (m *hostMetrics) streamOpened(proto protocol.ID, dir network.Direction) {
+	if m == nil {
+		return
+	}
+	d := "inbound"
+	if dir == network.DirOutbound {
+		d = "outbound"
+	}
+	m.streamsOpened.WithLabelValues(string(proto), d).Inc()
+}
+
+func (m *hostMetrics) connOpened(c network.Conn) {
+	if m == nil {
+		return
+	}
+	m.activeConns.WithLabelValues(connTransport(c)).Inc()
+}
+
+func (m *hostMetrics) connClosed(c network.Conn) {
+	if m == nil {
+		return
+	}
+	m.activeConns.WithLabelValues(connTransport(c)).Dec()
+}
+
+func (m *hostMetrics) identified(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.identifyDuration.Observe(d.Seconds())
+}
+
+func (m *hostMetrics) addrsChanged() {
+	if m == nil {
+		return
+	}
+	m.addrChanges.Inc()
+}
+
+// connTransport returns the name of the outermost protocol of the remote
+// address of c, e.g. "tcp", "quic" or "ws".
+func connTransport(c network.Conn) string {
+	protos := c.RemoteMultiaddr().Protocols()
+	if len(protos) == 0 {
+		return "unknown"
+	}
+	return protos[len(protos)-1].Name
+}
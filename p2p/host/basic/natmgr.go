@@ -44,14 +44,16 @@ type natManager struct {
 	ready chan struct{} // closed once the nat is ready to process port mappings
 
 	syncMu sync.Mutex
+	synced chan struct{} // signaled after the port mappings were synced
 
 	proc goprocess.Process // natManager has a process + children. can be closed.
 }
 
 func newNatManager(net network.Network) *natManager {
 	nmgr := &natManager{
-		net:   net,
-		ready: make(chan struct{}),
+		net:    net,
+		ready:  make(chan struct{}),
+		synced: make(chan struct{}, 1),
 	}
 
 	nmgr.proc = goprocess.WithTeardown(func() error {
@@ -177,7 +179,13 @@ func (nmgr *natManager) sync() {
 		}
 
 		var wg sync.WaitGroup
-		defer wg.Wait()
+		defer func() {
+			wg.Wait()
+			select {
+			case nmgr.synced <- struct{}{}:
+			default:
+			}
+		}()
 
 		// Close old mappings
 		for _, m := range nat.Mappings() {
@@ -214,6 +222,12 @@ func (nmgr *natManager) sync() {
 	})
 }
 
+// syncedChan is signaled each time the port mappings have been synced, so
+// the host can advertise new external addresses right away.
+func (nmgr *natManager) syncedChan() <-chan struct{} {
+	return nmgr.synced
+}
+
 // NAT returns the natManager's nat object. this may be nil, if
 // (a) the search process is still ongoing, or (b) the search process
 // found no nat. Clients must check whether the return value is nil.
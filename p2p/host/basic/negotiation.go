@@ -0,0 +1,86 @@
+package basichost
+
+import (
+	"bytes"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// EvtStreamNegotiationFailed is emitted on the host's event bus when the
+// protocol negotiation of an inbound stream fails, e.g. because we don't
+// handle any of the protocols the remote peer offered, or when the remote
+// peer isn't allowed to use the negotiated protocol.
+type EvtStreamNegotiationFailed struct {
+	RemotePeer peer.ID
+	// Offered are the protocols the remote peer offered, in order. For
+	// AuthRejected, it's the negotiated protocol.
+	Offered []protocol.ID
+	Err     error
+	Reason  NegotiationFailureReason
+}
+
+// NegotiationFailureReason tells why an inbound stream was rejected, see
+// EvtStreamNegotiationFailed.
+type NegotiationFailureReason int
+
+const (
+	// NegotiationFailed means that no protocol could be negotiated.
+	NegotiationFailed NegotiationFailureReason = iota
+	// AuthRejected means that the remote peer isn't allowed to use the
+	// negotiated protocol, see SetStreamHandlerAuthRequired.
+	AuthRejected
+)
+
+// negotiationRecorder records what's read from an inbound stream while its
+// protocol is being negotiated, so we can tell which protocols the remote
+// peer offered when the negotiation fails.
+type negotiationRecorder struct {
+	network.Stream
+	buf       bytes.Buffer
+	recording bool
+}
+
+func (s *negotiationRecorder) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if s.recording {
+		s.buf.Write(b[:n])
+	}
+	return n, err
+}
+
+// stop stops recording once the negotiation is over.
+func (s *negotiationRecorder) stop() {
+	s.recording = false
+	s.buf = bytes.Buffer{}
+}
+
+// offered returns the protocols offered in the recorded negotiation.
+func (s *negotiationRecorder) offered() []protocol.ID {
+	var offered []protocol.ID
+	r := bytes.NewReader(s.buf.Bytes())
+	for {
+		tok, err := msmux.ReadNextToken(r)
+		if err != nil {
+			return offered
+		}
+		if tok == msmux.ProtocolID || tok == "ls" {
+			continue
+		}
+		offered = append(offered, protocol.ID(tok))
+	}
+}
+
+func (h *BasicHost) emitNegotiationFailed(s *negotiationRecorder, err error) {
+	evt := EvtStreamNegotiationFailed{
+		RemotePeer: s.Conn().RemotePeer(),
+		Offered:    s.offered(),
+		Err:        err,
+	}
+	if err := h.emitters.evtStreamNegotiationFailed.Emit(evt); err != nil {
+		h.log.Warnf("error emitting event for failed stream negotiation: %s", err)
+	}
+}
@@ -0,0 +1,31 @@
+package basichost
+
+import (
+	"runtime/debug"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// PanicHandler is called with the value recovered from a panicking stream
+// handler, the protocol it handles and the stream it was given.
+type PanicHandler func(pid protocol.ID, s network.Stream, r interface{})
+
+// runHandler runs the stream handler negotiated for s, recovering from its
+// panics. Only the goroutine of the handler is covered, not the goroutines
+// it starts.
+func (h *BasicHost) runHandler(handle protocol.HandlerFunc, protoID string, s network.Stream) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if h.panicHandler != nil {
+			h.panicHandler(protocol.ID(protoID), s, r)
+			return
+		}
+		h.log.Errorf("stream handler for %s panicked: %v\n%s", protoID, r, debug.Stack())
+		s.Reset()
+	}()
+	handle(protoID, s)
+}
@@ -0,0 +1,97 @@
+package basichost
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	msmux "github.com/multiformats/go-multistream"
+)
+
+type peerMatchHandler struct {
+	match  func(peer.ID, string) bool
+	handle msmux.HandlerFunc
+}
+
+// SetStreamHandlerMatchWithPeer sets the protocol handler on the Host's Mux
+// using a matching function that is also given the (authenticated) remote
+// peer, e.g. to only accept whitelisted peers. Like with
+// SetStreamHandlerMatch, m is called with the protocols proposed during the
+// negotiation; when it returns false, the protocol is refused and the remote
+// peer may propose another one.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlerMatchWithPeer(pid protocol.ID, m func(peer.ID, string) bool, handler network.StreamHandler) {
+	handle := h.muxHandler(pid, handler)
+
+	h.peerMatchMx.Lock()
+	h.peerMatch[pid] = peerMatchHandler{match: m, handle: handle}
+	h.peerMatchMx.Unlock()
+	h.recordProtocol(pid, true, "", nil)
+
+	// Register the protocol with the muxer so it's advertised. The muxer
+	// itself never selects it as it doesn't know the remote peer; the
+	// streams are negotiated with the muxer returned by peerMux instead.
+	h.addMuxHandler(pid, func(string) bool { return false }, handle)
+	h.emitLocalProtocolsUpdated(event.EvtLocalProtocolsUpdated{
+		Added: []protocol.ID{pid},
+	})
+}
+
+func (h *BasicHost) removePeerMatchHandler(pid protocol.ID) {
+	h.peerMatchMx.Lock()
+	delete(h.peerMatch, pid)
+	h.peerMatchMx.Unlock()
+}
+
+// peerMux returns the muxer negotiating the streams opened by p: the Host's
+// Mux, or, when there are peer-aware handlers, a muxer trying them with p
+// first and then the handlers of the Host's Mux.
+func (h *BasicHost) peerMux(p peer.ID) *msmux.MultistreamMuxer {
+	h.peerMatchMx.RLock()
+	if len(h.peerMatch) == 0 {
+		h.peerMatchMx.RUnlock()
+		return h.mux
+	}
+	handlers := make(map[protocol.ID]peerMatchHandler, len(h.peerMatch))
+	for pid, ph := range h.peerMatch {
+		handlers[pid] = ph
+	}
+	h.peerMatchMx.RUnlock()
+
+	protos := h.mux.Protocols()
+	mux := msmux.NewMultistreamMuxer()
+	for _, proto := range protos {
+		if ph, ok := handlers[protocol.ID(proto)]; ok {
+			match := ph.match
+			mux.AddHandlerWithFunc(proto, func(proposed string) bool {
+				return match(p, proposed)
+			}, ph.handle)
+		}
+	}
+	for _, proto := range protos {
+		if _, ok := handlers[protocol.ID(proto)]; !ok {
+			mux.AddHandlerWithFunc(proto, h.hasHandler, h.dispatch)
+		}
+	}
+	return mux
+}
+
+// hasHandler reports whether the Host's Mux has a handler for proto.
+func (h *BasicHost) hasHandler(proto string) bool {
+	_, ok := h.lookupHandler(proto)
+	return ok
+}
+
+// dispatch runs the handler of the Host's Mux for proto.
+func (h *BasicHost) dispatch(proto string, rwc io.ReadWriteCloser) error {
+	handle, ok := h.lookupHandler(proto)
+	if !ok {
+		rwc.Close()
+		return fmt.Errorf("no handler for %s", proto)
+	}
+	return handle(proto, rwc)
+}
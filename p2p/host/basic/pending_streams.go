@@ -0,0 +1,39 @@
+package basichost
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// pendingStream is an outbound stream whose protocol the remote peer hasn't
+// acknowledged yet. It frees its slot in the pending stream limiter once we
+// read the acknowledgement, or anything else, from the stream, or when the
+// stream is closed or reset.
+type pendingStream struct {
+	network.Stream
+	once    sync.Once
+	release func()
+}
+
+func (s *pendingStream) acknowledged() {
+	s.once.Do(s.release)
+}
+
+func (s *pendingStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 || err != nil {
+		s.acknowledged()
+	}
+	return n, err
+}
+
+func (s *pendingStream) Close() error {
+	s.acknowledged()
+	return s.Stream.Close()
+}
+
+func (s *pendingStream) Reset() error {
+	s.acknowledged()
+	return s.Stream.Reset()
+}
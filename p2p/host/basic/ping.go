@@ -0,0 +1,76 @@
+package basichost
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// PingPeer measures the round-trip time to p using the ping protocol, sending
+// ping.PingSize random bytes and waiting for them to be echoed back. The RTT
+// is recorded in the peerstore. It returns ErrProtocolNotSupported when p
+// doesn't handle the ping protocol.
+func (h *BasicHost) PingPeer(ctx context.Context, p peer.ID) (time.Duration, error) {
+	s, err := h.NewStream(ctx, p, ping.ID)
+	if err != nil {
+		if err == msmux.ErrNotSupported {
+			return 0, ErrProtocolNotSupported
+		}
+		return 0, err
+	}
+	defer s.Reset()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// abort the ping.
+			s.Reset()
+		case <-done:
+		}
+	}()
+
+	buf := make([]byte, ping.PingSize)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+
+	before := time.Now()
+	if _, err := s.Write(buf); err != nil {
+		return 0, pingError(ctx, err)
+	}
+	rbuf := make([]byte, ping.PingSize)
+	if _, err := io.ReadFull(s, rbuf); err != nil {
+		return 0, pingError(ctx, err)
+	}
+	rtt := time.Since(before)
+
+	if !bytes.Equal(buf, rbuf) {
+		return 0, errors.New("ping packet was incorrect")
+	}
+	h.Peerstore().RecordLatency(p, rtt)
+	return rtt, nil
+}
+
+// pingError translates an error on a ping stream, which may be negotiated
+// lazily.
+func pingError(ctx context.Context, err error) error {
+	switch {
+	case err == msmux.ErrNotSupported:
+		return ErrProtocolNotSupported
+	case ctx.Err() != nil:
+		return ctx.Err()
+	default:
+		return err
+	}
+}
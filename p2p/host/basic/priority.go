@@ -0,0 +1,108 @@
+package basichost
+
+import (
+	"sort"
+
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// muxRegistration is a handler the host registered on its muxer.
+type muxRegistration struct {
+	// match is nil for handlers matching the protocol exactly.
+	match  func(string) bool
+	handle msmux.HandlerFunc
+	seq    uint64
+}
+
+// SetStreamHandlerPriority sets the priority of the handler for pid, 0 by
+// default. The muxer tries the handlers in decreasing order of priority when
+// negotiating inbound streams, handlers with the same priority in the order
+// they were set, and identify advertises protocols in that order. It may be
+// called before the handler is set. Handlers registered on the Mux directly
+// are tried before the ones set through the host.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlerPriority(pid protocol.ID, priority int) {
+	h.muxRegsMx.Lock()
+	defer h.muxRegsMx.Unlock()
+
+	h.priorities[pid] = priority
+	h.reorderMuxHandlers()
+}
+
+// addMuxHandler registers handle for pid on the muxer, keeping the handlers
+// ordered by priority.
+func (h *BasicHost) addMuxHandler(pid protocol.ID, match func(string) bool, handle msmux.HandlerFunc) {
+	h.muxRegsMx.Lock()
+	defer h.muxRegsMx.Unlock()
+
+	h.muxSeq++
+	reg := muxRegistration{match: match, handle: handle, seq: h.muxSeq}
+	h.muxRegs[pid] = reg
+	h.addToMux(pid, reg)
+	if len(h.priorities) > 0 {
+		h.reorderMuxHandlers()
+	}
+}
+
+// addMuxHandlers registers the handlers matching their protocol exactly in
+// handles at once, in the order of their protocols.
+func (h *BasicHost) addMuxHandlers(handles map[protocol.ID]msmux.HandlerFunc) {
+	pids := make([]protocol.ID, 0, len(handles))
+	for pid := range handles {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+
+	h.muxRegsMx.Lock()
+	defer h.muxRegsMx.Unlock()
+
+	for _, pid := range pids {
+		h.muxSeq++
+		reg := muxRegistration{handle: handles[pid], seq: h.muxSeq}
+		h.muxRegs[pid] = reg
+		h.addToMux(pid, reg)
+	}
+	if len(h.priorities) > 0 {
+		h.reorderMuxHandlers()
+	}
+}
+
+func (h *BasicHost) removeMuxHandler(pid protocol.ID) {
+	h.muxRegsMx.Lock()
+	defer h.muxRegsMx.Unlock()
+
+	h.Mux().RemoveHandler(string(pid))
+	delete(h.muxRegs, pid)
+	delete(h.priorities, pid)
+}
+
+func (h *BasicHost) addToMux(pid protocol.ID, reg muxRegistration) {
+	if reg.match == nil {
+		h.Mux().AddHandler(string(pid), reg.handle)
+	} else {
+		h.Mux().AddHandlerWithFunc(string(pid), reg.match, reg.handle)
+	}
+}
+
+// reorderMuxHandlers registers the handlers again in order of priority. The
+// muxer moves a handler registered again to the end of its list, without
+// ever dropping it. muxRegsMx must be held.
+func (h *BasicHost) reorderMuxHandlers() {
+	pids := make([]protocol.ID, 0, len(h.muxRegs))
+	for pid := range h.muxRegs {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool {
+		pi, pj := h.priorities[pids[i]], h.priorities[pids[j]]
+		if pi != pj {
+			return pi > pj
+		}
+		return h.muxRegs[pids[i]].seq < h.muxRegs[pids[j]].seq
+	})
+
+	for _, pid := range pids {
+		h.addToMux(pid, h.muxRegs[pid])
+	}
+}
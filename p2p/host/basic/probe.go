@@ -0,0 +1,63 @@
+package basichost
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// ProbeAddr checks that addr is reachable by dialing it and checking that a
+// libp2p listener answers the multistream-select handshake that precedes the
+// security handshake. It's meant to filter the addresses returned by a custom
+// AddrsFactory. addr is dialed directly, not through the network which
+// refuses to dial ourselves, so only addresses reachable with a plain
+// connection, i.e. TCP ones, can be probed. A trailing /p2p component is
+// ignored.
+func (h *BasicHost) ProbeAddr(ctx context.Context, addr ma.Multiaddr) error {
+	if rest, last := ma.SplitLast(addr); last != nil && last.Protocol().Code == ma.P_P2P {
+		addr = rest
+	}
+	if addr == nil {
+		return fmt.Errorf("can't probe an empty address")
+	}
+	if network, _, err := manet.DialArgs(addr); err != nil || !strings.HasPrefix(network, "tcp") {
+		return fmt.Errorf("can't probe %s", addr)
+	}
+
+	var d manet.Dialer
+	c, err := d.DialContext(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// unblock the handshake when ctx is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	if err := delimWrite(c, []byte(msmux.ProtocolID)); err != nil {
+		return err
+	}
+	tok, err := msmux.ReadNextToken(c)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if tok != msmux.ProtocolID {
+		return fmt.Errorf("%s didn't answer the multistream handshake: %q", addr, tok)
+	}
+	return nil
+}
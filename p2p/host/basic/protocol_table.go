@@ -0,0 +1,87 @@
+package basichost
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// ProtocolEntry describes a protocol registered on the host, see
+// ProtocolTable. It's JSON-serializable.
+type ProtocolEntry struct {
+	// Registered is the time the handler was set. It's zero for protocols
+	// registered on the muxer directly.
+	Registered time.Time `json:"registered"`
+	// Match is true when the handler was set with a matching function.
+	Match bool `json:"match"`
+	// Description is the description given to
+	// SetStreamHandlerWithDescription, if any.
+	Description string `json:"description,omitempty"`
+}
+
+// SetStreamHandlerWithDescription is like SetStreamHandler, also recording a
+// human-readable description of the protocol in ProtocolTable.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlerWithDescription(pid protocol.ID, desc string, handler network.StreamHandler) {
+	h.setStreamHandler(pid, desc, handler, nil)
+}
+
+// SetStreamHandlerWithDeregisterHook is like SetStreamHandler, also calling
+// onRemove once the handler is removed with RemoveStreamHandler or replaced
+// by another handler for pid, so that the resources used by the handler can
+// be released. Streams already dispatched to the handler may still be
+// running when onRemove is called.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlerWithDeregisterHook(pid protocol.ID, handler network.StreamHandler, onRemove func()) {
+	h.setStreamHandler(pid, "", handler, onRemove)
+}
+
+// ProtocolTable returns the protocols the host handles, for debugging.
+// (Threadsafe)
+func (h *BasicHost) ProtocolTable() map[protocol.ID]ProtocolEntry {
+	h.protoTableMx.Lock()
+	defer h.protoTableMx.Unlock()
+
+	protos := h.Mux().Protocols()
+	table := make(map[protocol.ID]ProtocolEntry, len(protos))
+	for _, proto := range protos {
+		pid := protocol.ID(proto)
+		table[pid] = h.protoTable[pid]
+	}
+	return table
+}
+
+// recordProtocol records a new handler for pid with its deregister hook,
+// calling the hook of the handler it replaces, if any.
+func (h *BasicHost) recordProtocol(pid protocol.ID, match bool, desc string, onRemove func()) {
+	h.protoTableMx.Lock()
+	h.protoTable[pid] = ProtocolEntry{
+		Registered:  time.Now(),
+		Match:       match,
+		Description: desc,
+	}
+	prev := h.deregisterHooks[pid]
+	if onRemove != nil {
+		h.deregisterHooks[pid] = onRemove
+	} else {
+		delete(h.deregisterHooks, pid)
+	}
+	h.protoTableMx.Unlock()
+
+	if prev != nil {
+		prev()
+	}
+}
+
+func (h *BasicHost) forgetProtocol(pid protocol.ID) {
+	h.protoTableMx.Lock()
+	delete(h.protoTable, pid)
+	onRemove := h.deregisterHooks[pid]
+	delete(h.deregisterHooks, pid)
+	h.protoTableMx.Unlock()
+
+	if onRemove != nil {
+		onRemove()
+	}
+}
@@ -0,0 +1,448 @@
+package basichost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-eventbus"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+)
+
+// ErrProtocolNotSupported is returned by WaitForProtocol when the peer isn't
+// known to support the protocol before the context expires, and by PingPeer
+// when the peer doesn't handle the ping protocol.
+var ErrProtocolNotSupported = errors.New("peer does not support protocol")
+
+// WaitForProtocol blocks until the peerstore knows that p supports proto,
+// typically once identify has completed or the peer pushed a protocol
+// update. It returns ErrProtocolNotSupported if ctx expires first.
+func (h *BasicHost) WaitForProtocol(ctx context.Context, p peer.ID, proto protocol.ID) error {
+	// subscribe before checking the peerstore so we can't miss an update.
+	sub, err := h.EventBus().Subscribe([]interface{}{
+		new(event.EvtPeerProtocolsUpdated),
+		new(event.EvtPeerIdentificationCompleted),
+	}, eventbus.BufSize(16))
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	for {
+		supported, err := h.Peerstore().SupportsProtocols(p, string(proto))
+		if err != nil {
+			return err
+		}
+		if len(supported) > 0 {
+			return nil
+		}
+
+	wait:
+		for {
+			select {
+			case evt, ok := <-sub.Out():
+				if !ok {
+					return ErrProtocolNotSupported
+				}
+				switch evt := evt.(type) {
+				case event.EvtPeerProtocolsUpdated:
+					if evt.Peer == p {
+						break wait
+					}
+				case event.EvtPeerIdentificationCompleted:
+					if evt.Peer == p {
+						break wait
+					}
+				}
+			case <-ctx.Done():
+				return ErrProtocolNotSupported
+			}
+		}
+	}
+}
+
+// Protocols returns the protocols supported by p. The peerstore is used as
+// long as identify told us about the protocols of p within the configured
+// ProtocolCacheTTL. Otherwise identify is run again on one of our connections
+// to p first. When we aren't connected to p, the peerstore data is returned
+// as is.
+func (h *BasicHost) Protocols(p peer.ID) ([]protocol.ID, error) {
+	if h.protocolsStale(p) {
+		if conns := h.Network().ConnsToPeer(p); len(conns) > 0 {
+			h.ids.IdentifyConn(conns[0])
+		}
+	}
+
+	protos, err := h.Peerstore().GetProtocols(p)
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]protocol.ID, 0, len(protos))
+	for _, proto := range protos {
+		pids = append(pids, protocol.ID(proto))
+	}
+	return pids, nil
+}
+
+// ProtocolsAfterIdentify returns the protocols of the peer on the other end
+// of c once identify has completed on c, so the result reflects that
+// connection's identify response rather than whatever the peerstore held
+// before. It waits for an in-flight identify, or runs one if c hasn't been
+// identified yet, and returns an error if ctx expires or c closes first.
+func (h *BasicHost) ProtocolsAfterIdentify(ctx context.Context, c network.Conn) ([]protocol.ID, error) {
+	if _, ok := h.identifiedConns.Load(c); !ok {
+		done := make(chan struct{})
+		go func() {
+			h.ids.IdentifyConn(c)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if !h.connOpen(c) {
+		return nil, fmt.Errorf("connection to %s closed before identify completed", c.RemotePeer())
+	}
+
+	protos, err := h.Peerstore().GetProtocols(c.RemotePeer())
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]protocol.ID, 0, len(protos))
+	for _, proto := range protos {
+		pids = append(pids, protocol.ID(proto))
+	}
+	return pids, nil
+}
+
+// AwaitIdentify waits for identify to complete on any connection to p, for
+// callers that don't hold a connection. It returns an error if we aren't
+// connected to p, if the connections to p close first or if ctx expires.
+func (h *BasicHost) AwaitIdentify(ctx context.Context, p peer.ID) error {
+	conns := h.Network().ConnsToPeer(p)
+	if len(conns) == 0 {
+		return fmt.Errorf("not connected to %s", p)
+	}
+	for _, c := range conns {
+		if _, ok := h.identifiedConns.Load(c); ok {
+			return nil
+		}
+	}
+
+	done := make(chan network.Conn, len(conns))
+	for _, c := range conns {
+		go func(c network.Conn) {
+			h.ids.IdentifyConn(c)
+			done <- c
+		}(c)
+	}
+	for range conns {
+		select {
+		case c := <-done:
+			if h.connOpen(c) {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fmt.Errorf("connections to %s closed before identify completed", p)
+}
+
+// connOpen reports whether c is still one of the network's connections.
+func (h *BasicHost) connOpen(c network.Conn) bool {
+	for _, conn := range h.Network().ConnsToPeer(c.RemotePeer()) {
+		if conn == c {
+			return true
+		}
+	}
+	return false
+}
+
+// HasProtocol reports whether the peerstore knows that p supports proto. For
+// the local host, it reports whether a handler would be selected for proto.
+func (h *BasicHost) HasProtocol(p peer.ID, proto protocol.ID) bool {
+	if p == h.ID() {
+		_, ok := h.lookupHandler(string(proto))
+		return ok
+	}
+
+	supported, err := h.Peerstore().SupportsProtocols(p, string(proto))
+	return err == nil && len(supported) > 0
+}
+
+// ProtocolPeers returns the connected peers the peerstore knows support
+// proto. The peerstore doesn't index peers by protocol, so this checks each
+// connected peer.
+func (h *BasicHost) ProtocolPeers(proto protocol.ID) []peer.ID {
+	var peers []peer.ID
+	for _, p := range h.Network().Peers() {
+		if h.HasProtocol(p, proto) {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// HasProtocolRemote is like HasProtocol but, when identify told us about the
+// protocols of p longer than ProtocolCacheTTL ago, it also runs identify
+// again in the background, if we're connected to p. Unlike Protocols, it
+// doesn't wait for it: the refreshed protocols are used by subsequent calls.
+func (h *BasicHost) HasProtocolRemote(p peer.ID, proto protocol.ID) bool {
+	if p != h.ID() && h.protocolsStale(p) {
+		if conns := h.Network().ConnsToPeer(p); len(conns) > 0 {
+			go h.ids.IdentifyConn(conns[0])
+		}
+	}
+	return h.HasProtocol(p, proto)
+}
+
+// BroadcastProtocolUpdate pushes our current protocols, along with the rest
+// of our identify record, to all the connected peers supporting identify push
+// right away, without waiting for the next scheduled push. It returns once
+// every push completed, or when ctx is done.
+//
+// Unlike IdentifyPushAll, it skips the peers we know don't support identify
+// push, and doesn't fail when we aren't connected to any peer.
+func (h *BasicHost) BroadcastProtocolUpdate(ctx context.Context) error {
+	var peers []peer.ID
+	for _, p := range h.Network().Peers() {
+		// don't bother peers we know don't support identify push.
+		if supported, err := h.Peerstore().SupportsProtocols(p, identify.IDPush); err == nil && len(supported) == 0 {
+			if protos, _ := h.Peerstore().GetProtocols(p); len(protos) > 0 {
+				continue
+			}
+		}
+		peers = append(peers, p)
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	return h.identifyPushPeers(ctx, peers)
+}
+
+// Sources of the protocols returned by PeerProtocols.
+const (
+	// ProtocolSourceIdentify means identify told us about the protocol.
+	ProtocolSourceIdentify = "identify"
+	// ProtocolSourcePeerstore means the protocol was added to the peerstore
+	// by something else than identify, e.g. a routing system or user code.
+	ProtocolSourcePeerstore = "peerstore"
+)
+
+// ProtocolWithSource is a protocol of a peer along with where we learned
+// about it.
+type ProtocolWithSource struct {
+	Protocol protocol.ID
+	// Source is ProtocolSourceIdentify or ProtocolSourcePeerstore.
+	Source string
+	// UpdatedAt is when identify last told us about the protocol. It's zero
+	// for the protocols that didn't come from identify.
+	UpdatedAt time.Time
+}
+
+// PeerProtocols returns the protocols the peerstore knows for p, along with
+// where they came from. This helps debugging stale or conflicting protocol
+// information.
+func (h *BasicHost) PeerProtocols(p peer.ID) []ProtocolWithSource {
+	protos, err := h.Peerstore().GetProtocols(p)
+	if err != nil {
+		h.log.Debugf("failed to get the protocols of %s: %s", p, err)
+		return nil
+	}
+
+	h.protoUpdatedMx.Lock()
+	defer h.protoUpdatedMx.Unlock()
+	sources := h.protoSources[p]
+	out := make([]ProtocolWithSource, 0, len(protos))
+	for _, proto := range protos {
+		pws := ProtocolWithSource{Protocol: protocol.ID(proto), Source: ProtocolSourcePeerstore}
+		if at, ok := sources[pws.Protocol]; ok {
+			pws.Source = ProtocolSourceIdentify
+			pws.UpdatedAt = at
+		}
+		out = append(out, pws)
+	}
+	return out
+}
+
+// protocolsStale reports whether identify told us about the protocols of p
+// longer than ProtocolCacheTTL ago, or never did.
+func (h *BasicHost) protocolsStale(p peer.ID) bool {
+	h.protoUpdatedMx.Lock()
+	updated, ok := h.protoUpdated[p]
+	h.protoUpdatedMx.Unlock()
+	return !ok || time.Since(updated) >= h.protoCacheTTL
+}
+
+// isConnected reports whether we have at least one connection to p.
+func (h *BasicHost) isConnected(p peer.ID) bool {
+	return h.Network().Connectedness(p) == network.Connected
+}
+
+// forgetProtocolUpdates drops what identify told us about the protocols of
+// p, once we are no longer connected to it. The updates that come after are
+// ignored by trackProtocolUpdates, which checks the peer is still connected
+// under protoUpdatedMx.
+func (h *BasicHost) forgetProtocolUpdates(p peer.ID) {
+	h.protoUpdatedMx.Lock()
+	defer h.protoUpdatedMx.Unlock()
+	delete(h.protoUpdated, p)
+	delete(h.protoSources, p)
+}
+
+// trackProtocolUpdates records when identify last told us about the
+// protocols of each peer.
+func (h *BasicHost) trackProtocolUpdates(proc goprocess.Process, sub event.Subscription) {
+	defer sub.Close()
+	for {
+		select {
+		case evt, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			now := time.Now()
+			switch evt := evt.(type) {
+			case event.EvtPeerIdentificationCompleted:
+				// identify confirmed the protocols it told us about before;
+				// the new ones came with an EvtPeerProtocolsUpdated.
+				h.protoUpdatedMx.Lock()
+				if !h.isConnected(evt.Peer) {
+					h.protoUpdatedMx.Unlock()
+					continue
+				}
+				h.protoUpdated[evt.Peer] = now
+				for proto := range h.protoSources[evt.Peer] {
+					h.protoSources[evt.Peer][proto] = now
+				}
+				h.protoUpdatedMx.Unlock()
+			case event.EvtPeerProtocolsUpdated:
+				h.protoUpdatedMx.Lock()
+				if !h.isConnected(evt.Peer) {
+					h.protoUpdatedMx.Unlock()
+					continue
+				}
+				h.protoUpdated[evt.Peer] = now
+				sources := h.protoSources[evt.Peer]
+				if sources == nil {
+					sources = make(map[protocol.ID]time.Time)
+					h.protoSources[evt.Peer] = sources
+				}
+				for _, proto := range evt.Added {
+					sources[proto] = now
+				}
+				for _, proto := range evt.Removed {
+					delete(sources, proto)
+				}
+				h.protoUpdatedMx.Unlock()
+			}
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+// emitLocalProtocolsUpdated emits evt, or queues it to be coalesced with the
+// other updates within the configured ProtocolUpdateDebounce.
+func (h *BasicHost) emitLocalProtocolsUpdated(evt event.EvtLocalProtocolsUpdated) {
+	if h.protoUpdateDebounce <= 0 {
+		h.emitters.evtLocalProtocolsUpdated.Emit(evt)
+		return
+	}
+
+	h.protoUpdatesMx.Lock()
+	defer h.protoUpdatesMx.Unlock()
+
+	now := time.Now()
+	b := h.protoUpdates
+	if b == nil {
+		b = &protoUpdateBatch{
+			updates: make(map[protocol.ID]*protoUpdate),
+			start:   now,
+		}
+		b.timer = time.AfterFunc(h.protoUpdateDebounce, func() { h.flushLocalProtocolsUpdated(b) })
+		h.protoUpdates = b
+	} else {
+		// wait for the updates to settle, within protoUpdateMaxWait.
+		wait := h.protoUpdateDebounce
+		if left := b.start.Add(protoUpdateMaxWait * h.protoUpdateDebounce).Sub(now); left < wait {
+			wait = left
+		}
+		b.timer.Reset(wait)
+	}
+
+	for _, pid := range evt.Added {
+		b.update(pid, true)
+	}
+	for _, pid := range evt.Removed {
+		b.update(pid, false)
+	}
+}
+
+// protoUpdateMaxWait bounds the time the first update of a batch waits to be
+// emitted, in multiples of the debounce duration.
+const protoUpdateMaxWait = 10
+
+// protoUpdateBatch holds the local protocol updates to be emitted together.
+type protoUpdateBatch struct {
+	updates map[protocol.ID]*protoUpdate
+	start   time.Time
+	timer   *time.Timer
+}
+
+// protoUpdate tracks whether a protocol was advertised before the batch, as
+// told by its first update, and whether it is after its last update.
+type protoUpdate struct {
+	before, after bool
+}
+
+func (b *protoUpdateBatch) update(pid protocol.ID, added bool) {
+	u, ok := b.updates[pid]
+	if !ok {
+		u = &protoUpdate{before: !added}
+		b.updates[pid] = u
+	}
+	u.after = added
+}
+
+// flushLocalProtocolsUpdated emits the protocol updates of b, leaving out the
+// protocols that ended up as they were before the batch.
+func (h *BasicHost) flushLocalProtocolsUpdated(b *protoUpdateBatch) {
+	h.protoUpdatesMx.Lock()
+	if h.protoUpdates != b {
+		// already flushed, the timer was reset after firing.
+		h.protoUpdatesMx.Unlock()
+		return
+	}
+	h.protoUpdates = nil
+	h.protoUpdatesMx.Unlock()
+
+	var evt event.EvtLocalProtocolsUpdated
+	for pid, u := range b.updates {
+		switch {
+		case u.after == u.before:
+		case u.after:
+			evt.Added = append(evt.Added, pid)
+		default:
+			evt.Removed = append(evt.Removed, pid)
+		}
+	}
+	if len(evt.Added) == 0 && len(evt.Removed) == 0 {
+		return
+	}
+	sort.Slice(evt.Added, func(i, j int) bool { return evt.Added[i] < evt.Added[j] })
+	sort.Slice(evt.Removed, func(i, j int) bool { return evt.Removed[i] < evt.Removed[j] })
+	h.emitters.evtLocalProtocolsUpdated.Emit(evt)
+}
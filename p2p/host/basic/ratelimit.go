@@ -0,0 +1,82 @@
+package basichost
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// streamRateLimiterSize is the maximum number of peers we track stream
+// rates for. When more peers open streams, the least recently active peer is
+// forgotten (and starts over with a full bucket).
+const streamRateLimiterSize = 1024
+
+// EvtPeerRateLimitExceeded is emitted on the host's event bus every time an
+// inbound stream is rejected because the remote peer exceeded the per-peer
+// stream rate limit.
+type EvtPeerRateLimitExceeded struct {
+	// Peer is the peer whose stream was rejected.
+	Peer peer.ID
+}
+
+// streamRateLimiter limits the rate at which each peer may open inbound
+// streams. Every peer gets a token bucket holding up to limit tokens which
+// refills continuously over window, so a peer can open at most limit streams
+// in any sliding window of that duration.
+type streamRateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mx      sync.Mutex
+	buckets *simplelru.LRU
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newStreamRateLimiter(limit int, window time.Duration) *streamRateLimiter {
+	buckets, err := simplelru.NewLRU(streamRateLimiterSize, nil)
+	if err != nil {
+		// only fails for a non-positive size
+		panic(err)
+	}
+	return &streamRateLimiter{
+		limit:   limit,
+		window:  window,
+		buckets: buckets,
+	}
+}
+
+// Allow records a new stream from p and returns false if p has exceeded its
+// rate limit.
+func (rl *streamRateLimiter) Allow(p peer.ID) bool {
+	now := time.Now()
+
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+
+	var b *tokenBucket
+	if v, ok := rl.buckets.Get(p); ok {
+		b = v.(*tokenBucket)
+		refill := float64(rl.limit) * float64(now.Sub(b.last)) / float64(rl.window)
+		b.tokens += refill
+		if b.tokens > float64(rl.limit) {
+			b.tokens = float64(rl.limit)
+		}
+		b.last = now
+	} else {
+		b = &tokenBucket{tokens: float64(rl.limit), last: now}
+		rl.buckets.Add(p, b)
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,30 @@
+package basichost
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// readTimeoutStream pushes the read deadline of a stream back by timeout on
+// every read, see HostOpts.StreamReadTimeout.
+type readTimeoutStream struct {
+	network.Stream
+	timeout time.Duration
+}
+
+func newReadTimeoutStream(s network.Stream, timeout time.Duration) *readTimeoutStream {
+	rs := &readTimeoutStream{Stream: s, timeout: timeout}
+	rs.extendDeadline()
+	return rs
+}
+
+func (s *readTimeoutStream) extendDeadline() {
+	// streams that don't support deadlines just don't time out.
+	_ = s.Stream.SetReadDeadline(time.Now().Add(s.timeout))
+}
+
+func (s *readTimeoutStream) Read(b []byte) (int, error) {
+	s.extendDeadline()
+	return s.Stream.Read(b)
+}
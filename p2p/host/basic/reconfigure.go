@@ -0,0 +1,110 @@
+package basichost
+
+import "fmt"
+
+// ReconfigureOption is an option Reconfigure can change on a running host:
+// an AddrsFactory, an AppendAddrsFactory or DialLimits.
+type ReconfigureOption interface {
+	// check validates the option before any option is applied.
+	check() error
+	// reconfigure applies the option to h, with optsMx held, and reports
+	// whether it changed the AddrsFactory.
+	reconfigure(h *BasicHost) bool
+}
+
+// EvtHostReconfigured is emitted on the host's event bus after Reconfigure
+// applied a set of options.
+type EvtHostReconfigured struct {
+	// Options are the options that were applied.
+	Options []ReconfigureOption
+}
+
+// DialLimits can be passed to Reconfigure in order to change the limits set
+// by HostOpts.MaxConcurrentDials and HostOpts.MaxConcurrentDialsPerPeer. A
+// limit of 0 means unlimited.
+type DialLimits struct {
+	MaxConcurrentDials        int
+	MaxConcurrentDialsPerPeer int
+}
+
+func (f AddrsFactory) check() error { return nil }
+
+func (f AddrsFactory) reconfigure(h *BasicHost) bool {
+	h.AddrsFactory = f
+	return true
+}
+
+func (f AppendAddrsFactory) check() error { return nil }
+
+func (f AppendAddrsFactory) reconfigure(h *BasicHost) bool {
+	h.AddrsFactory = ChainAddrsFactories(h.AddrsFactory, AddrsFactory(f))
+	return true
+}
+
+func (l DialLimits) check() error {
+	if l.MaxConcurrentDials < 0 || l.MaxConcurrentDialsPerPeer < 0 {
+		return fmt.Errorf("invalid dial limits %d, %d", l.MaxConcurrentDials, l.MaxConcurrentDialsPerPeer)
+	}
+	return nil
+}
+
+func (l DialLimits) reconfigure(h *BasicHost) bool {
+	if h.dialLimiter == nil {
+		h.dialLimiter = newDialLimiter(l.MaxConcurrentDials, l.MaxConcurrentDialsPerPeer)
+	} else {
+		h.dialLimiter.setLimits(l.MaxConcurrentDials, l.MaxConcurrentDialsPerPeer)
+	}
+	return false
+}
+
+// Reconfigure changes options of a running host. The following options can
+// be passed:
+// * AddrsFactory
+// * AppendAddrsFactory, chained to the current AddrsFactory
+// * DialLimits
+//
+// The options are checked before any of them is applied, so on error the
+// host is unchanged.
+//
+// As with HostOpts, AddrsFactoryWithTTL takes precedence over AddrsFactory
+// when set. A changed AddrsFactory is advertised right away, as by
+// CheckForAddressChanges.
+func (h *BasicHost) Reconfigure(opts ...ReconfigureOption) error {
+	for _, o := range opts {
+		if err := o.check(); err != nil {
+			return err
+		}
+	}
+
+	addrsChanged := false
+	h.optsMx.Lock()
+	for _, o := range opts {
+		if o.reconfigure(h) {
+			addrsChanged = true
+		}
+	}
+	h.optsMx.Unlock()
+
+	if addrsChanged {
+		h.CheckForAddressChanges()
+	}
+	if err := h.emitters.evtHostReconfigured.Emit(EvtHostReconfigured{Options: opts}); err != nil {
+		h.log.Warnf("error emitting host reconfigured event: %s", err)
+	}
+	return nil
+}
+
+// addrsFactory returns the current AddrsFactory.
+func (h *BasicHost) addrsFactory() AddrsFactory {
+	h.optsMx.RLock()
+	defer h.optsMx.RUnlock()
+	return h.AddrsFactory
+}
+
+// getDialLimiter returns the current dial limiter, nil if dials are not
+// limited.
+func (h *BasicHost) getDialLimiter() *dialLimiter {
+	h.optsMx.RLock()
+	defer h.optsMx.RUnlock()
+	return h.dialLimiter
+}
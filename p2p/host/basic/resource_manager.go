@@ -0,0 +1,122 @@
+package basichost
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ResourceManager accounts for the streams and connections of the host, see
+// HostOpts.ResourceManager. Open* are called when a stream or connection is
+// opened, in either direction; returning an error rejects it. Close* are
+// called once an accepted stream or connection is closed.
+type ResourceManager interface {
+	OpenStream(network.Stream) error
+	CloseStream(network.Stream)
+	OpenConn(network.Conn) error
+	CloseConn(network.Conn)
+}
+
+// resourceScopes tracks the streams and connections admitted by the
+// resource manager, so that it's notified once and only once when they
+// close.
+type resourceScopes struct {
+	mx      sync.Mutex
+	streams map[network.Stream]struct{}
+	conns   map[network.Conn]struct{}
+}
+
+func newResourceScopes() *resourceScopes {
+	return &resourceScopes{
+		streams: make(map[network.Stream]struct{}),
+		conns:   make(map[network.Conn]struct{}),
+	}
+}
+
+// admitStream asks the resource manager, if any, for s. It resets s when
+// rejected.
+func (h *BasicHost) admitStream(s network.Stream) error {
+	if h.rcmgr == nil {
+		return nil
+	}
+	if err := h.rcmgr.OpenStream(s); err != nil {
+		s.Reset()
+		return err
+	}
+	h.scopes.mx.Lock()
+	h.scopes.streams[s] = struct{}{}
+	h.scopes.mx.Unlock()
+	return nil
+}
+
+// admitConn asks the resource manager, if any, for c. It closes c when
+// rejected.
+func (h *BasicHost) admitConn(c network.Conn) error {
+	if h.rcmgr == nil {
+		return nil
+	}
+	if err := h.rcmgr.OpenConn(c); err != nil {
+		c.Close()
+		return err
+	}
+	h.scopes.mx.Lock()
+	h.scopes.conns[c] = struct{}{}
+	h.scopes.mx.Unlock()
+	return nil
+}
+
+func (h *BasicHost) releaseStream(s network.Stream) {
+	if h.rcmgr == nil {
+		return
+	}
+	h.scopes.mx.Lock()
+	_, ok := h.scopes.streams[s]
+	delete(h.scopes.streams, s)
+	h.scopes.mx.Unlock()
+	if ok {
+		h.rcmgr.CloseStream(s)
+	}
+}
+
+func (h *BasicHost) releaseConn(c network.Conn) {
+	if h.rcmgr == nil {
+		return
+	}
+	h.scopes.mx.Lock()
+	_, ok := h.scopes.conns[c]
+	delete(h.scopes.conns, c)
+	h.scopes.mx.Unlock()
+	if ok {
+		h.rcmgr.CloseConn(c)
+	}
+}
+
+// openStream opens a new stream to p on the network, or on the connection
+// selected by the StreamDialStrategy, admitted by the resource manager.
+func (h *BasicHost) openStream(ctx context.Context, p peer.ID) (network.Stream, error) {
+	var c network.Conn
+	if h.dialStrategy != nil {
+		if conns := h.Network().ConnsToPeer(p); len(conns) > 0 {
+			c = h.dialStrategy.SelectConn(conns)
+		}
+	}
+
+	var (
+		s   network.Stream
+		err error
+	)
+	if c != nil {
+		s, err = c.NewStream()
+	} else {
+		s, err = h.Network().NewStream(ctx, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := h.admitStream(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
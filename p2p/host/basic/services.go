@@ -0,0 +1,90 @@
+package basichost
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// Service is a protocol implementation whose lifecycle is managed by the
+// host, see Register.
+type Service interface {
+	// Protocol returns the protocol the service handles.
+	Protocol() protocol.ID
+	// Start is called when the service is registered.
+	Start(host.Host) error
+	// Stop is called when the service is unregistered or the host closes.
+	Stop() error
+}
+
+// StreamService is a Service handling the streams of its protocol.
+type StreamService interface {
+	Service
+	HandleStream(network.Stream)
+}
+
+// Register starts s and, if it's a StreamService, sets it as the stream
+// handler for its protocol. s is stopped when unregistered or when the host
+// closes. Registering a service again is a no-op; registering another
+// service for the same protocol is an error.
+// (Threadsafe)
+func (h *BasicHost) Register(s Service) error {
+	pid := s.Protocol()
+
+	h.servicesMx.Lock()
+	defer h.servicesMx.Unlock()
+
+	if h.servicesClosed {
+		return fmt.Errorf("host closed")
+	}
+	if registered, ok := h.services[pid]; ok {
+		if registered == s {
+			return nil
+		}
+		return fmt.Errorf("a service is already registered for %s", pid)
+	}
+
+	if err := s.Start(h); err != nil {
+		return err
+	}
+	if ss, ok := s.(StreamService); ok {
+		h.SetStreamHandler(pid, ss.HandleStream)
+	}
+	h.services[pid] = s
+	return nil
+}
+
+// Unregister removes the stream handler of the service registered for pid,
+// if any, and stops it.
+// (Threadsafe)
+func (h *BasicHost) Unregister(pid protocol.ID) error {
+	h.servicesMx.Lock()
+	s, ok := h.services[pid]
+	delete(h.services, pid)
+	h.servicesMx.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if _, ok := s.(StreamService); ok {
+		h.RemoveStreamHandler(pid)
+	}
+	return s.Stop()
+}
+
+// stopServices stops all the registered services when the host closes.
+func (h *BasicHost) stopServices() {
+	h.servicesMx.Lock()
+	services := h.services
+	h.services = nil
+	h.servicesClosed = true
+	h.servicesMx.Unlock()
+
+	for pid, s := range services {
+		if err := s.Stop(); err != nil {
+			h.log.Warnf("error stopping the service for %s: %s", pid, err)
+		}
+	}
+}
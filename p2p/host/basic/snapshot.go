@@ -0,0 +1,114 @@
+package basichost
+
+import (
+	"sort"
+)
+
+// HostSnapshot is a point-in-time view of the state of a host, see
+// BasicHost.Snapshot. It can be encoded as JSON, e.g. for golden files.
+type HostSnapshot struct {
+	// Addrs are the addresses the host advertises.
+	Addrs []string `json:"addrs"`
+	// Peers are the connected peers, sorted by ID.
+	Peers []PeerSnapshot `json:"peers"`
+	// Streams are the open streams, sorted by peer, protocol and direction.
+	Streams []StreamSnapshot `json:"streams"`
+}
+
+// PeerSnapshot is the state of a connected peer in a HostSnapshot.
+type PeerSnapshot struct {
+	ID string `json:"id"`
+	// Addrs are the remote addresses of the connections to the peer.
+	Addrs []string `json:"addrs"`
+	// Protocols are the protocols the peerstore knows the peer supports.
+	Protocols []string `json:"protocols"`
+}
+
+// StreamSnapshot is an open stream in a HostSnapshot.
+type StreamSnapshot struct {
+	Peer      string `json:"peer"`
+	Protocol  string `json:"protocol"`
+	Direction string `json:"direction"`
+}
+
+// Snapshot captures the addresses, connected peers with their protocols, and
+// open streams of the host. All the lists are sorted so that snapshots of the
+// same state are Equal.
+func (h *BasicHost) Snapshot() HostSnapshot {
+	snap := HostSnapshot{
+		Addrs:   addrStrings(h.Addrs()),
+		Peers:   make([]PeerSnapshot, 0),
+		Streams: make([]StreamSnapshot, 0),
+	}
+	sort.Strings(snap.Addrs)
+
+	for _, p := range h.Network().Peers() {
+		ps := PeerSnapshot{ID: p.Pretty(), Addrs: make([]string, 0)}
+		for _, c := range h.Network().ConnsToPeer(p) {
+			ps.Addrs = append(ps.Addrs, c.RemoteMultiaddr().String())
+			for _, s := range c.GetStreams() {
+				snap.Streams = append(snap.Streams, StreamSnapshot{
+					Peer:      ps.ID,
+					Protocol:  string(s.Protocol()),
+					Direction: directionString(s.Stat().Direction),
+				})
+			}
+		}
+		sort.Strings(ps.Addrs)
+
+		ps.Protocols, _ = h.Peerstore().GetProtocols(p)
+		if ps.Protocols == nil {
+			ps.Protocols = make([]string, 0)
+		}
+		sort.Strings(ps.Protocols)
+
+		snap.Peers = append(snap.Peers, ps)
+	}
+
+	sort.Slice(snap.Peers, func(i, j int) bool { return snap.Peers[i].ID < snap.Peers[j].ID })
+	sort.Slice(snap.Streams, func(i, j int) bool {
+		a, b := snap.Streams[i], snap.Streams[j]
+		if a.Peer != b.Peer {
+			return a.Peer < b.Peer
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.Direction < b.Direction
+	})
+	return snap
+}
+
+// Equal reports whether s and other describe the same state. Nil and empty
+// lists are equal.
+func (s HostSnapshot) Equal(other HostSnapshot) bool {
+	if !stringsEqual(s.Addrs, other.Addrs) ||
+		len(s.Peers) != len(other.Peers) ||
+		len(s.Streams) != len(other.Streams) {
+		return false
+	}
+	for i, p := range s.Peers {
+		o := other.Peers[i]
+		if p.ID != o.ID || !stringsEqual(p.Addrs, o.Addrs) || !stringsEqual(p.Protocols, o.Protocols) {
+			return false
+		}
+	}
+	for i := range s.Streams {
+		if s.Streams[i] != other.Streams[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package basichost
+
+import (
+	"context"
+	"io"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// SetStreamHandlerWithContext sets a protocol handler given a context that is
+// cancelled when the stream is reset, by either side, when its connection
+// closes or when the host closes, so that handlers blocked on something else
+// than the stream don't outlive it. The host only notices that the remote
+// peer reset the stream on a read or write. The context is also cancelled
+// once the handler returns. It carries the ContextPropagationKeys values
+// recorded for the connection of the stream.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlerWithContext(pid protocol.ID, handler func(context.Context, network.Stream)) {
+	h.SetStreamHandler(pid, func(s network.Stream) {
+		ctx, cancel := context.WithCancel(h.propagateContextValues(h.closing, s.Conn()))
+		defer cancel()
+
+		cs := &contextStream{Stream: s, cancel: cancel}
+		c := s.Conn()
+
+		h.streamCtxsMx.Lock()
+		if h.streamCtxs[c] == nil {
+			h.streamCtxs[c] = make(map[*contextStream]struct{})
+		}
+		h.streamCtxs[c][cs] = struct{}{}
+		h.streamCtxsMx.Unlock()
+
+		defer func() {
+			h.streamCtxsMx.Lock()
+			delete(h.streamCtxs[c], cs)
+			if len(h.streamCtxs[c]) == 0 {
+				delete(h.streamCtxs, c)
+			}
+			h.streamCtxsMx.Unlock()
+		}()
+
+		handler(ctx, cs)
+	})
+}
+
+// cancelStreamContexts cancels the contexts of the handlers of the streams of
+// c.
+func (h *BasicHost) cancelStreamContexts(c network.Conn) {
+	h.streamCtxsMx.Lock()
+	defer h.streamCtxsMx.Unlock()
+	for cs := range h.streamCtxs[c] {
+		cs.cancel()
+	}
+}
+
+// contextStream cancels the context of its handler when reset.
+type contextStream struct {
+	network.Stream
+	cancel context.CancelFunc
+}
+
+func (s *contextStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if err != nil && err != io.EOF {
+		s.cancel()
+	}
+	return n, err
+}
+
+func (s *contextStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if err != nil {
+		s.cancel()
+	}
+	return n, err
+}
+
+func (s *contextStream) Reset() error {
+	err := s.Stream.Reset()
+	s.cancel()
+	return err
+}
@@ -0,0 +1,123 @@
+package basichost
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/jbenet/goprocess"
+)
+
+// streamEventsBufSize is the number of stream events we queue for emission.
+// When subscribers are too slow and the queue is full, events are dropped
+// rather than blocking the stream.
+const streamEventsBufSize = 256
+
+// EvtStreamOpened is emitted on the host's event bus when a stream is handed
+// to a stream handler (inbound) or returned by NewStream (outbound).
+type EvtStreamOpened struct {
+	Stream    network.Stream
+	Direction network.Direction
+}
+
+// EvtStreamClosed is emitted on the host's event bus the first time a stream
+// for which an EvtStreamOpened event was emitted is closed or reset locally.
+type EvtStreamClosed struct {
+	Stream       network.Stream
+	Protocol     protocol.ID
+	Duration     time.Duration
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// trackStream wraps s so that EvtStreamOpened and EvtStreamClosed events are
+// emitted for it.
+func (h *BasicHost) trackStream(s network.Stream, dir network.Direction) network.Stream {
+	ts := &trackedStream{
+		Stream: s,
+		host:   h,
+		opened: time.Now(),
+	}
+	h.metrics.streamOpened(s.Protocol(), dir)
+	h.queueStreamEvent(EvtStreamOpened{Stream: ts, Direction: dir})
+	return ts
+}
+
+func (h *BasicHost) queueStreamEvent(evt interface{}) {
+	select {
+	case h.streamEvents <- evt:
+	default:
+		h.log.Debugf("dropping stream event, subscribers are too slow: %T", evt)
+	}
+}
+
+// emitStreamEvents emits the queued stream events, decoupling the streams
+// from slow subscribers.
+func (h *BasicHost) emitStreamEvents(p goprocess.Process) {
+	for {
+		select {
+		case evt := <-h.streamEvents:
+			var err error
+			switch evt := evt.(type) {
+			case EvtStreamOpened:
+				err = h.emitters.evtStreamOpened.Emit(evt)
+			case EvtStreamClosed:
+				err = h.emitters.evtStreamClosed.Emit(evt)
+			}
+			if err != nil {
+				h.log.Debugf("error emitting stream event: %s", err)
+			}
+		case <-p.Closing():
+			return
+		}
+	}
+}
+
+type trackedStream struct {
+	network.Stream
+
+	host      *BasicHost
+	opened    time.Time
+	read      int64
+	written   int64
+	closeOnce sync.Once
+}
+
+func (s *trackedStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	atomic.AddInt64(&s.read, int64(n))
+	return n, err
+}
+
+func (s *trackedStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	atomic.AddInt64(&s.written, int64(n))
+	return n, err
+}
+
+func (s *trackedStream) Close() error {
+	err := s.Stream.Close()
+	s.closed()
+	return err
+}
+
+func (s *trackedStream) Reset() error {
+	err := s.Stream.Reset()
+	s.closed()
+	return err
+}
+
+func (s *trackedStream) closed() {
+	s.closeOnce.Do(func() {
+		s.host.queueStreamEvent(EvtStreamClosed{
+			Stream:       s,
+			Protocol:     s.Protocol(),
+			Duration:     time.Since(s.opened),
+			BytesRead:    atomic.LoadInt64(&s.read),
+			BytesWritten: atomic.LoadInt64(&s.written),
+		})
+	})
+}
@@ -0,0 +1,54 @@
+package basichost
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// SetStreamHandlerWithConnLimit sets a protocol handler that resets the
+// inbound streams of pid opened while max of them are already open, across
+// all connections. A stream counts as open until it's fully closed or reset.
+// (Threadsafe)
+func (h *BasicHost) SetStreamHandlerWithConnLimit(pid protocol.ID, max int, handler network.StreamHandler) {
+	h.SetStreamHandler(pid, func(s network.Stream) {
+		if !h.acquireStreamSlot(pid, max, baseStream(s)) {
+			h.log.Debugf("too many streams for %s, resetting the stream from %s", pid, s.Conn().RemotePeer())
+			s.Reset()
+			return
+		}
+		handler(s)
+	})
+}
+
+// ActiveStreamCount returns the number of open inbound streams of proto, when
+// its handler was set with SetStreamHandlerWithConnLimit.
+func (h *BasicHost) ActiveStreamCount(proto protocol.ID) int {
+	h.streamLimitsMx.Lock()
+	defer h.streamLimitsMx.Unlock()
+	return h.activeStreams[proto]
+}
+
+func (h *BasicHost) acquireStreamSlot(pid protocol.ID, max int, s network.Stream) bool {
+	h.streamLimitsMx.Lock()
+	defer h.streamLimitsMx.Unlock()
+	if h.activeStreams[pid] >= max {
+		return false
+	}
+	h.activeStreams[pid]++
+	h.limitedStreams[s] = pid
+	return true
+}
+
+// releaseStreamSlot is called when s closes.
+func (h *BasicHost) releaseStreamSlot(s network.Stream) {
+	h.streamLimitsMx.Lock()
+	defer h.streamLimitsMx.Unlock()
+	pid, ok := h.limitedStreams[s]
+	if !ok {
+		return
+	}
+	delete(h.limitedStreams, s)
+	if h.activeStreams[pid]--; h.activeStreams[pid] <= 0 {
+		delete(h.activeStreams, pid)
+	}
+}
@@ -0,0 +1,217 @@
+package basichost
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// maxStreamResetMsgSize is the maximum size of the message sent by
+// CloseStream. Longer messages are truncated.
+const maxStreamResetMsgSize = 1024
+
+// streamResetMarker starts a stream reset frame.
+const streamResetMarker = "\x00/libp2p/stream-reset\n"
+
+// ErrCloseStreamNotEnabled is returned by CloseStream for the streams of
+// protocols EnableCloseStream wasn't called for.
+var ErrCloseStreamNotEnabled = errors.New("CloseStream not enabled for the protocol of the stream")
+
+// protocolSet is a set of protocols safe for concurrent use.
+type protocolSet struct {
+	mx     sync.RWMutex
+	protos map[protocol.ID]struct{}
+}
+
+func (ps *protocolSet) add(pids ...protocol.ID) {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	if ps.protos == nil {
+		ps.protos = make(map[protocol.ID]struct{}, len(pids))
+	}
+	for _, pid := range pids {
+		ps.protos[pid] = struct{}{}
+	}
+}
+
+func (ps *protocolSet) has(pid protocol.ID) bool {
+	ps.mx.RLock()
+	defer ps.mx.RUnlock()
+	_, ok := ps.protos[pid]
+	return ok
+}
+
+// EnableCloseStream enables CloseStream on the streams of the given
+// protocols. The stream reset frames of CloseStream are sent in band, so
+// both peers must enable it for a protocol, and the data of the protocol
+// must never contain a frame marker: the streams of these protocols are
+// scanned for it, the streams of other protocols are left untouched. Data
+// ending with the first bytes of a marker is only returned once more data
+// shows it isn't one, or the stream ends.
+// (Threadsafe)
+func (h *BasicHost) EnableCloseStream(pids ...protocol.ID) {
+	h.closeStreamProtos.add(pids...)
+}
+
+// StreamResetError is returned by Read on a stream of the host when the
+// remote peer closed it with CloseStream.
+type StreamResetError struct {
+	Code uint32
+	Msg  string
+}
+
+func (e *StreamResetError) Error() string {
+	return fmt.Sprintf("stream reset by remote peer with code %d: %s", e.Code, e.Msg)
+}
+
+// CloseStream sends an error code and message to the remote peer of s, which
+// surfaces them as a *StreamResetError from Read, and resets the stream. Like
+// QUIC application error codes, the meaning of code is up to the protocol.
+// The remote peer needs to read from the stream to see the error. It fails
+// with ErrCloseStreamNotEnabled unless EnableCloseStream was called for the
+// protocol of s.
+// (Threadsafe)
+func (h *BasicHost) CloseStream(s network.Stream, code uint32, msg string) error {
+	if !h.closeStreamProtos.has(s.Protocol()) {
+		return ErrCloseStreamNotEnabled
+	}
+	if _, err := s.Write(encodeStreamReset(code, msg)); err != nil {
+		s.Reset()
+		return err
+	}
+	go resetAfterRemote(s)
+	return nil
+}
+
+// resetAfterRemote resets s once the remote peer is done with it. A reset
+// discards the data the remote peer didn't read yet, so we close our side and
+// wait for the remote peer to close or reset the stream after reading what we
+// wrote, discarding what it sends meanwhile, before resetting it.
+func resetAfterRemote(s network.Stream) {
+	s.Close()
+	s.SetReadDeadline(time.Now().Add(helpers.EOFTimeout))
+	io.Copy(ioutil.Discard, s)
+	s.Reset()
+}
+
+func encodeStreamReset(code uint32, msg string) []byte {
+	if len(msg) > maxStreamResetMsgSize {
+		msg = msg[:maxStreamResetMsgSize]
+	}
+
+	buf := make([]byte, len(streamResetMarker)+2*binary.MaxVarintLen64+len(msg))
+	n := copy(buf, streamResetMarker)
+	n += binary.PutUvarint(buf[n:], uint64(code))
+	n += binary.PutUvarint(buf[n:], uint64(len(msg)))
+	n += copy(buf[n:], msg)
+	return buf[:n]
+}
+
+// decodeStreamReset reads the code and message following a stream reset
+// marker from r.
+func decodeStreamReset(r io.ByteReader) (*StreamResetError, error) {
+	code, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if code > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("invalid stream reset code: %d", code)
+	}
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if l > maxStreamResetMsgSize {
+		return nil, fmt.Errorf("stream reset message too long: %d", l)
+	}
+	msg := make([]byte, l)
+	for i := range msg {
+		if msg[i], err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+	return &StreamResetError{Code: uint32(code), Msg: string(msg)}, nil
+}
+
+// streamResetStream looks for a stream reset frame in the data read from the
+// stream of a protocol CloseStream is enabled for. Data preceding the frame is
+// returned as usual. Trailing bytes that may start a marker are held back
+// until the next read tells whether they do.
+type streamResetStream struct {
+	network.Stream
+
+	// pending is the data ready to be returned, held the trailing bytes
+	// that may start a marker.
+	pending []byte
+	held    []byte
+	err     error
+}
+
+func (s *streamResetStream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return s.Stream.Read(b)
+	}
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.fill(len(b))
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// fill reads up to size bytes from the stream into pending, or sets err.
+func (s *streamResetStream) fill(size int) {
+	buf := make([]byte, len(s.held)+size)
+	copy(buf, s.held)
+	n, err := s.Stream.Read(buf[len(s.held):])
+	data := buf[:len(s.held)+n]
+	s.held = nil
+
+	if i := bytes.Index(data, []byte(streamResetMarker)); i >= 0 {
+		r := bufio.NewReader(io.MultiReader(bytes.NewReader(data[i+len(streamResetMarker):]), s.Stream))
+		if rerr, derr := decodeStreamReset(r); derr != nil {
+			s.err = fmt.Errorf("invalid stream reset frame: %s", derr)
+		} else {
+			s.err = rerr
+		}
+		s.Stream.Reset()
+		s.pending = data[:i]
+		return
+	}
+
+	if err != nil {
+		// what was held back is data after all.
+		s.pending, s.err = data, err
+		return
+	}
+	k := markerPrefixLen(data)
+	s.pending, s.held = data[:len(data)-k], data[len(data)-k:]
+}
+
+// markerPrefixLen returns the length of the longest suffix of data that is a
+// proper prefix of streamResetMarker.
+func markerPrefixLen(data []byte) int {
+	k := len(streamResetMarker) - 1
+	if k > len(data) {
+		k = len(data)
+	}
+	for ; k > 0; k-- {
+		if bytes.HasPrefix([]byte(streamResetMarker), data[len(data)-k:]) {
+			return k
+		}
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package basichost
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// streamTags holds the tags of a stream.
+type streamTags struct {
+	mx   sync.Mutex
+	tags map[string]int
+}
+
+// TagStream tags s with the given tag and value, replacing the previous value
+// of the tag, if any. Tags are removed once the stream is closed.
+func (h *BasicHost) TagStream(s network.Stream, tag string, value int) {
+	v, _ := h.streamTags.LoadOrStore(baseStream(s), &streamTags{tags: make(map[string]int)})
+	st := v.(*streamTags)
+
+	st.mx.Lock()
+	st.tags[tag] = value
+	st.mx.Unlock()
+}
+
+// UntagStream removes the given tag from s.
+func (h *BasicHost) UntagStream(s network.Stream, tag string) {
+	v, ok := h.streamTags.Load(baseStream(s))
+	if !ok {
+		return
+	}
+	st := v.(*streamTags)
+
+	st.mx.Lock()
+	delete(st.tags, tag)
+	st.mx.Unlock()
+}
+
+// StreamTagValue returns the value of the given tag of s, and whether s has
+// the tag.
+func (h *BasicHost) StreamTagValue(s network.Stream, tag string) (int, bool) {
+	v, ok := h.streamTags.Load(baseStream(s))
+	if !ok {
+		return 0, false
+	}
+	st := v.(*streamTags)
+
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	value, ok := st.tags[tag]
+	return value, ok
+}
+
+func (h *BasicHost) closedStreamNotify(_ network.Network, s network.Stream) {
+	atomic.AddInt32(&h.numStreams, -1)
+	h.streamTags.Delete(s)
+	h.releaseStream(s)
+	h.releaseStreamSlot(s)
+	h.streamDrained(s.Conn().RemotePeer())
+}
+
+// baseStream returns the network stream underlying the wrappers the host
+// hands out.
+func baseStream(s network.Stream) network.Stream {
+	for {
+		switch ws := s.(type) {
+		case *streamWrapper:
+			s = ws.Stream
+		case *trackedStream:
+			s = ws.Stream
+		case *meteredStream:
+			s = ws.Stream
+		case *handlerErrorStream:
+			s = ws.Stream
+		case *writeTrackingStream:
+			s = ws.Stream
+		case *prefixedStream:
+			s = ws.Stream
+		case *streamResetStream:
+			s = ws.Stream
+		case *pendingStream:
+			s = ws.Stream
+		case *writeTimeoutStream:
+			s = ws.Stream
+		case *readTimeoutStream:
+			s = ws.Stream
+		case *contextStream:
+			s = ws.Stream
+		case *interceptedStream:
+			s = ws.orig
+		default:
+			return s
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package basichost
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// ConnectSpanName is the name of the spans traced for Connect.
+	ConnectSpanName = "libp2p.connect"
+	// NewStreamSpanName is the name of the spans traced for NewStream.
+	NewStreamSpanName = "libp2p.newstream"
+)
+
+// Tracer starts the spans traced by a BasicHost, see HostOpts.Tracer. It
+// mirrors the part of the OpenTelemetry trace API we use, so that an
+// OpenTelemetry tracer can be plugged in with a thin adapter.
+type Tracer interface {
+	// Start starts a span, as a child of the span of ctx if any, and
+	// returns a context holding it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key, value string)
+	End()
+}
+
+// startSpan starts a span for an operation on p, returning a nil span when
+// tracing is disabled.
+func (h *BasicHost) startSpan(ctx context.Context, name string, p peer.ID) (context.Context, Span) {
+	if h.tracer == nil {
+		return ctx, nil
+	}
+	ctx, span := h.tracer.Start(ctx, name)
+	span.SetAttribute("peer.id", p.Pretty())
+	return ctx, span
+}
+
+// endSpan records the outcome of the operation of span, made over c for pid
+// when it succeeded, and ends it.
+func endSpan(span Span, c network.Conn, pid protocol.ID, err error) {
+	if span == nil {
+		return
+	}
+	if pid != "" {
+		span.SetAttribute("protocol", string(pid))
+	}
+	if c != nil {
+		span.SetAttribute("transport", transportName(c.RemoteMultiaddr()))
+	}
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+	}
+	span.End()
+}
+
+// transportName returns the name of the outermost transport protocol of a,
+// e.g. tcp, ws or quic.
+func transportName(a ma.Multiaddr) string {
+	var name string
+	for _, p := range a.Protocols() {
+		switch p.Code {
+		case ma.P_IP4, ma.P_IP6, ma.P_DNS4, ma.P_DNS6, ma.P_DNSADDR, ma.P_P2P:
+		default:
+			name = p.Name
+		}
+	}
+	return name
+}
@@ -0,0 +1,41 @@
+package basichost
+
+import (
+	"fmt"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// transportCodes returns the multiaddr protocol codes of the transports
+// named by HostOpts.TransportFilter.
+func transportCodes(names []string) ([]int, error) {
+	codes := make([]int, 0, len(names))
+	for _, name := range names {
+		p := ma.ProtocolWithName(name)
+		if p.Code == 0 {
+			return nil, fmt.Errorf("unknown transport in filter: %s", name)
+		}
+		codes = append(codes, p.Code)
+	}
+	return codes, nil
+}
+
+// filterTransports returns the addresses of addrs using one of the transports
+// of HostOpts.TransportFilter. It returns addrs unchanged when no filter is
+// configured.
+func (h *BasicHost) filterTransports(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if len(h.transports) == 0 {
+		return addrs
+	}
+
+	filtered := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		for _, code := range h.transports {
+			if _, err := a.ValueForProtocol(code); err == nil {
+				filtered = append(filtered, a)
+				break
+			}
+		}
+	}
+	return filtered
+}
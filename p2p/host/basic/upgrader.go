@@ -0,0 +1,31 @@
+package basichost
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// ConnectionUpgrader runs an application-level handshake, e.g. a capability
+// exchange, on new connections. See HostOpts.ConnectionUpgraders.
+type ConnectionUpgrader interface {
+	// Upgrade is called once identify completed on c. Returning an error
+	// closes the connection.
+	Upgrade(context.Context, network.Conn) error
+}
+
+// upgradeConn runs the connection upgraders, in order, on c. It closes c if
+// one of them fails.
+func (h *BasicHost) upgradeConn(c network.Conn) {
+	if len(h.upgraders) == 0 {
+		return
+	}
+
+	for _, u := range h.upgraders {
+		if err := u.Upgrade(h.closing, c); err != nil {
+			h.log.Debugf("failed to upgrade connection to %s: %s", c.RemotePeer(), err)
+			c.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package basichost
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// writeTimeoutStream pushes the write deadline of a stream back by timeout
+// on every write, see HostOpts.StreamWriteTimeout.
+type writeTimeoutStream struct {
+	network.Stream
+	timeout time.Duration
+}
+
+func newWriteTimeoutStream(s network.Stream, timeout time.Duration) *writeTimeoutStream {
+	ws := &writeTimeoutStream{Stream: s, timeout: timeout}
+	ws.extendDeadline()
+	return ws
+}
+
+func (s *writeTimeoutStream) extendDeadline() {
+	// streams that don't support deadlines just don't time out.
+	_ = s.Stream.SetWriteDeadline(time.Now().Add(s.timeout))
+}
+
+func (s *writeTimeoutStream) Write(b []byte) (int, error) {
+	s.extendDeadline()
+	return s.Stream.Write(b)
+}
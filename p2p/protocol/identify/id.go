@@ -2,8 +2,10 @@ package identify
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"runtime/debug"
+	"sort"
 	"sync"
 	"time"
 
@@ -72,6 +74,23 @@ type IDService struct {
 	UserAgent string
 
 	ctx context.Context
+	log Logger
+
+	// protocolFilter, if set, restricts the protocols we advertise.
+	protocolFilter func(protocol.ID) bool
+
+	// maxMessageSize, if positive, limits the size of the messages we send.
+	maxMessageSize int
+
+	// freshTTL, if positive, is how long we skip identifying the new
+	// connections to a peer after identifying it.
+	freshTTL     time.Duration
+	identifiedMu sync.Mutex
+	identified   map[peer.ID]time.Time
+
+	// pushDebounce, if positive, is how long we wait for the local protocols
+	// to stop changing before pushing a delta.
+	pushDebounce time.Duration
 
 	// connections undergoing identification
 	// for wait purposes
@@ -89,9 +108,17 @@ type IDService struct {
 		evtPeerProtocolsUpdated        event.Emitter
 		evtPeerIdentificationCompleted event.Emitter
 		evtPeerIdentificationFailed    event.Emitter
+		evtIdentifyTruncated           event.Emitter
 	}
 }
 
+// EvtIdentifyTruncated is emitted on the host's event bus when protocols were
+// left out of an identify message sent to Peer to honor MaxMessageSize.
+type EvtIdentifyTruncated struct {
+	Peer    peer.ID
+	Dropped []protocol.ID
+}
+
 // NewIDService constructs a new *IDService and activates it by
 // attaching its stream handler to the given host.Host.
 func NewIDService(ctx context.Context, h host.Host, opts ...Option) *IDService {
@@ -105,35 +132,50 @@ func NewIDService(ctx context.Context, h host.Host, opts ...Option) *IDService {
 		userAgent = cfg.userAgent
 	}
 
+	var logger Logger = log
+	if cfg.logger != nil {
+		logger = cfg.logger
+	}
+
 	s := &IDService{
 		Host:      h,
 		UserAgent: userAgent,
 
-		ctx:           ctx,
-		currid:        make(map[network.Conn]chan struct{}),
-		observedAddrs: NewObservedAddrSet(ctx),
+		ctx:            ctx,
+		log:            logger,
+		protocolFilter: cfg.protocolFilter,
+		maxMessageSize: cfg.maxMessageSize,
+		freshTTL:       cfg.freshTTL,
+		pushDebounce:   cfg.pushDebounce,
+		identified:     make(map[peer.ID]time.Time),
+		currid:         make(map[network.Conn]chan struct{}),
+		observedAddrs:  NewObservedAddrSet(ctx),
 	}
 
 	// handle local protocol handler updates, and push deltas to peers.
 	var err error
 	s.subscription, err = h.EventBus().Subscribe(&event.EvtLocalProtocolsUpdated{}, eventbus.BufSize(128))
 	if err != nil {
-		log.Warningf("identify service not subscribed to local protocol handlers updates; err: %s", err)
+		s.log.Warnf("identify service not subscribed to local protocol handlers updates; err: %s", err)
 	} else {
 		go s.handleEvents()
 	}
 
 	s.emitters.evtPeerProtocolsUpdated, err = h.EventBus().Emitter(&event.EvtPeerProtocolsUpdated{})
 	if err != nil {
-		log.Warningf("identify service not emitting peer protocol updates; err: %s", err)
+		s.log.Warnf("identify service not emitting peer protocol updates; err: %s", err)
 	}
 	s.emitters.evtPeerIdentificationCompleted, err = h.EventBus().Emitter(&event.EvtPeerIdentificationCompleted{})
 	if err != nil {
-		log.Warningf("identify service not emitting identification completed events; err: %s", err)
+		s.log.Warnf("identify service not emitting identification completed events; err: %s", err)
 	}
 	s.emitters.evtPeerIdentificationFailed, err = h.EventBus().Emitter(&event.EvtPeerIdentificationFailed{})
 	if err != nil {
-		log.Warningf("identify service not emitting identification failed events; err: %s", err)
+		s.log.Warnf("identify service not emitting identification failed events; err: %s", err)
+	}
+	s.emitters.evtIdentifyTruncated, err = h.EventBus().Emitter(&EvtIdentifyTruncated{})
+	if err != nil {
+		s.log.Warnf("identify service not emitting truncation events; err: %s", err)
 	}
 
 	h.SetStreamHandler(ID, s.requestHandler)
@@ -152,13 +194,63 @@ func (ids *IDService) handleEvents() {
 		}
 	}()
 
+	// the protocol changes waiting for the debounce timer. The last change
+	// of a protocol wins.
+	var (
+		pending map[protocol.ID]bool
+		timer   *time.Timer
+		fire    <-chan time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
 	for {
 		select {
 		case evt, more := <-sub.Out():
 			if !more {
 				return
 			}
-			ids.fireProtocolDelta(evt.(event.EvtLocalProtocolsUpdated))
+			e := evt.(event.EvtLocalProtocolsUpdated)
+			if ids.pushDebounce <= 0 {
+				ids.fireProtocolDelta(e)
+				continue
+			}
+
+			if pending == nil {
+				pending = make(map[protocol.ID]bool)
+			}
+			for _, p := range e.Added {
+				pending[p] = true
+			}
+			for _, p := range e.Removed {
+				pending[p] = false
+			}
+
+			// restart the timer on every change.
+			if timer == nil {
+				timer = time.NewTimer(ids.pushDebounce)
+			} else {
+				if fire != nil && !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(ids.pushDebounce)
+			}
+			fire = timer.C
+		case <-fire:
+			fire = nil
+			var e event.EvtLocalProtocolsUpdated
+			for p, added := range pending {
+				if added {
+					e.Added = append(e.Added, p)
+				} else {
+					e.Removed = append(e.Removed, p)
+				}
+			}
+			pending = nil
+			ids.fireProtocolDelta(e)
 		case <-ids.ctx.Done():
 			return
 		}
@@ -180,10 +272,16 @@ func (ids *IDService) IdentifyConn(c network.Conn) {
 		err error
 	)
 
+	if p := c.RemotePeer(); ids.Fresh(p) {
+		ids.log.Debugf("skipping identify of %s, identified recently", p)
+		ids.emitters.evtPeerIdentificationCompleted.Emit(event.EvtPeerIdentificationCompleted{Peer: p})
+		return
+	}
+
 	ids.currmu.Lock()
 	if wait, found := ids.currid[c]; found {
 		ids.currmu.Unlock()
-		log.Debugf("IdentifyConn called twice on: %s", c)
+		ids.log.Debugf("IdentifyConn called twice on: %s", c)
 		<-wait // already identifying it. wait for it.
 		return
 	}
@@ -207,7 +305,7 @@ func (ids *IDService) IdentifyConn(c network.Conn) {
 
 	s, err = c.NewStream()
 	if err != nil {
-		log.Debugf("error opening initial stream for %s: %s", ID, err)
+		ids.log.Debugf("error opening initial stream for %s: %s", ID, err)
 		log.Event(context.TODO(), "IdentifyOpenFailed", c.RemotePeer())
 		c.Close()
 		return
@@ -227,14 +325,22 @@ func (ids *IDService) IdentifyConn(c network.Conn) {
 
 func (ids *IDService) requestHandler(s network.Stream) {
 	defer helpers.FullClose(s)
+	ids.writeMessage(s)
+}
+
+// writeMessage writes an identify message with our current state to s.
+func (ids *IDService) writeMessage(s network.Stream) error {
 	c := s.Conn()
 
 	w := ggio.NewDelimitedWriter(s)
 	mes := pb.Identify{}
 	ids.populateMessage(&mes, s.Conn())
-	w.WriteMsg(&mes)
+	if err := w.WriteMsg(&mes); err != nil {
+		return err
+	}
 
-	log.Debugf("%s sent message to %s %s", ID, c.RemotePeer(), c.RemoteMultiaddr())
+	ids.log.Debugf("%s sent message to %s %s", ID, c.RemotePeer(), c.RemoteMultiaddr())
+	return nil
 }
 
 func (ids *IDService) responseHandler(s network.Stream) {
@@ -243,14 +349,14 @@ func (ids *IDService) responseHandler(s network.Stream) {
 	r := ggio.NewDelimitedReader(s, 2048)
 	mes := pb.Identify{}
 	if err := r.ReadMsg(&mes); err != nil {
-		log.Warning("error reading identify message: ", err)
+		ids.log.Warnf("error reading identify message: %s", err)
 		s.Reset()
 		return
 	}
 
 	defer func() { go helpers.FullClose(s) }()
 
-	log.Debugf("%s received message from %s %s", s.Protocol(), c.RemotePeer(), c.RemoteMultiaddr())
+	ids.log.Debugf("%s received message from %s %s", s.Protocol(), c.RemotePeer(), c.RemoteMultiaddr())
 	ids.consumeMessage(&mes, c)
 }
 
@@ -293,7 +399,7 @@ func (ids *IDService) broadcast(proto protocol.ID, payloadWriter func(s network.
 
 			s, err := ids.Host.NewStream(ctx, p, proto)
 			if err != nil {
-				log.Debugf("error opening push stream to %s: %s", p, err.Error())
+				ids.log.Debugf("error opening push stream to %s: %s", p, err.Error())
 				return
 			}
 
@@ -319,12 +425,19 @@ func (ids *IDService) broadcast(proto protocol.ID, payloadWriter func(s network.
 	}()
 }
 
+// advertises returns whether we tell peers we support proto.
+func (ids *IDService) advertises(proto protocol.ID) bool {
+	return ids.protocolFilter == nil || ids.protocolFilter(proto)
+}
+
 func (ids *IDService) populateMessage(mes *pb.Identify, c network.Conn) {
 	// set protocols this node is currently handling
 	protos := ids.Host.Mux().Protocols()
-	mes.Protocols = make([]string, len(protos))
-	for i, p := range protos {
-		mes.Protocols[i] = p
+	mes.Protocols = make([]string, 0, len(protos))
+	for _, p := range protos {
+		if ids.advertises(protocol.ID(p)) {
+			mes.Protocols = append(mes.Protocols, p)
+		}
 	}
 
 	// observed address so other side is informed of their
@@ -342,7 +455,7 @@ func (ids *IDService) populateMessage(mes *pb.Identify, c network.Conn) {
 		}
 		mes.ListenAddrs = append(mes.ListenAddrs, addr.Bytes())
 	}
-	log.Debugf("%s sent listen addrs to %s: %s", c.LocalPeer(), c.RemotePeer(), laddrs)
+	ids.log.Debugf("%s sent listen addrs to %s: %s", c.LocalPeer(), c.RemotePeer(), laddrs)
 
 	// set our public key
 	ownKey := ids.Host.Peerstore().PubKey(ids.Host.ID())
@@ -353,13 +466,13 @@ func (ids *IDService) populateMessage(mes *pb.Identify, c network.Conn) {
 		// check if we're even operating in "secure mode"
 		if ids.Host.Peerstore().PrivKey(ids.Host.ID()) != nil {
 			// private key is present. But NO public key. Something bad happened.
-			log.Errorf("did not have own public key in Peerstore")
+			ids.log.Errorf("did not have own public key in Peerstore")
 		}
 		// if neither of the key is present it is safe to assume that we are using an insecure transport.
 	} else {
 		// public key is present. Safe to proceed.
 		if kb, err := ownKey.Bytes(); err != nil {
-			log.Errorf("failed to convert key to bytes")
+			ids.log.Errorf("failed to convert key to bytes")
 		} else {
 			mes.PublicKey = kb
 		}
@@ -370,13 +483,59 @@ func (ids *IDService) populateMessage(mes *pb.Identify, c network.Conn) {
 	av := ids.UserAgent
 	mes.ProtocolVersion = &pv
 	mes.AgentVersion = &av
+
+	if ids.maxMessageSize > 0 {
+		ids.truncateProtocols(mes, c.RemotePeer())
+	}
+}
+
+// truncateProtocols leaves the longest protocols out of mes until it fits in
+// maxMessageSize.
+func (ids *IDService) truncateProtocols(mes *pb.Identify, p peer.ID) {
+	size := mes.Size()
+	if size <= ids.maxMessageSize {
+		return
+	}
+
+	byLength := make([]string, len(mes.Protocols))
+	copy(byLength, mes.Protocols)
+	sort.SliceStable(byLength, func(i, j int) bool { return len(byLength[i]) > len(byLength[j]) })
+
+	dropped := make(map[string]bool)
+	var evt EvtIdentifyTruncated
+	for _, proto := range byLength {
+		if size <= ids.maxMessageSize {
+			break
+		}
+		// the tag, the length prefix and the protocol itself.
+		size -= 1 + uvarintSize(uint64(len(proto))) + len(proto)
+		dropped[proto] = true
+		evt.Dropped = append(evt.Dropped, protocol.ID(proto))
+	}
+
+	kept := mes.Protocols[:0]
+	for _, proto := range mes.Protocols {
+		if !dropped[proto] {
+			kept = append(kept, proto)
+		}
+	}
+	mes.Protocols = kept
+
+	ids.log.Debugf("left %d protocols out of the identify message to %s", len(evt.Dropped), p)
+	evt.Peer = p
+	ids.emitters.evtIdentifyTruncated.Emit(evt)
+}
+
+func uvarintSize(x uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], x)
 }
 
 func (ids *IDService) consumeMessage(mes *pb.Identify, c network.Conn) {
 	p := c.RemotePeer()
 
 	// mes.Protocols
-	ids.Host.Peerstore().SetProtocols(p, mes.Protocols...)
+	ids.consumeProtocols(p, mes.Protocols)
 
 	// mes.ObservedAddr
 	ids.consumeObservedAddress(mes.GetObservedAddr(), c)
@@ -387,7 +546,7 @@ func (ids *IDService) consumeMessage(mes *pb.Identify, c network.Conn) {
 	for _, addr := range laddrs {
 		maddr, err := ma.NewMultiaddrBytes(addr)
 		if err != nil {
-			log.Debugf("%s failed to parse multiaddr from %s %s", ID,
+			ids.log.Debugf("%s failed to parse multiaddr from %s %s", ID,
 				p, c.RemoteMultiaddr())
 			continue
 		}
@@ -417,7 +576,7 @@ func (ids *IDService) consumeMessage(mes *pb.Identify, c network.Conn) {
 	}
 	ids.addrMu.Unlock()
 
-	log.Debugf("%s received listen addrs for %s: %s", c.LocalPeer(), c.RemotePeer(), lmaddrs)
+	ids.log.Debugf("%s received listen addrs for %s: %s", c.LocalPeer(), c.RemotePeer(), lmaddrs)
 
 	// get protocol versions
 	pv := mes.GetProtocolVersion()
@@ -428,6 +587,43 @@ func (ids *IDService) consumeMessage(mes *pb.Identify, c network.Conn) {
 
 	// get the key from the other side. we may not have it (no-auth transport)
 	ids.consumeReceivedPubKey(c, mes.PublicKey)
+
+	if ids.freshTTL > 0 {
+		ids.markIdentified(p)
+	}
+}
+
+// Fresh reports whether the SkipIfFresh option is set and we identified p
+// within its ttl, with the peerstore still knowing the protocols and the
+// addresses of p.
+func (ids *IDService) Fresh(p peer.ID) bool {
+	if ids.freshTTL <= 0 {
+		return false
+	}
+	ids.identifiedMu.Lock()
+	at, ok := ids.identified[p]
+	ids.identifiedMu.Unlock()
+	if !ok || time.Since(at) >= ids.freshTTL {
+		return false
+	}
+
+	pstore := ids.Host.Peerstore()
+	protos, err := pstore.GetProtocols(p)
+	return err == nil && len(protos) > 0 && len(pstore.Addrs(p)) > 0
+}
+
+// markIdentified records that we just identified p, forgetting the peers
+// identified longer than freshTTL ago.
+func (ids *IDService) markIdentified(p peer.ID) {
+	ids.identifiedMu.Lock()
+	defer ids.identifiedMu.Unlock()
+	now := time.Now()
+	for q, at := range ids.identified {
+		if now.Sub(at) >= ids.freshTTL {
+			delete(ids.identified, q)
+		}
+	}
+	ids.identified[p] = now
 }
 
 func (ids *IDService) consumeReceivedPubKey(c network.Conn, kb []byte) {
@@ -435,20 +631,20 @@ func (ids *IDService) consumeReceivedPubKey(c network.Conn, kb []byte) {
 	rp := c.RemotePeer()
 
 	if kb == nil {
-		log.Debugf("%s did not receive public key for remote peer: %s", lp, rp)
+		ids.log.Debugf("%s did not receive public key for remote peer: %s", lp, rp)
 		return
 	}
 
 	newKey, err := ic.UnmarshalPublicKey(kb)
 	if err != nil {
-		log.Warningf("%s cannot unmarshal key from remote peer: %s, %s", lp, rp, err)
+		ids.log.Warnf("%s cannot unmarshal key from remote peer: %s, %s", lp, rp, err)
 		return
 	}
 
 	// verify key matches peer.ID
 	np, err := peer.IDFromPublicKey(newKey)
 	if err != nil {
-		log.Debugf("%s cannot get peer.ID from key of remote peer: %s, %s", lp, rp, err)
+		ids.log.Debugf("%s cannot get peer.ID from key of remote peer: %s, %s", lp, rp, err)
 		return
 	}
 
@@ -459,12 +655,12 @@ func (ids *IDService) consumeReceivedPubKey(c network.Conn, kb []byte) {
 			// if local peerid is empty, then use the new, sent key.
 			err := ids.Host.Peerstore().AddPubKey(rp, newKey)
 			if err != nil {
-				log.Debugf("%s could not add key for %s to peerstore: %s", lp, rp, err)
+				ids.log.Debugf("%s could not add key for %s to peerstore: %s", lp, rp, err)
 			}
 
 		} else {
 			// we have a local peer.ID and it does not match the sent key... error.
-			log.Errorf("%s received key for remote peer %s mismatch: %s", lp, rp, np)
+			ids.log.Errorf("%s received key for remote peer %s mismatch: %s", lp, rp, np)
 		}
 		return
 	}
@@ -474,7 +670,7 @@ func (ids *IDService) consumeReceivedPubKey(c network.Conn, kb []byte) {
 		// no key? no auth transport. set this one.
 		err := ids.Host.Peerstore().AddPubKey(rp, newKey)
 		if err != nil {
-			log.Debugf("%s could not add key for %s to peerstore: %s", lp, rp, err)
+			ids.log.Debugf("%s could not add key for %s to peerstore: %s", lp, rp, err)
 		}
 		return
 	}
@@ -487,21 +683,21 @@ func (ids *IDService) consumeReceivedPubKey(c network.Conn, kb []byte) {
 	// weird, got a different key... but the different key MATCHES the peer.ID.
 	// this odd. let's log error and investigate. this should basically never happen
 	// and it means we have something funky going on and possibly a bug.
-	log.Errorf("%s identify got a different key for: %s", lp, rp)
+	ids.log.Errorf("%s identify got a different key for: %s", lp, rp)
 
 	// okay... does ours NOT match the remote peer.ID?
 	cp, err := peer.IDFromPublicKey(currKey)
 	if err != nil {
-		log.Errorf("%s cannot get peer.ID from local key of remote peer: %s, %s", lp, rp, err)
+		ids.log.Errorf("%s cannot get peer.ID from local key of remote peer: %s, %s", lp, rp, err)
 		return
 	}
 	if cp != rp {
-		log.Errorf("%s local key for remote peer %s yields different peer.ID: %s", lp, rp, cp)
+		ids.log.Errorf("%s local key for remote peer %s yields different peer.ID: %s", lp, rp, cp)
 		return
 	}
 
 	// okay... curr key DOES NOT match new key. both match peer.ID. wat?
-	log.Errorf("%s local key and received key for %s do not match, but match peer.ID", lp, rp)
+	ids.log.Errorf("%s local key and received key for %s do not match, but match peer.ID", lp, rp)
 }
 
 // HasConsistentTransport returns true if the address 'a' shares a
@@ -560,7 +756,7 @@ func (ids *IDService) consumeObservedAddress(observed []byte, c network.Conn) {
 
 	maddr, err := ma.NewMultiaddrBytes(observed)
 	if err != nil {
-		log.Debugf("error parsing received observed addr for %s: %s", c, err)
+		ids.log.Debugf("error parsing received observed addr for %s: %s", c, err)
 		return
 	}
 
@@ -570,23 +766,23 @@ func (ids *IDService) consumeObservedAddress(observed []byte, c network.Conn) {
 	// the same as the listen addr.
 	ifaceaddrs, err := ids.Host.Network().InterfaceListenAddresses()
 	if err != nil {
-		log.Infof("failed to get interface listen addrs", err)
+		ids.log.Infof("failed to get interface listen addrs: %s", err)
 		return
 	}
 
-	log.Debugf("identify identifying observed multiaddr: %s %s", c.LocalMultiaddr(), ifaceaddrs)
+	ids.log.Debugf("identify identifying observed multiaddr: %s %s", c.LocalMultiaddr(), ifaceaddrs)
 	if !addrInAddrs(c.LocalMultiaddr(), ifaceaddrs) && !addrInAddrs(c.LocalMultiaddr(), ids.Host.Network().ListenAddresses()) {
 		// not in our list
 		return
 	}
 
 	if !HasConsistentTransport(maddr, ids.Host.Addrs()) {
-		log.Debugf("ignoring observed multiaddr that doesn't match the transports of any addresses we're announcing", c.RemoteMultiaddr())
+		ids.log.Debugf("ignoring observed multiaddr that doesn't match the transports of any addresses we're announcing", c.RemoteMultiaddr())
 		return
 	}
 
 	// ok! we have the observed version of one of our ListenAddresses!
-	log.Debugf("added own observed listen addr: %s --> %s", c.LocalMultiaddr(), maddr)
+	ids.log.Debugf("added own observed listen addr: %s --> %s", c.LocalMultiaddr(), maddr)
 	ids.observedAddrs.Add(maddr, c.LocalMultiaddr(), c.RemoteMultiaddr(),
 		c.Stat().Direction)
 }
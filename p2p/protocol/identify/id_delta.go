@@ -20,14 +20,14 @@ func (ids *IDService) deltaHandler(s network.Stream) {
 	r := ggio.NewDelimitedReader(s, 2048)
 	mes := pb.Identify{}
 	if err := r.ReadMsg(&mes); err != nil {
-		log.Warning("error reading identify message: ", err)
+		ids.log.Warnf("error reading identify message: %s", err)
 		s.Reset()
 		return
 	}
 
 	defer helpers.FullClose(s)
 
-	log.Debugf("%s received message from %s %s", s.Protocol(), c.RemotePeer(), c.RemoteMultiaddr())
+	ids.log.Debugf("%s received message from %s %s", s.Protocol(), c.RemotePeer(), c.RemoteMultiaddr())
 
 	delta := mes.GetDelta()
 	if delta == nil {
@@ -36,16 +36,21 @@ func (ids *IDService) deltaHandler(s network.Stream) {
 
 	p := s.Conn().RemotePeer()
 	if err := ids.consumeDelta(p, delta); err != nil {
-		log.Warningf("delta update from peer %s failed: %s", p, err)
+		ids.log.Warnf("delta update from peer %s failed: %s", p, err)
 	}
 }
 
 // fireProtocolDelta fires a delta message to all connected peers to signal a local protocol table update.
 func (ids *IDService) fireProtocolDelta(evt event.EvtLocalProtocolsUpdated) {
+	added, removed := ids.filterProtocols(evt.Added), ids.filterProtocols(evt.Removed)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
 	mes := pb.Identify{
 		Delta: &pb.Delta{
-			AddedProtocols: protocol.ConvertToStrings(evt.Added),
-			RmProtocols:    protocol.ConvertToStrings(evt.Removed),
+			AddedProtocols: protocol.ConvertToStrings(added),
+			RmProtocols:    protocol.ConvertToStrings(removed),
 		},
 	}
 	deltaWriter := func(s network.Stream) {
@@ -53,10 +58,10 @@ func (ids *IDService) fireProtocolDelta(evt event.EvtLocalProtocolsUpdated) {
 		c := s.Conn()
 		err := ggio.NewDelimitedWriter(s).WriteMsg(&mes)
 		if err != nil {
-			log.Warningf("%s error while sending delta update to %s: %s", IDDelta, c.RemotePeer(), c.RemoteMultiaddr())
+			ids.log.Warnf("%s error while sending delta update to %s: %s", IDDelta, c.RemotePeer(), c.RemoteMultiaddr())
 			return
 		}
-		log.Debugf("%s sent delta update to %s: %s", IDDelta, c.RemotePeer(), c.RemoteMultiaddr())
+		ids.log.Debugf("%s sent delta update to %s: %s", IDDelta, c.RemotePeer(), c.RemoteMultiaddr())
 	}
 	ids.broadcast(IDDelta, deltaWriter)
 }
@@ -82,3 +87,59 @@ func (ids *IDService) consumeDelta(id peer.ID, delta *pb.Delta) error {
 	ids.emitters.evtPeerProtocolsUpdated.Emit(evt)
 	return nil
 }
+
+// consumeProtocols replaces the protocols of p in the peerstore with the full
+// list of an identify message, emitting an EvtPeerProtocolsUpdated event when
+// it differs from the list we knew.
+func (ids *IDService) consumeProtocols(p peer.ID, protos []string) {
+	old, err := ids.Host.Peerstore().GetProtocols(p)
+	if err != nil {
+		ids.log.Debugf("failed to get the protocols of %s: %s", p, err)
+	}
+	if err := ids.Host.Peerstore().SetProtocols(p, protos...); err != nil {
+		ids.log.Debugf("failed to set the protocols of %s: %s", p, err)
+		return
+	}
+
+	known := make(map[string]bool, len(old))
+	for _, proto := range old {
+		known[proto] = true
+	}
+	current := make(map[string]bool, len(protos))
+	var added []protocol.ID
+	for _, proto := range protos {
+		if !known[proto] && !current[proto] {
+			added = append(added, protocol.ID(proto))
+		}
+		current[proto] = true
+	}
+	var removed []protocol.ID
+	for _, proto := range old {
+		if !current[proto] {
+			removed = append(removed, protocol.ID(proto))
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	ids.emitters.evtPeerProtocolsUpdated.Emit(event.EvtPeerProtocolsUpdated{
+		Peer:    p,
+		Added:   added,
+		Removed: removed,
+	})
+}
+
+// filterProtocols returns the protocols of protos we advertise.
+func (ids *IDService) filterProtocols(protos []protocol.ID) []protocol.ID {
+	if ids.protocolFilter == nil {
+		return protos
+	}
+	filtered := make([]protocol.ID, 0, len(protos))
+	for _, p := range protos {
+		if ids.protocolFilter(p) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
@@ -1,6 +1,13 @@
 package identify
 
-import "github.com/libp2p/go-libp2p-core/network"
+import (
+	"context"
+	"errors"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
 
 // IDPush is the protocol.ID of the Identify push protocol. It sends full identify messages containing
 // the current state of the peer.
@@ -9,11 +16,44 @@ import "github.com/libp2p/go-libp2p-core/network"
 // resource utilisation.
 const IDPush = "/ipfs/id/push/1.0.0"
 
+// ErrNotConnected is returned by PushTo when we aren't connected to the peer.
+var ErrNotConnected = errors.New("not connected to peer")
+
 // Push pushes a full identify message to all peers containing the current state.
 func (ids *IDService) Push() {
 	ids.broadcast(IDPush, ids.requestHandler)
 }
 
+// PushTo pushes a full identify message containing the current state to p,
+// which we must already be connected to. It returns once the message was
+// sent, or when ctx is done.
+func (ids *IDService) PushTo(ctx context.Context, p peer.ID) error {
+	if ids.Host.Network().Connectedness(p) != network.Connected {
+		return ErrNotConnected
+	}
+
+	s, err := ids.Host.NewStream(network.WithNoDial(ctx, IDPush), p, IDPush)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- ids.writeMessage(s) }()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			s.Reset()
+			return err
+		}
+		go helpers.FullClose(s)
+		return nil
+	case <-ctx.Done():
+		s.Reset()
+		return ctx.Err()
+	}
+}
+
 // pushHandler handles incoming identify push streams. The behaviour is identical to the ordinary identify protocol.
 func (ids *IDService) pushHandler(s network.Stream) {
 	ids.responseHandler(s)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -458,6 +459,229 @@ func TestIdentifyDeltaWhileIdentifyingConn(t *testing.T) {
 	}
 }
 
+func TestIdentifyProtocolsUpdatedOnIdentify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	defer h1.Close()
+
+	h2.SetStreamHandler(protocol.TestingID, func(_ network.Stream) {})
+
+	ids1 := identify.NewIDService(ctx, h1)
+	_ = identify.NewIDService(ctx, h2)
+
+	// h1 remembers a protocol h2 doesn't speak anymore.
+	if err := h1.Peerstore().AddProtocols(h2.ID(), "/stale"); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := h1.EventBus().Subscribe(&event.EvtPeerProtocolsUpdated{}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+	ids1.IdentifyConn(conn)
+
+	select {
+	case evt := <-sub.Out():
+		e := evt.(event.EvtPeerProtocolsUpdated)
+		if e.Peer != h2.ID() {
+			t.Fatalf("expected an event for %s, got %s", h2.ID(), e.Peer)
+		}
+		added := protocol.ConvertToStrings(e.Added)
+		sort.Strings(added)
+		if i := sort.SearchStrings(added, string(protocol.TestingID)); i == len(added) || added[i] != string(protocol.TestingID) {
+			t.Fatalf("expected the testing protocol to be added, got %v", added)
+		}
+		if len(e.Removed) != 1 || e.Removed[0] != "/stale" {
+			t.Fatalf("expected /stale to be removed, got %v", e.Removed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event for the protocols of h2")
+	}
+}
+
+func TestIdentifyMaxMessageSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	defer h1.Close()
+
+	h2.SetStreamHandler("/short", func(_ network.Stream) {})
+	var long []protocol.ID
+	for _, c := range "abc" {
+		pid := protocol.ID("/" + strings.Repeat(string(c), 1000))
+		long = append(long, pid)
+		h2.SetStreamHandler(pid, func(_ network.Stream) {})
+	}
+
+	sub, err := h2.EventBus().Subscribe(new(identify.EvtIdentifyTruncated), eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	ids1 := identify.NewIDService(ctx, h1)
+	_ = identify.NewIDService(ctx, h2, identify.MaxMessageSize(900))
+
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	select {
+	case evt := <-sub.Out():
+		e := evt.(identify.EvtIdentifyTruncated)
+		if e.Peer != h1.ID() {
+			t.Fatalf("expected an event for %s, got %s", h1.ID(), e.Peer)
+		}
+		dropped := protocol.ConvertToStrings(e.Dropped)
+		sort.Strings(dropped)
+		if !reflect.DeepEqual(dropped, protocol.ConvertToStrings(long)) {
+			t.Fatalf("expected the %d long protocols to be dropped, got %d protocols", len(long), len(dropped))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the truncation event")
+	}
+
+	supported, err := h1.Peerstore().SupportsProtocols(h2.ID(), "/short", string(long[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(supported, []string{"/short"}) {
+		t.Fatalf("expected only the short protocol to be advertised, got %v", supported)
+	}
+	if addrs := h1.Peerstore().Addrs(h2.ID()); len(addrs) == 0 {
+		t.Fatal("expected the listen addresses to be sent")
+	}
+}
+
+func TestIdentifySkipIfFresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1 := identify.NewIDService(ctx, h1, identify.SkipIfFresh(time.Minute))
+	_ = identify.NewIDService(ctx, h2)
+
+	sub, err := h1.EventBus().Subscribe([]interface{}{
+		new(event.EvtPeerIdentificationCompleted),
+		new(event.EvtPeerIdentificationFailed),
+	}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	identifyConn := func() interface{} {
+		t.Helper()
+		if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+		c := h1.Network().ConnsToPeer(h2.ID())[0]
+		ids1.IdentifyConn(c)
+		select {
+		case <-ids1.IdentifyWait(c):
+		default:
+			t.Fatal("expected identify to be done")
+		}
+		select {
+		case evt := <-sub.Out():
+			return evt
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an identify event")
+			return nil
+		}
+	}
+
+	if _, ok := identifyConn().(event.EvtPeerIdentificationCompleted); !ok {
+		t.Fatal("expected the first identify to complete")
+	}
+	if !ids1.Fresh(h2.ID()) {
+		t.Fatal("expected the record of h2 to be fresh")
+	}
+
+	// identifying h2 again would fail, so it must be skipped.
+	h2.RemoveStreamHandler(identify.ID)
+	h1.Network().ClosePeer(h2.ID())
+	if evt, ok := identifyConn().(event.EvtPeerIdentificationCompleted); !ok {
+		t.Fatalf("expected identify to be skipped, got %v", evt)
+	}
+	if protos, _ := h1.Peerstore().GetProtocols(h2.ID()); len(protos) == 0 {
+		t.Fatal("expected the protocols of h2 to be kept")
+	}
+}
+
+func TestIdentifyPushDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	defer h1.Close()
+
+	ids1 := identify.NewIDService(ctx, h1)
+	_ = identify.NewIDService(ctx, h2, identify.PushDebounce(200*time.Millisecond))
+
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+	ids1.IdentifyConn(conn)
+
+	// let the registration of the identify handlers of h2 go through.
+	time.Sleep(300 * time.Millisecond)
+
+	sub, err := h1.EventBus().Subscribe(&event.EvtPeerProtocolsUpdated{}, eventbus.BufSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// a burst of changes, each within the debounce of the previous one.
+	for _, p := range []protocol.ID{"foo", "bar", "baz"} {
+		h2.SetStreamHandler(p, func(_ network.Stream) {})
+		time.Sleep(50 * time.Millisecond)
+	}
+	h2.RemoveStreamHandler("baz")
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(event.EvtPeerProtocolsUpdated)
+		sort.Slice(evt.Added, func(i, j int) bool { return evt.Added[i] < evt.Added[j] })
+		if len(evt.Added) != 2 || evt.Added[0] != "bar" || evt.Added[1] != "foo" {
+			t.Fatalf("expected bar and foo to be added, got %v", evt.Added)
+		}
+		if len(evt.Removed) != 1 || evt.Removed[0] != "baz" {
+			t.Fatalf("expected baz to be removed, got %v", evt.Removed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the delta")
+	}
+
+	select {
+	case e := <-sub.Out():
+		t.Fatalf("expected a single delta, got %v", e)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
 func TestUserAgent(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
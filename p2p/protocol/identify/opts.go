@@ -1,7 +1,27 @@
 package identify
 
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
 type config struct {
-	userAgent string
+	userAgent      string
+	protocolFilter func(protocol.ID) bool
+	logger         Logger
+	maxMessageSize int
+	freshTTL       time.Duration
+	pushDebounce   time.Duration
+}
+
+// Logger is the logger used by the identify service. It's implemented by
+// *zap.SugaredLogger and go-log loggers.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
 }
 
 // Option is an option function for identify.
@@ -13,3 +33,49 @@ func UserAgent(ua string) Option {
 		cfg.userAgent = ua
 	}
 }
+
+// ProtocolFilter restricts the protocols this node advertises to peers to
+// those for which f returns true. Protocols that don't pass the filter are
+// still handled.
+func ProtocolFilter(f func(protocol.ID) bool) Option {
+	return func(cfg *config) {
+		cfg.protocolFilter = f
+	}
+}
+
+// UseLogger sets the logger the identify service logs to, instead of the
+// package logger.
+func UseLogger(l Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = l
+	}
+}
+
+// MaxMessageSize limits the size of the identify messages we send to n bytes
+// by leaving out protocols, longest first. Our listen addresses are always
+// sent. An EvtIdentifyTruncated event is emitted when protocols are left out.
+func MaxMessageSize(n int) Option {
+	return func(cfg *config) {
+		cfg.maxMessageSize = n
+	}
+}
+
+// SkipIfFresh makes IdentifyConn skip identifying connections to peers we
+// identified less than ttl ago, as long as the peerstore still knows their
+// protocols and addresses. IdentifyWait returns a closed channel for such
+// connections.
+func SkipIfFresh(ttl time.Duration) Option {
+	return func(cfg *config) {
+		cfg.freshTTL = ttl
+	}
+}
+
+// PushDebounce coalesces the local protocol changes into a single delta push
+// to our peers once no change happened for d, instead of pushing every
+// change as it happens. This avoids a burst of pushes when many handlers are
+// set at once, e.g. while services start.
+func PushDebounce(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.pushDebounce = d
+	}
+}